@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/contentindex"
 	"github.com/leijurv/gb/db"
 	"github.com/leijurv/gb/storage"
 	"github.com/leijurv/gb/utils"
@@ -101,6 +102,7 @@ func (s *BackupSession) Run(rawPaths []string) {
 	s.filesWg.Wait()
 	done <- struct{}{}
 	close(s.bucketerCh)
+	contentindex.Save()
 	log.Println("Backup complete")
 }
 
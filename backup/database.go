@@ -3,13 +3,19 @@ package backup
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
 	"io"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/leijurv/gb/compression"
 	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/contentindex"
 	"github.com/leijurv/gb/crypto"
 	"github.com/leijurv/gb/db"
 	"github.com/leijurv/gb/storage"
@@ -41,7 +47,61 @@ func BackupDB() {
 	}
 	defer f.Close()
 
-	fname := "db-v2backup-" + strconv.FormatInt(GetLastSessionTimestamp(), 10)
+	now := GetLastSessionTimestamp()
+	header := make([]byte, 100)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		panic(err)
+	}
+	pageSize, err := db.PageSize(header)
+	if err != nil {
+		panic(err)
+	}
+	hashes, fileHash, size := db.HashPages(f, pageSize)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		panic(err)
+	}
+
+	state := loadIncrementalState(loc, key, storages, pageSize)
+	var changed []int64
+	if state != nil {
+		changed = db.ChangedPages(state.PageHashes, hashes)
+		if int64(len(changed))*pageSize > size/2 {
+			log.Println(len(changed), "pages of the database changed since the last backup, which is too many for an incremental backup to be worth it")
+			state = nil
+		}
+	}
+	if state == nil {
+		uploadDatabaseBackup("Database", "db-v2backup-"+strconv.FormatInt(now, 10), storages, key, f)
+		state = &incrementalState{
+			Full:     now,
+			Storages: storageIDs(storages),
+			KeyCheck: incrementalKeyCheck(key),
+			PageSize: pageSize,
+		}
+	} else {
+		log.Println("Incremental database backup of", len(changed), "changed pages on top of", state.Previous)
+		deltaReader, deltaWriter := io.Pipe()
+		go func() {
+			db.WriteDelta(deltaWriter, db.DeltaHeader{
+				Full:     state.Full,
+				Previous: state.Previous,
+				Current:  now,
+				PageSize: pageSize,
+				Size:     size,
+				Hash:     fileHash,
+			}, f, changed)
+			deltaWriter.Close()
+		}()
+		uploadDatabaseBackup("Database", "db-v2backup-"+strconv.FormatInt(state.Full, 10)+"-incremental-"+strconv.FormatInt(now, 10), storages, key, deltaReader)
+		state.Count++
+	}
+	state.Previous = now
+	state.PageHashes = hashes
+	saveIncrementalState(loc, state)
+}
+
+// also used for anything else that should be recoverable with just the database key, such as zstd dictionaries
+func uploadDatabaseBackup(what string, fname string, storages []storage_base.Storage, key []byte, in io.Reader) {
 	uploads := make([]storage_base.StorageUpload, 0)
 	writers := make([]io.Writer, 0)
 	for _, s := range storages {
@@ -52,16 +112,87 @@ func BackupDB() {
 	rawDB := utils.NewSHA256HasherSizer()
 	out := crypto.EncryptDatabaseV2(io.MultiWriter(writers...), key)
 	afterCompression := utils.NewSHA256HasherSizer()
-	compression.VerifiedCompression(&compression.ZstdCompression{}, io.MultiWriter(&afterCompression, out), io.TeeReader(f, &rawDB), &rawDB)
-	_, err = out.Write(crypto.ComputeMAC(afterCompression.Hash(), key))
+	compression.VerifiedCompression(&compression.ZstdCompression{}, io.MultiWriter(&afterCompression, out), io.TeeReader(in, &rawDB), &rawDB)
+	_, err := out.Write(crypto.ComputeMAC(afterCompression.Hash(), key))
 	if err != nil {
 		panic(err)
 	}
-	log.Println("Database", rawDB.Size(), "bytes, compressed encrypted to", afterCompression.Size(), "bytes")
+	log.Println(what, rawDB.Size(), "bytes, compressed encrypted to", afterCompression.Size(), "bytes")
 	for _, upload := range uploads {
 		upl := upload.End()
-		log.Println("DB uploaded to", upl.Path)
+		log.Println(what, "uploaded to", upl.Path)
+	}
+}
+
+// what the most recent database backup looked like, page by page, so that the next one can be an incremental on top of it
+// this lives next to the database (not in it), since it has to describe the database file as it was at the moment it was closed and uploaded
+type incrementalState struct {
+	Full       int64    // timestamp of the full backup at the start of the chain
+	Previous   int64    // timestamp of the most recent backup in the chain
+	Count      int      // how many incrementals are in the chain so far
+	Storages   []string // a storage that was added after the full backup won't have it, so the chain has to restart
+	KeyCheck   []byte   // likewise if the database key changes
+	PageSize   int64
+	PageHashes []byte
+}
+
+func loadIncrementalState(loc string, key []byte, storages []storage_base.Storage, pageSize int64) *incrementalState {
+	maxIncrementals := config.Config().DBBackupMaxIncrementals
+	if maxIncrementals == 0 {
+		os.Remove(loc + "-backupstate") // so that if this is turned on later, it doesn't pick up a stale chain
+		return nil
+	}
+	f, err := os.Open(loc + "-backupstate")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			panic(err)
+		}
+		log.Println("No record of a previous database backup, so this will be a full backup")
+		return nil
+	}
+	defer f.Close()
+	var state incrementalState
+	if err := gob.NewDecoder(f).Decode(&state); err != nil {
+		log.Println("Unable to read", loc+"-backupstate", err, "so this will be a full backup")
+		return nil
+	}
+	if state.Count >= maxIncrementals {
+		log.Println("Already", state.Count, "incremental database backups since the last full backup, so this will be a full backup")
+		return nil
+	}
+	if state.PageSize != pageSize || !bytes.Equal(state.KeyCheck, incrementalKeyCheck(key)) || strings.Join(state.Storages, ",") != strings.Join(storageIDs(storages), ",") {
+		log.Println("The database page size, database key, or set of storages has changed since the last database backup, so this will be a full backup")
+		return nil
+	}
+	return &state
+}
+
+func saveIncrementalState(loc string, state *incrementalState) {
+	if config.Config().DBBackupMaxIncrementals == 0 {
+		return
+	}
+	f, err := os.Create(loc + "-backupstate") // if this is interrupted halfway through, it will fail to decode next time, which just means a full backup
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err := gob.NewEncoder(f).Encode(state); err != nil {
+		panic(err)
+	}
+}
+
+func storageIDs(storages []storage_base.Storage) []string {
+	ids := make([]string, 0)
+	for _, s := range storages {
+		ids = append(ids, hex.EncodeToString(s.GetID()))
 	}
+	sort.Strings(ids)
+	return ids
+}
+
+func incrementalKeyCheck(key []byte) []byte {
+	check := sha256.Sum256([]byte("gb incremental database backup key check"))
+	return crypto.ComputeMAC(check[:], key) // so the key itself isn't sitting in plaintext next to the database
 }
 
 func DBKey() []byte {
@@ -90,6 +221,34 @@ func dbKeyImpl(interactive bool) []byte {
 	return key
 }
 
+// generate a new database key. database backups already in storage remain readable with (only) the old one
+func RotateDBKey() (oldKey []byte, newKey []byte) {
+	return rotateDBKeyImpl(true)
+}
+
+func RotateDBKeyNonInteractive() (oldKey []byte, newKey []byte) {
+	return rotateDBKeyImpl(false)
+}
+
+func rotateDBKeyImpl(interactive bool) ([]byte, []byte) {
+	oldKey := dbKeyImpl(interactive)
+	newKey := crypto.RandBytes(16)
+	if interactive {
+		log.Println("This is your NEW database encryption key, the old one will only decrypt database backups from before now")
+		Mnemonic(newKey)
+	}
+	contentindex.Rekey(oldKey, newKey, func() {
+		_, err := db.DB.Exec("UPDATE db_key SET key = ? WHERE id = 0", newKey)
+		if err != nil {
+			log.Println("The database key was NOT rotated, the new key printed above is useless")
+			panic(err)
+		}
+	})
+	// no need to touch the incremental backup state, the next BackupDB will notice the key changed and do a full backup
+	log.Println("Database key rotated")
+	return oldKey, newKey
+}
+
 func Mnemonic(key []byte) {
 	mnemonic, err := bip39.NewMnemonic(key)
 	if err != nil {
@@ -116,3 +275,50 @@ func Mnemonic(key []byte) {
 		panic("must confirm")
 	}
 }
+
+// the database key encrypted with a passphrase, for when the plain mnemonic is too much of a liability to write down
+func PassphraseWrappedKey(key []byte) {
+	reader := bufio.NewReader(os.Stdin)
+	log.Print("Enter a passphrase to protect the database encryption key with: ")
+	passphrase := utils.ReadPassphrase(reader)
+	log.Print("Enter it again: ")
+	again := utils.ReadPassphrase(reader)
+	if passphrase != again {
+		panic("passphrases did not match")
+	}
+	if len(passphrase) < 8 {
+		panic("gb cannot in good conscience condone such an insecure passphrase")
+	}
+	wrapped := crypto.WrapKeyWithPassphrase(key, passphrase)
+	unwrapped, err := crypto.UnwrapKeyWithPassphrase(wrapped, passphrase)
+	if err != nil || !bytes.Equal(unwrapped, key) {
+		panic("passphrase wrapping bad?? wtf")
+	}
+	log.Println("Your passphrase protected database encryption key is:", wrapped)
+	log.Println("\"gb restoredb\" accepts this in place of the mnemonic, and will then ask for the passphrase. If you forget the passphrase, this is useless")
+}
+
+// the database key split into shamir shares, any threshold of which recover it, and fewer than threshold of which reveal nothing
+func SplitMnemonic(key []byte, threshold int, count int) {
+	mnemonics := crypto.SplitKeyMnemonics(key, threshold, count)
+	// <paranoia>
+	shares := make([]crypto.KeyShare, 0)
+	for _, mnemonic := range mnemonics[count-threshold:] {
+		share, err := crypto.ParseKeyShareMnemonic(mnemonic)
+		if err != nil {
+			panic(err)
+		}
+		shares = append(shares, share)
+	}
+	test, err := crypto.CombineKeyShares(shares)
+	if err != nil || !bytes.Equal(test, key) {
+		panic("shamir bad?? wtf")
+	}
+	// </paranoia>
+	log.Println("Your database encryption key, split into", count, "shares, any", threshold, "of which are needed to recover it:")
+	for i, mnemonic := range mnemonics {
+		log.Println("Share", i+1, "of", count, ":", mnemonic)
+	}
+	log.Println("\"gb restoredb\" accepts any one of these in place of the mnemonic, and will then ask for the rest")
+	log.Println("Each share is useless on its own, but keep in mind that this does nothing about the plain mnemonic (\"gb mnemonic\"), or the unencrypted database file (" + config.Config().DatabaseLocation + "), both of which are sufficient by themselves")
+}
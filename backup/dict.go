@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/leijurv/gb/compression"
+	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/storage"
+	"github.com/leijurv/gb/utils"
+)
+
+// same as `zstd --train`
+const zstdDictSize = 112640
+
+// train a zstd dictionary on a random sample of the small files that are currently backed up (with this extension, or any if empty)
+// small files backed up from now on will be compressed with it
+func TrainZstdDict(extension string, maxSamples int) {
+	extension = strings.TrimPrefix(strings.ToLower(extension), ".")
+	query := "SELECT files.path FROM files INNER JOIN sizes USING (hash) WHERE files.end IS NULL AND sizes.size BETWEEN ? AND ?"
+	args := []interface{}{config.Config().MinCompressSize, config.Config().ZstdDictMaxSize}
+	if extension != "" {
+		query += " AND LOWER(SUBSTR(files.path, -?)) = ?"
+		args = append(args, len(extension)+1, "."+extension)
+	}
+	query += " ORDER BY RANDOM() LIMIT ?"
+	args = append(args, maxSamples)
+	rows, err := db.DB.Query(query, args...)
+	db.Must(err)
+	paths := make([]string, 0)
+	for rows.Next() {
+		var path string
+		db.Must(rows.Scan(&path))
+		paths = append(paths, path)
+	}
+	db.Must(rows.Err())
+	rows.Close()
+
+	samples := make([][]byte, 0, len(paths))
+	var total int64
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Println("Skipping", path, "because", err)
+			continue
+		}
+		samples = append(samples, data)
+		total += int64(len(data))
+	}
+	if len(samples) == 0 {
+		panic("there are no small files (between min_compress_size and zstd_dict_max_size) to train a dictionary on")
+	}
+	log.Println("Training a zstd dictionary on", len(samples), "files totaling", utils.FormatCommas(total), "bytes")
+	content, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: zstdDictSize, HashBytes: 6})
+	if err != nil {
+		log.Println("Unable to train a dictionary, perhaps there aren't enough samples?")
+		panic(err)
+	}
+
+	// see if it's any good
+	var without, with int64
+	for _, sample := range samples {
+		without += compressedSize(&compression.ZstdCompression{}, sample)
+		with += compressedSize(&compression.ZstdCompression{Dict: &compression.ZstdDict{Content: content}}, sample)
+	}
+	log.Println("These files compress to", utils.FormatCommas(without), "bytes with zstd, and", utils.FormatCommas(with), "bytes with the dictionary (which is itself", utils.FormatCommas(int64(len(content))), "bytes)")
+
+	// the database has the dictionary, and so does every storage, encrypted like a database backup
+	hash := sha256.Sum256(content)
+	uploadDatabaseBackup("Dictionary", "zstd-dict-"+hex.EncodeToString(hash[:]), storage.GetAll(), DBKey(), bytes.NewReader(content))
+	result, err := db.DB.Exec("INSERT INTO zstd_dictionaries (extension, content, hash, created) VALUES (?, ?, ?, ?)", extension, content, hash[:], time.Now().Unix())
+	db.Must(err)
+	id, err := result.LastInsertId()
+	db.Must(err)
+	compression.ForgetZstdDictChoices()
+	if extension == "" {
+		log.Println("Saved as dictionary", id, "which will be used for files up to zstd_dict_max_size bytes that would have been compressed with zstd, unless there is a dictionary for their extension")
+	} else {
+		log.Println("Saved as dictionary", id, "which will be used for ."+extension, "files up to zstd_dict_max_size bytes that would have been compressed with zstd")
+	}
+	if config.Config().PublicKey != "" {
+		log.Println("Note that the dictionary is made of snippets of these files, and it's in the database in plaintext, even though public_key is set")
+	}
+}
+
+func compressedSize(c compression.Compression, data []byte) int64 {
+	var out bytes.Buffer
+	if err := c.Compress(&out, bytes.NewReader(data)); err != nil {
+		panic(err)
+	}
+	return int64(out.Len())
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 
 	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/contentindex"
 	"github.com/leijurv/gb/db"
 	"github.com/leijurv/gb/utils"
 )
@@ -26,7 +27,9 @@ func (s *BackupSession) hashOneFile(plan HashPlan) {
 	// now, it's time to hash the file to see if it needs to be backed up or if we've already got it
 	log.Println("Beginning read for sha256 calc:", path)
 
-	hash, size, err := s.hashAFile(path)
+	// if it turns out to be backed up already, this is the only time it's read, so it's indexed from here
+	text := contentindex.NewCollector(path, info.Size())
+	hash, size, err := s.hashAFile(path, text)
 	if err != nil {
 		if config.Config().SkipHashFailures {
 			log.Println("Skipping", path, "due to", err, "(maybe it was deleted?) because skip_hash_failures is true")
@@ -49,6 +52,7 @@ func (s *BackupSession) hashOneFile(plan HashPlan) {
 		// this is VERY uncommon, so it is NOT worth maintaining a db WRITE transaction for it sadly
 		_, err := db.DB.Exec("UPDATE files SET fs_modified = ?, permissions = ? WHERE path = ? AND end IS NULL", info.ModTime().Unix(), info.Mode()&os.ModePerm, path)
 		db.Must(err)
+		contentindex.Add(hash, text)
 		return
 	}
 
@@ -70,6 +74,7 @@ func (s *BackupSession) hashOneFile(plan HashPlan) {
 			// yeah so we already have this hash backed up, so the train stops here. we just need to add this to files table, and we're done!
 			s.fileHasKnownData(tx, path, info, hash)
 			db.Must(tx.Commit())
+			contentindex.Add(hash, text)
 			return nil // done, no need to upload
 		}
 		if err != db.ErrNoRows {
@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"log"
+	"os"
+
+	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/crypto"
+	"github.com/leijurv/gb/db"
+)
+
+func configuredPublicKey() *ecdh.PublicKey {
+	if config.Config().PublicKey == "" {
+		return nil
+	}
+	pub, err := crypto.ParsePublicKey(config.Config().PublicKey)
+	if err != nil {
+		log.Println("public_key in the config file is not a valid X25519 public key")
+		panic(err)
+	}
+	return pub
+}
+
+// what goes in the encryption_key and sealed_key columns of blob_entries for this key
+// exactly one will be non-nil. with a public_key configured, the plaintext key is never written to the database
+func EntryKeyColumns(key []byte) ([]byte, []byte) {
+	pub := configuredPublicKey()
+	if pub == nil {
+		return key, nil
+	}
+	return nil, crypto.SealKey(key, pub)
+}
+
+func GenerateKeyPair(privateKeyFile string) {
+	priv, pub := crypto.GenerateKeyPair()
+	// O_EXCL: overwriting a private key file would make every backup sealed to it unreadable
+	f, err := os.OpenFile(privateKeyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := f.Write([]byte(hex.EncodeToString(priv.Bytes()) + "\n")); err != nil {
+		panic(err)
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+	log.Println("Wrote the private key to", privateKeyFile)
+	log.Println("Keep it (and a copy of it!) somewhere other than the machines you back up from. It is needed to restore, cat, mount, share and paranoia.")
+	log.Println("On the machines you back up from, add this to the config file:")
+	log.Println(`    "public_key": "` + hex.EncodeToString(pub.Bytes()) + `"`)
+	log.Println("And on the machine(s) that read backups, add this:")
+	log.Println(`    "private_key_file": "` + privateKeyFile + `"`)
+	log.Println("Then run `gb seal-keys` to seal the keys of everything that was backed up before this")
+}
+
+// replace every plaintext encryption_key with one sealed to the configured public key
+func SealExistingKeys() {
+	pub := configuredPublicKey()
+	if pub == nil {
+		panic("there is no public_key in the config file, run `gb generate-keypair` first")
+	}
+	tx, err := db.DB.Begin()
+	db.Must(err)
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT DISTINCT blob_id, encryption_key FROM blob_entries WHERE encryption_key IS NOT NULL")
+	db.Must(err)
+	type distinctKey struct {
+		blobID []byte
+		key    []byte
+	}
+	keys := make([]distinctKey, 0)
+	for rows.Next() {
+		var k distinctKey
+		db.Must(rows.Scan(&k.blobID, &k.key))
+		keys = append(keys, k)
+	}
+	db.Must(rows.Err())
+	rows.Close()
+	var sealed int64
+	for _, k := range keys {
+		// old blobs can have one key shared by every entry. seal it once so that they still share one sealed_key, which is what the shared key checks look for
+		result, err := tx.Exec("UPDATE blob_entries SET encryption_key = NULL, sealed_key = ? WHERE blob_id = ? AND encryption_key = ?", crypto.SealKey(k.key, pub), k.blobID, k.key)
+		db.Must(err)
+		cnt, err := result.RowsAffected()
+		db.Must(err)
+		sealed += cnt
+	}
+	db.Must(tx.Commit())
+	log.Println("Sealed the keys of", sealed, "blob entries")
+	if sealed > 0 {
+		log.Println("The database no longer contains them, but existing database backups still do!")
+		log.Println("Consider `gb rotate-db-key --delete-old-backups` so that those old backups can't be decrypted")
+	}
+}
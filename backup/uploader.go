@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/leijurv/gb/compression"
+	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/contentindex"
 	"github.com/leijurv/gb/crypto"
 	"github.com/leijurv/gb/db"
 	"github.com/leijurv/gb/utils"
@@ -60,8 +62,12 @@ func (s *BackupSession) executeBlobUploadPlan(plan BlobPlan, serv UploadService)
 		postCompressionSize int64
 		preCompressionSize  int64
 		compression         string
+		sampled             string
+		encryption          string
+		text                *contentindex.Collector
 	}
 	entries := make([]blobEntry, 0)
+	encryption := config.Config().BlobEncryption
 
 	for _, planned := range plan {
 		log.Println("Adding", planned.File)
@@ -80,8 +86,16 @@ func (s *BackupSession) executeBlobUploadPlan(plan BlobPlan, serv UploadService)
 			continue
 		}
 		s.addCurrentlyUploading(planned.path, &verify)
-		encryptedOut, key := crypto.EncryptBlob(postEncOut, startOffset)
-		compAlg := compression.Compress(compression.SelectCompressionForPath(planned.path), encryptedOut, io.TeeReader(f, &verify), &verify)
+		in := io.TeeReader(f, &verify)
+		text := contentindex.NewCollector(planned.path, planned.info.Size())
+		if text != nil {
+			in = io.TeeReader(in, text)
+		}
+		encryptedOut, key := crypto.EncryptBlobEntry(postEncOut, startOffset, encryption)
+		compAlg, sampled := compression.CompressSampled(compression.SelectCompressionForPath(planned.path, planned.info.Size()), encryptedOut, in, &verify)
+		if err := encryptedOut.Close(); err != nil {
+			panic(err)
+		}
 		s.finishedUploading(planned.path)
 		f.Close()
 		realHash, realSize := verify.HashAndSize()
@@ -102,6 +116,9 @@ func (s *BackupSession) executeBlobUploadPlan(plan BlobPlan, serv UploadService)
 			preCompressionSize:  realSize,
 			postCompressionSize: length,
 			compression:         compAlg,
+			sampled:             sampled,
+			encryption:          encryption,
+			text:                text,
 		})
 	}
 	if len(entries) == 0 {
@@ -167,7 +184,8 @@ func (s *BackupSession) executeBlobUploadPlan(plan BlobPlan, serv UploadService)
 			s.fileHasKnownData(tx, entry.originalPlan.path, entry.originalPlan.info, entry.hash)
 		}
 		// and either way, make a note of what hash is stored in this blob at this location
-		_, err = tx.Exec("INSERT INTO blob_entries (hash, blob_id, encryption_key, final_size, offset, compression_alg) VALUES (?, ?, ?, ?, ?, ?)", entry.hash, blobID, entry.key, entry.postCompressionSize, entry.offset, entry.compression)
+		plainKey, sealedKey := EntryKeyColumns(entry.key)
+		_, err = tx.Exec("INSERT INTO blob_entries (hash, blob_id, encryption_key, sealed_key, final_size, offset, compression_alg, encryption_alg, sampled) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", entry.hash, blobID, plainKey, sealedKey, entry.postCompressionSize, entry.offset, entry.compression, entry.encryption, entry.sampled)
 		db.Must(err)
 	}
 	log.Println("Uploader done with blob", plan)
@@ -175,6 +193,9 @@ func (s *BackupSession) executeBlobUploadPlan(plan BlobPlan, serv UploadService)
 	txCommitted = true // err on the side of caution - if tx.Commit returns an err, very likely it did not actually commit, but, it's possible! so don't delete the blob if there's ANY chance that the db is expecting this blob to exist.
 	db.Must(tx.Commit())
 	log.Println("Committed uploaded blob")
+	for _, entry := range entries {
+		contentindex.Add(entry.hash, entry.text)
+	}
 }
 
 func (s *BackupSession) fileHasKnownData(tx *sql.Tx, path string, info os.FileInfo, hash []byte) {
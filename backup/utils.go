@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/contentindex"
 	"github.com/leijurv/gb/storage_base"
 	"github.com/leijurv/gb/utils"
 )
@@ -100,18 +101,23 @@ type BackupSession struct {
 var lastSessionTime int64
 var lastSessionTimeLock sync.Mutex
 
-// NewBackupSession creates a new backup session with all state initialized.
-func NewBackupSession() *BackupSession {
+// ReserveSessionTimestamp returns a timestamp strictly after every one handed out so far,
+// and makes it the one returned by GetLastSessionTimestamp (which is what BackupDB names its upload after).
+func ReserveSessionTimestamp() int64 {
 	lastSessionTimeLock.Lock()
+	defer lastSessionTimeLock.Unlock()
 	now := time.Now().Unix()
 	if now <= lastSessionTime {
 		now = lastSessionTime + 1
 	}
 	lastSessionTime = now
-	lastSessionTimeLock.Unlock()
+	return now
+}
 
+// NewBackupSession creates a new backup session with all state initialized.
+func NewBackupSession() *BackupSession {
 	return &BackupSession{
-		now:                 now,
+		now:                 ReserveSessionTimestamp(),
 		sizeClaimMap:        make(map[int64]*sizeClaim),
 		hashLateMap:         make(map[[32]byte][]File),
 		hasherCh:            make(chan HashPlan),
@@ -267,14 +273,19 @@ func SamplePaddingLength(size int64) int64 {
 	return ret
 }
 
-func (s *BackupSession) hashAFile(path string) ([]byte, int64, error) {
+// text can be nil, otherwise what's read is also written to it
+func (s *BackupSession) hashAFile(path string, text *contentindex.Collector) ([]byte, int64, error) {
 	f, err := s.FileOpener.Open(path)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer f.Close()
 	hs := utils.NewSHA256HasherSizer()
-	if _, err := io.CopyBuffer(&hs, f, make([]byte, 1024*1024)); err != nil {
+	var out io.Writer = &hs
+	if text != nil {
+		out = io.MultiWriter(&hs, text)
+	}
+	if _, err := io.CopyBuffer(out, f, make([]byte, 1024*1024)); err != nil {
 		return nil, 0, err
 	}
 	hash, size := hs.HashAndSize()
@@ -0,0 +1,285 @@
+package compression
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/utils"
+)
+
+// only the start of huge files is benchmarked, otherwise zstd -19 and xz would take all day
+const benchMaxFileBytes = 4 * 1024 * 1024
+
+// a level is only worth suggesting if it saves this much more than the default
+const benchMinLevelImprovement = 0.05
+
+var benchZstdLevels = []int{1, 3, 9, 19}
+
+type benchCandidate struct {
+	name        string
+	compression Compression
+	zstdLevel   int // 0 if not a zstd level other than the default
+}
+
+type benchResult struct {
+	name           string
+	zstdLevel      int
+	inBytes        int64
+	outBytes       int64
+	compressTime   time.Duration
+	decompressTime time.Duration
+	failed         bool // fallible compression that couldn't handle one of the samples
+}
+
+func (r benchResult) ratio() float64 {
+	if r.inBytes == 0 {
+		return 1
+	}
+	return float64(r.outBytes) / float64(r.inBytes)
+}
+
+type extensionBench struct {
+	extension string
+	files     int
+	bytes     int64
+	results   []benchResult
+}
+
+// try every compression (and a few zstd levels) on a sample of the files under path, grouped by extension
+func Bench(path string, samplesPerExtension int) {
+	samples := benchSampleFiles(path, samplesPerExtension)
+	if len(samples) == 0 {
+		log.Println("There are no files of at least min_compress_size bytes under", path)
+		return
+	}
+	extensions := make([]string, 0, len(samples))
+	for ext := range samples {
+		extensions = append(extensions, ext)
+	}
+	sort.Strings(extensions)
+	benches := make([]extensionBench, 0, len(extensions))
+	for _, ext := range extensions {
+		data := make([][]byte, 0, len(samples[ext]))
+		for _, p := range samples[ext] {
+			d, err := benchReadFile(p)
+			if err != nil {
+				log.Println("Skipping", p, "because", err)
+				continue
+			}
+			data = append(data, d)
+		}
+		if len(data) == 0 {
+			continue
+		}
+		log.Println("Benchmarking", len(data), "files with extension", benchExtensionName(ext))
+		benches = append(benches, benchExtension(ext, data))
+	}
+	for _, b := range benches {
+		printExtensionBench(b)
+	}
+	fmt.Println()
+	suggestions := benchSuggestions(benches)
+	if len(suggestions) == 0 {
+		fmt.Println("No suggestions, your config looks good for these files")
+		return
+	}
+	fmt.Println("Suggestions:")
+	for _, s := range suggestions {
+		fmt.Println("  " + s)
+	}
+}
+
+// extension -> paths, at most samplesPerExtension of each (reservoir sampled, so it's a uniform sample)
+func benchSampleFiles(path string, samplesPerExtension int) map[string][]string {
+	samples := make(map[string][]string)
+	seen := make(map[string]int)
+	utils.WalkFiles(path, func(p string, info os.FileInfo) {
+		if info.Size() < config.Config().MinCompressSize {
+			return
+		}
+		ext := benchExtensionOf(p)
+		seen[ext]++
+		if len(samples[ext]) < samplesPerExtension {
+			samples[ext] = append(samples[ext], p)
+		} else if i := rand.Intn(seen[ext]); i < samplesPerExtension {
+			samples[ext][i] = p
+		}
+	})
+	return samples
+}
+
+func benchExtensionOf(path string) string {
+	base := strings.ToLower(filepath.Base(path))
+	idx := strings.LastIndex(base, ".")
+	if idx <= 0 {
+		return ""
+	}
+	return base[idx+1:]
+}
+
+func benchExtensionName(ext string) string {
+	if ext == "" {
+		return "(none)"
+	}
+	return "." + ext
+}
+
+func benchReadFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, benchMaxFileBytes))
+}
+
+func benchCandidates(ext string) []benchCandidate {
+	names := make([]string, 0, len(compressionMap))
+	for name := range compressionMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := make([]benchCandidate, 0)
+	for _, name := range names {
+		c := compressionMap[name]
+		if name == "" {
+			continue
+		}
+		if name == "lepton" && ext != "jpg" && ext != "jpeg" {
+			continue
+		}
+		if name == "redeflate" && !IsRedeflateExt("."+ext) {
+			continue
+		}
+		ret = append(ret, benchCandidate{name: name, compression: c})
+	}
+	for _, level := range benchZstdLevels {
+		ret = append(ret, benchCandidate{name: "zstd level " + strconv.Itoa(level), compression: &ZstdCompression{Level: level}, zstdLevel: level})
+	}
+	return ret
+}
+
+func benchExtension(ext string, data [][]byte) extensionBench {
+	b := extensionBench{extension: ext, files: len(data)}
+	for _, d := range data {
+		b.bytes += int64(len(d))
+	}
+	for _, candidate := range benchCandidates(ext) {
+		b.results = append(b.results, benchOne(candidate, data))
+	}
+	return b
+}
+
+func benchOne(candidate benchCandidate, data [][]byte) benchResult {
+	r := benchResult{name: candidate.name, zstdLevel: candidate.zstdLevel}
+	for _, d := range data {
+		var out bytes.Buffer
+		start := time.Now()
+		err := candidate.compression.Compress(&out, bytes.NewReader(d))
+		r.compressTime += time.Since(start)
+		if err != nil {
+			if !candidate.compression.Fallible() {
+				panic(err)
+			}
+			log.Println(candidate.name, "failed on a sample due to", err)
+			r.failed = true
+			return r
+		}
+		start = time.Now()
+		decom := candidate.compression.Decompress(bytes.NewReader(out.Bytes()))
+		var verify bytes.Buffer
+		utils.Copy(&verify, decom)
+		decom.Close()
+		r.decompressTime += time.Since(start)
+		if !bytes.Equal(verify.Bytes(), d) {
+			panic(candidate.name + " decompressed to DIFFERENT DATA this is VERY BAD")
+		}
+		r.inBytes += int64(len(d))
+		r.outBytes += int64(out.Len())
+	}
+	return r
+}
+
+func benchThroughput(bytes int64, d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f MB/s", float64(bytes)/d.Seconds()/1e6)
+}
+
+func printExtensionBench(b extensionBench) {
+	fmt.Println()
+	fmt.Printf("=== %s (%d files, %s bytes) ===\n", benchExtensionName(b.extension), b.files, utils.FormatCommas(b.bytes))
+	fmt.Printf("%-16s %15s %8s %14s %14s\n", "Algorithm", "Compressed", "Ratio", "Compress", "Decompress")
+	for _, r := range b.results {
+		if r.failed {
+			fmt.Printf("%-16s %15s\n", r.name, "failed")
+			continue
+		}
+		fmt.Printf("%-16s %15s %7.1f%% %14s %14s\n", r.name, utils.FormatCommas(r.outBytes), r.ratio()*100, benchThroughput(r.inBytes, r.compressTime), benchThroughput(r.inBytes, r.decompressTime))
+	}
+}
+
+func benchSuggestions(benches []extensionBench) []string {
+	listed := make(map[string]bool)
+	for _, ext := range config.Config().NoCompressionExts {
+		listed[ext] = true
+	}
+	ret := make([]string, 0)
+	for _, b := range benches {
+		var best, zstdDefault *benchResult
+		for i := range b.results {
+			r := &b.results[i]
+			if r.failed {
+				continue
+			}
+			if r.name == "zstd" {
+				zstdDefault = r
+			}
+			if best == nil || r.ratio() < best.ratio() {
+				best = r
+			}
+		}
+		if best == nil || b.extension == "" {
+			continue // no_compression_exts and compression_rules can't match files without an extension
+		}
+		compressible := best.ratio() < 1-sampleMinSavings
+		if !compressible && !listed[b.extension] {
+			ret = append(ret, fmt.Sprintf("add %q to no_compression_exts (best was %s at %.1f%%)", b.extension, best.name, best.ratio()*100))
+			continue
+		}
+		if compressible && listed[b.extension] {
+			ret = append(ret, fmt.Sprintf("remove %q from no_compression_exts (%s gets it to %.1f%%)", b.extension, best.name, best.ratio()*100))
+		}
+		if !compressible || zstdDefault == nil || best.ratio() > zstdDefault.ratio()*(1-benchMinLevelImprovement) {
+			continue
+		}
+		rule := config.CompressionRule{Extension: b.extension, Algorithm: best.name}
+		if best.zstdLevel != 0 {
+			rule.Algorithm = "zstd"
+			rule.Level = best.zstdLevel
+		}
+		if rule.Algorithm == "lepton" || rule.Algorithm == "redeflate" {
+			continue // these are already the default for their extensions
+		}
+		ret = append(ret, fmt.Sprintf("add %s to compression_rules (%.1f%% instead of %.1f%% with the default zstd)", benchRuleJSON(rule), best.ratio()*100, zstdDefault.ratio()*100))
+	}
+	return ret
+}
+
+func benchRuleJSON(rule config.CompressionRule) string {
+	if rule.Level != 0 {
+		return fmt.Sprintf(`{"extension": %q, "algorithm": %q, "level": %d}`, rule.Extension, rule.Algorithm, rule.Level)
+	}
+	return fmt.Sprintf(`{"extension": %q, "algorithm": %q}`, rule.Extension, rule.Algorithm)
+}
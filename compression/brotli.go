@@ -0,0 +1,33 @@
+package compression
+
+import (
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/leijurv/gb/utils"
+)
+
+type BrotliCompression struct{}
+
+func (n *BrotliCompression) Compress(out io.Writer, in io.Reader) error {
+	// this is for cold data, so trade speed for ratio, but not all the way to level 11 which is glacial
+	w := brotli.NewWriterOptions(out, brotli.WriterOptions{Quality: 9, LGWin: 24})
+	utils.Copy(w, in)
+	return w.Close()
+}
+
+func (n *BrotliCompression) Decompress(in io.Reader) io.ReadCloser {
+	return io.NopCloser(brotli.NewReader(in))
+}
+
+func (n *BrotliCompression) AlgName() string {
+	return "brotli"
+}
+
+func (n *BrotliCompression) Fallible() bool {
+	return false
+}
+
+func (n *BrotliCompression) DecompressionTrollBashCommandIncludingThePipe() string {
+	return " | brotli -dc"
+}
@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"io"
 	"log"
-	"os"
 	"strings"
 
 	"github.com/leijurv/gb/config"
@@ -37,6 +36,10 @@ func init() {
 		&NoCompression{},
 		&ZstdCompression{},
 		&LeptonCompression{},
+		&XzCompression{},
+		&BrotliCompression{},
+		&Lz4Compression{},
+		&RedeflateCompression{},
 	}
 	for _, c := range compressions {
 		n := c.AlgName()
@@ -48,28 +51,107 @@ func init() {
 }
 
 func ByAlgName(algName string) Compression {
+	if IsZstdDictAlgName(algName) {
+		dict := zstdDictByAlgName(algName)
+		if dict == nil {
+			return nil
+		}
+		return &ZstdCompression{Dict: dict}
+	}
 	// map is only written to on init, so no need to synchronize on read
 	return compressionMap[algName]
 }
 
-func SelectCompressionForPath(path string) []Compression {
+// size is the size of the file, as far as we know
+func SelectCompressionForPath(path string, size int64) []Compression {
 	path = strings.ToLower(path)
-	stat, err := os.Stat(path)
-	if err == nil && stat.Size() < config.Config().MinCompressSize {
+	if size < config.Config().MinCompressSize {
 		return []Compression{&NoCompression{}}
 	}
+	for _, rule := range config.Config().CompressionRules {
+		if rule.Extension != "" && strings.HasSuffix(path, "."+rule.Extension) {
+			return compressionFromRule(rule, path, size)
+		}
+	}
 	if !config.Config().DisableLeptonGo && (strings.HasSuffix(path, ".jpg") || strings.HasSuffix(path, ".jpeg")) {
 		return []Compression{&LeptonCompression{}, &NoCompression{}}
 	}
 	for _, ext := range config.Config().NoCompressionExts {
 		if strings.HasSuffix(path, "."+ext) {
-			return []Compression{&NoCompression{}}
+			return []Compression{&NoCompression{fromExtensionList: true}}
+		}
+	}
+	if config.Config().Redeflate && IsRedeflateExt(path) {
+		return []Compression{&RedeflateCompression{}, &NoCompression{}}
+	}
+	var longest *config.CompressionRule
+	for i, rule := range config.Config().CompressionRules {
+		if rule.PathPrefix != "" && strings.HasPrefix(path, rule.PathPrefix) && (longest == nil || len(rule.PathPrefix) > len(longest.PathPrefix)) {
+			longest = &config.Config().CompressionRules[i]
+		}
+	}
+	if longest != nil {
+		return compressionFromRule(*longest, path, size)
+	}
+	return []Compression{&ZstdCompression{Dict: zstdDictForPath(path, size)}, &NoCompression{}}
+}
+
+func compressionFromRule(rule config.CompressionRule, path string, size int64) []Compression {
+	if rule.Algorithm == "zstd" {
+		return []Compression{&ZstdCompression{Level: rule.Level, Dict: zstdDictForPath(path, size), fromRule: true}, &NoCompression{}}
+	}
+	c := ByAlgName(rule.Algorithm)
+	if c == nil {
+		panic("unknown compression algorithm \"" + rule.Algorithm + "\" in compression_rules")
+	}
+	if c.AlgName() == "" {
+		return []Compression{c}
+	}
+	return []Compression{c, &NoCompression{}}
+}
+
+// the webshare page can only decompress zstd (without a dictionary) and lepton (see webshare/share-sw.js), so anything else becomes zstd for files that are shared
+// except redeflate, which is just dropped, since its files are already compressed and there's always a NoCompression after it
+func WebshareCompatible(compOptions []Compression) []Compression {
+	ret := make([]Compression, 0, len(compOptions))
+	for _, c := range compOptions {
+		if _, ok := c.(*RedeflateCompression); ok {
+			continue
 		}
+		if zstdCompression, ok := c.(*ZstdCompression); ok {
+			c = &ZstdCompression{Level: zstdCompression.Level, fromRule: zstdCompression.fromRule}
+		} else if !WebshareCanDecompress(c.AlgName()) {
+			c = &ZstdCompression{fromRule: true} // only a rule picks anything else that can be compressed
+		}
+		ret = append(ret, c)
 	}
-	return []Compression{&ZstdCompression{}, &NoCompression{}}
+	return ret
+}
+
+func WebshareCanDecompress(algName string) bool {
+	return algName == "" || algName == "zstd" || algName == "lepton"
 }
 
 func Compress(compOptions []Compression, out io.Writer, in io.Reader, hs *utils.HasherSizer) string {
+	alg, _ := CompressSampled(compOptions, out, in, hs)
+	return alg
+}
+
+// Compress, and also what compression_sampling decided (SampledCompressed, SampledSkipped, or empty string), to be stored with the entry
+func CompressSampled(compOptions []Compression, out io.Writer, in io.Reader, hs *utils.HasherSizer) (string, string) {
+	sampled := ""
+	if config.Config().CompressionSampling {
+		compOptions, in, sampled = sample(compOptions, in)
+	}
+	return compress(compOptions, out, in, hs), sampled
+}
+
+// Compress, but with exactly compOptions even if compression_sampling is on, for when an algorithm was asked for explicitly
+func CompressWithoutSampling(compOptions []Compression, out io.Writer, in io.Reader, hs *utils.HasherSizer) string {
+	return compress(compOptions, out, in, hs)
+}
+
+func compress(compOptions []Compression, out io.Writer, in io.Reader, hs *utils.HasherSizer) string {
 	var inData []byte
 	buffered := false
 	for _, c := range compOptions {
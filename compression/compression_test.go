@@ -2,13 +2,26 @@ package compression
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
+	"hash/adler32"
+	"hash/crc32"
 	"io"
+	"os"
+	"strings"
 	"testing"
 
+	"github.com/DataDog/zstd"
+	"github.com/leijurv/gb/config"
 	"github.com/leijurv/gb/utils"
 )
 
+func TestMain(m *testing.M) {
+	config.SetTestConfig("/nonexistent/gb.db") // Compress reads the config, but nothing here needs a database
+	os.Exit(m.Run())
+}
+
 type mockBase struct {
 	name     string
 	fallible bool
@@ -335,3 +348,318 @@ func TestCompressWithRealZstd(t *testing.T) {
 		t.Errorf("zstd round-trip failed")
 	}
 }
+
+func TestCompressWithRealAlgorithms(t *testing.T) {
+	input := bytes.Repeat([]byte("hello world "), 100000)
+	for _, algName := range []string{"xz", "brotli", "lz4"} {
+		for _, data := range [][]byte{input, {}} {
+			hs := makeHasherSizerFor(data)
+			var out bytes.Buffer
+
+			c := ByAlgName(algName)
+			if got := Compress([]Compression{c, &NoCompression{}}, &out, bytes.NewReader(data), hs); got != algName {
+				t.Errorf("expected %s, got %s", algName, got)
+			}
+			if len(data) > 0 && out.Len() >= len(data)/10 {
+				t.Errorf("%s barely compressed %d bytes to %d", algName, len(data), out.Len())
+			}
+
+			decompressed := c.Decompress(bytes.NewReader(out.Bytes()))
+			result, err := io.ReadAll(decompressed)
+			decompressed.Close()
+			if err != nil || !bytes.Equal(result, data) {
+				t.Errorf("%s round-trip of %d bytes failed: %v", algName, len(data), err)
+			}
+		}
+	}
+}
+
+func TestSelectCompressionForPathRules(t *testing.T) {
+	config.SetCompressionRules([]config.CompressionRule{
+		{Extension: "log", Algorithm: "xz"},
+		{Extension: "jpg", Algorithm: "lz4"},
+		{PathPrefix: "/archive/", Algorithm: "brotli"},
+		{PathPrefix: "/archive/fast/", Algorithm: "lz4"},
+		{PathPrefix: "/raw/", Algorithm: ""},
+		{Extension: "json", Algorithm: "zstd", Level: 19},
+	})
+	defer config.SetCompressionRules(nil)
+
+	cases := map[string][]string{
+		"/home/a.txt":                {"zstd", ""},
+		"/home/a.LOG":                {"xz", ""},
+		"/home/a.jpg":                {"lz4", ""},
+		"/home/a.jpeg":               {"lepton", ""},
+		"/archive/a.txt":             {"brotli", ""},
+		"/archive/a.mp4":             {""},
+		"/archive/a.log":             {"xz", ""},
+		"/archive/fast/a.txt":        {"lz4", ""},
+		"/archive/fast/deeper/a.txt": {"lz4", ""},
+		"/archivex/a.txt":            {"zstd", ""},
+		"/raw/a.txt":                 {""},
+		"/home/a.json":               {"zstd", ""},
+		"/home/a.png":                {""},
+		"/home/a.DOCX":               {"zstd", ""},
+	}
+	for path, expected := range cases {
+		var got []string
+		for _, c := range SelectCompressionForPath(path, 1<<20) {
+			got = append(got, c.AlgName())
+		}
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected %v, got %v", path, expected, got)
+		}
+	}
+
+	if level := SelectCompressionForPath("/home/a.json", 1<<20)[0].(*ZstdCompression).Level; level != 19 {
+		t.Errorf("expected level 19, got %d", level)
+	}
+	if got := SelectCompressionForPath("/archive/a.txt", 100); len(got) != 1 || got[0].AlgName() != "" {
+		t.Errorf("files smaller than min_compress_size shouldn't be compressed")
+	}
+
+	var got []string
+	for _, c := range WebshareCompatible(SelectCompressionForPath("/archive/a.txt", 1<<20)) {
+		got = append(got, c.AlgName())
+	}
+	if strings.Join(got, ",") != "zstd," {
+		t.Errorf("expected webshare compatible zstd, got %v", got)
+	}
+}
+
+func TestCompressionSampling(t *testing.T) {
+	random := make([]byte, 200000)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("hello world "), 20000)
+
+	compress := func(options []Compression, data []byte) (string, string) {
+		var out bytes.Buffer
+		alg, sampled := CompressSampled(options, &out, bytes.NewReader(data), makeHasherSizerFor(data))
+		decompressed, err := io.ReadAll(ByAlgName(alg).Decompress(bytes.NewReader(out.Bytes())))
+		if err != nil || !bytes.Equal(decompressed, data) {
+			t.Errorf("%s round-trip failed: %v", alg, err)
+		}
+		return alg, sampled
+	}
+
+	if alg, sampled := compress(SelectCompressionForPath("/a.bin", int64(len(random))), random); alg != "zstd" || sampled != "" {
+		t.Errorf("without sampling, expected zstd, got %q %q", alg, sampled)
+	}
+
+	config.SetCompressionSampling(true)
+	defer config.SetCompressionSampling(false)
+	if alg, sampled := compress(SelectCompressionForPath("/a.bin", int64(len(random))), random); alg != "" || sampled != SampledSkipped {
+		t.Errorf("random data should be skipped, got %q %q", alg, sampled)
+	}
+	if alg, sampled := compress(SelectCompressionForPath("/a.bin", int64(len(text))), text); alg != "zstd" || sampled != "" {
+		t.Errorf("text should still be compressed, got %q %q", alg, sampled)
+	}
+	if alg, sampled := compress(SelectCompressionForPath("/a.mp4", int64(len(text))), text); alg != "zstd" || sampled != SampledCompressed {
+		t.Errorf("compressible data should be compressed despite the extension, got %q %q", alg, sampled)
+	}
+	if alg, sampled := compress(SelectCompressionForPath("/a.mp4", int64(len(random))), random); alg != "" || sampled != "" {
+		t.Errorf("random data with a listed extension should stay uncompressed, got %q %q", alg, sampled)
+	}
+
+	config.SetCompressionRules([]config.CompressionRule{{Extension: "log", Algorithm: "xz"}, {Extension: "json", Algorithm: "zstd", Level: 19}, {PathPrefix: "/fast/", Algorithm: "lz4"}})
+	defer config.SetCompressionRules(nil)
+	for _, path := range []string{"/a.log", "/a.json", "/fast/a.bin"} {
+		expected := SelectCompressionForPath(path, int64(len(random)))[0].AlgName()
+		if alg, sampled := compress(SelectCompressionForPath(path, int64(len(random))), random); alg != expected || sampled != "" {
+			t.Errorf("%s: what compression_rules asked for should be left alone by sampling, expected %q, got %q %q", path, expected, alg, sampled)
+		}
+	}
+}
+
+func TestBenchSuggestions(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("hello world "), 10000)
+
+	benches := []extensionBench{
+		benchExtension("bin", [][]byte{random}),
+		benchExtension("mp4", [][]byte{text}),
+		benchExtension("txt", [][]byte{text}),
+	}
+	for _, b := range benches {
+		for _, r := range b.results {
+			if r.failed || r.inBytes != b.bytes {
+				t.Errorf("%s on .%s should have run on every sample", r.name, b.extension)
+			}
+		}
+	}
+	suggestions := strings.Join(benchSuggestions(benches), "\n")
+	if !strings.Contains(suggestions, `add "bin" to no_compression_exts`) {
+		t.Errorf("random data should be suggested for no_compression_exts, got %s", suggestions)
+	}
+	if !strings.Contains(suggestions, `remove "mp4" from no_compression_exts`) {
+		t.Errorf("compressible data should be suggested for removal from no_compression_exts, got %s", suggestions)
+	}
+	if strings.Contains(suggestions, `"txt" to no_compression_exts`) {
+		t.Errorf("text shouldn't be suggested for no_compression_exts, got %s", suggestions)
+	}
+	if benchExtensionOf("/a/B.TXT") != "txt" || benchExtensionOf("/a/.bashrc") != "" || benchExtensionOf("/a.b/c") != "" {
+		t.Error("wrong extension")
+	}
+}
+
+func zlibDeflate(t *testing.T, params deflateParams, data []byte) []byte {
+	var out bytes.Buffer
+	z := newZlibDeflater(params)
+	defer z.free()
+	z.write(data, true, func(b []byte) bool {
+		out.Write(b)
+		return true
+	})
+	return out.Bytes()
+}
+
+func redeflateTestData(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		buf.WriteString("row " + strings.Repeat(string(rune('a'+i*7%26)), i%13) + " of some image data\n")
+	}
+	return buf.Bytes()[:n]
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	var chunk bytes.Buffer
+	binary.Write(&chunk, binary.BigEndian, uint32(len(data)))
+	chunk.WriteString(typ)
+	chunk.Write(data)
+	binary.Write(&chunk, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(typ), data...)))
+	return chunk.Bytes()
+}
+
+func zipLocalFile(name string, compressed []byte, dataDescriptor bool) []byte {
+	var f bytes.Buffer
+	f.Write(zipLocalHeaderSignature)
+	var flags uint16
+	size := uint32(len(compressed))
+	if dataDescriptor {
+		flags, size = 0x8, 0
+	}
+	for _, x := range []uint16{20, flags, 8, 0, 0} { // version, flags, method, time, date
+		binary.Write(&f, binary.LittleEndian, x)
+	}
+	for _, x := range []uint32{0, size, 0} { // crc, compressed size, uncompressed size
+		binary.Write(&f, binary.LittleEndian, x)
+	}
+	binary.Write(&f, binary.LittleEndian, uint16(len(name)))
+	binary.Write(&f, binary.LittleEndian, uint16(0))
+	f.WriteString(name)
+	f.Write(compressed)
+	if dataDescriptor {
+		f.Write([]byte("PK\x07\x08\x00\x00\x00\x00"))
+		binary.Write(&f, binary.LittleEndian, uint32(len(compressed)))
+	}
+	return f.Bytes()
+}
+
+func redeflateRoundTrip(t *testing.T, data []byte) []byte {
+	c := &RedeflateCompression{}
+	var out bytes.Buffer
+	if err := c.Compress(&out, bytes.NewReader(data)); err != nil {
+		t.Fatalf("redeflate failed: %v", err)
+	}
+	decompressed, err := io.ReadAll(c.Decompress(bytes.NewReader(out.Bytes())))
+	if err != nil || !bytes.Equal(decompressed, data) {
+		t.Fatalf("redeflate round-trip failed: %v", err)
+	}
+	return out.Bytes()
+}
+
+func TestRedeflatePNG(t *testing.T) {
+	raw := redeflateTestData(300000)
+	stream := append([]byte{0x78, 0xda}, zlibDeflate(t, deflateParams{level: 9, windowBits: 15, memLevel: 8, strategy: zlibFiltered}, raw)...)
+	stream = binary.BigEndian.AppendUint32(stream, adler32.Checksum(raw))
+
+	var png bytes.Buffer
+	png.Write(pngSignature)
+	png.Write(pngChunk("IHDR", make([]byte, 13)))
+	third := len(stream) / 3
+	png.Write(pngChunk("IDAT", stream[:third]))
+	png.Write(pngChunk("IDAT", stream[third:2*third]))
+	png.Write(pngChunk("IDAT", stream[2*third:]))
+	png.Write(pngChunk("IEND", nil))
+
+	compressed := redeflateRoundTrip(t, png.Bytes())
+	if len(compressed) >= png.Len() {
+		t.Errorf("redeflate should beat the original deflate, got %d vs %d", len(compressed), png.Len())
+	}
+}
+
+func TestRedeflateZip(t *testing.T) {
+	a := redeflateTestData(100000)
+	b := redeflateTestData(50000)
+	var zip bytes.Buffer
+	zip.Write(zipLocalFile("a.txt", zlibDeflate(t, deflateParams{level: 6, windowBits: 15, memLevel: 8, strategy: zlibDefaultStrategy}, a), false))
+	zip.Write(zipLocalFile("b.txt", zlibDeflate(t, deflateParams{level: 1, windowBits: 15, memLevel: 8, strategy: zlibDefaultStrategy}, b), true))
+	zip.Write(zipLocalFile("c.bin", []byte("not actually deflate, but the size says it's this long"), false))
+	zip.WriteString("PK\x01\x02 pretend this is the central directory")
+
+	redeflateRoundTrip(t, zip.Bytes())
+}
+
+func TestRedeflateFallsBack(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.Read(random)
+	notZlib := append(append([]byte{}, pngSignature...), pngChunk("IDAT", append([]byte{0x78, 0xda}, random...))...)
+	for _, data := range [][]byte{random, notZlib} {
+		if err := (&RedeflateCompression{}).Compress(io.Discard, bytes.NewReader(data)); err == nil {
+			t.Error("redeflate should fail when there's nothing it can reproduce")
+		}
+		var out bytes.Buffer
+		if alg := Compress([]Compression{&RedeflateCompression{}, &NoCompression{}}, &out, bytes.NewReader(data), makeHasherSizerFor(data)); alg != "" {
+			t.Errorf("expected fallback to no compression, got %q", alg)
+		}
+	}
+
+}
+
+func TestRedeflateOptIn(t *testing.T) {
+	config.SetRedeflate(true)
+	defer config.SetRedeflate(false)
+	if got := SelectCompressionForPath("/a.docx", 1<<20); got[0].AlgName() != "redeflate" {
+		t.Errorf("docx should be redeflated once redeflate is on, got %q", got[0].AlgName())
+	}
+	if got := SelectCompressionForPath("/a.png", 1<<20); len(got) != 1 || got[0].AlgName() != "" {
+		t.Errorf("no_compression_exts should still win over redeflate")
+	}
+}
+
+func TestRedeflateMismatch(t *testing.T) {
+	raw := redeflateTestData(100000)
+	stream := append([]byte{0x78, 0xda}, zlibDeflate(t, deflateParams{level: 9, windowBits: 15, memLevel: 8, strategy: zlibFiltered}, raw)...)
+	stream = binary.BigEndian.AppendUint32(stream, adler32.Checksum(raw))
+	var png bytes.Buffer
+	png.Write(pngSignature)
+	png.Write(pngChunk("IDAT", stream))
+	png.Write(pngChunk("IEND", nil))
+	compressed := redeflateRoundTrip(t, png.Bytes())
+
+	// pretend this zlib deflates differently, by changing the level that's stored in the record
+	records, err := zstd.Decompress(nil, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	literalLen, n := binary.Uvarint(records[2:])
+	level := 2 + n + int(literalLen) + 1
+	if records[level-1] != redeflateRecordDeflate || records[level] != 9 {
+		t.Fatalf("expected a deflate record at level 9, got %v", records[level-1:level+1])
+	}
+	records[level] = 1
+	tampered, err := zstd.Compress(nil, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing of the stream is written, not even an inflated version of it
+	out, err := io.ReadAll((&RedeflateCompression{}).Decompress(bytes.NewReader(tampered)))
+	if err == nil {
+		t.Error("Decompress should fail when zlib doesn't reproduce the stream")
+	}
+	if bytes.Contains(out, raw[:1000]) {
+		t.Error("the stream shouldn't be written inflated when it can't be reproduced")
+	}
+}
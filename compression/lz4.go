@@ -0,0 +1,32 @@
+package compression
+
+import (
+	"io"
+
+	"github.com/leijurv/gb/utils"
+	"github.com/pierrec/lz4/v4"
+)
+
+type Lz4Compression struct{}
+
+func (n *Lz4Compression) Compress(out io.Writer, in io.Reader) error {
+	w := lz4.NewWriter(out)
+	utils.Copy(w, in)
+	return w.Close()
+}
+
+func (n *Lz4Compression) Decompress(in io.Reader) io.ReadCloser {
+	return io.NopCloser(lz4.NewReader(in))
+}
+
+func (n *Lz4Compression) AlgName() string {
+	return "lz4"
+}
+
+func (n *Lz4Compression) Fallible() bool {
+	return false
+}
+
+func (n *Lz4Compression) DecompressionTrollBashCommandIncludingThePipe() string {
+	return " | lz4 -dc"
+}
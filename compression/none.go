@@ -6,7 +6,9 @@ import (
 	"github.com/leijurv/gb/utils"
 )
 
-type NoCompression struct{}
+type NoCompression struct {
+	fromExtensionList bool // chosen because of no_compression_exts, which sampling can overrule
+}
 
 func (n *NoCompression) Compress(out io.Writer, in io.Reader) error {
 	utils.Copy(out, in)
@@ -0,0 +1,584 @@
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/zstd"
+)
+
+// like lepton, but for the deflate streams inside pngs and zips (so also docx, xlsx, jar, epub, ...)
+// each deflate stream is stored inflated, along with the zlib settings that make exactly the same compressed bytes again, and then the whole thing is zstd'd
+// this only works for streams that were made by zlib in the first place (libpng, info-zip, and most things that link zlib), anything else is kept as is
+// if nothing in the file can be reproduced, this fails, so the file falls back to NoCompression
+// decompression relies on zlib deflating the same way it did when this was compressed, which it has for decades, but a different zlib (like zlib-ng) might not
+// so this is off unless the redeflate config option is on, and if it doesn't match, restoring that file fails, and has to be done with a gb built with the zlib that backed it up
+type RedeflateCompression struct{}
+
+var redeflateExts = []string{"png", "zip", "docx", "xlsx", "pptx", "odt", "ods", "odp", "jar", "apk", "epub"}
+
+// not worth trying to reproduce anything smaller than this
+const redeflateMinStreamSize = 256
+
+const (
+	redeflateVersion = 1
+
+	redeflateRecordLiteral = 0
+	redeflateRecordDeflate = 1
+	redeflateRecordEnd     = 2
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+var zipLocalHeaderSignature = []byte("PK\x03\x04")
+
+// path should already be lowercase
+func IsRedeflateExt(path string) bool {
+	for _, ext := range redeflateExts {
+		if strings.HasSuffix(path, "."+ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// where in the file a deflate stream might be. it can be split across several pieces, like png IDAT chunks
+type deflateCandidate struct {
+	pieces     []filePiece
+	prefixLen  int // bytes before the deflate stream itself, like the zlib header
+	windowBits int
+	levels     []int // the likely ones go first, but all of them are tried
+	strategies []int
+}
+
+type filePiece struct {
+	off int
+	len int
+}
+
+func (n *RedeflateCompression) Compress(out io.Writer, in io.Reader) error {
+	r := bufio.NewReaderSize(in, 128*1024)
+	magic, _ := r.Peek(len(pngSignature))
+	isPNG := bytes.HasPrefix(magic, pngSignature)
+	if !isPNG && !bytes.HasPrefix(magic, zipLocalHeaderSignature) {
+		return errors.New("not a png or a zip")
+	}
+	w := zstd.NewWriter(out)
+	bw := bufio.NewWriterSize(w, 128*1024)
+	bw.WriteByte(redeflateVersion)
+	d := &redeflater{r: r, w: bw}
+	if isPNG {
+		d.png()
+	} else {
+		d.zip()
+	}
+	d.copyRest()
+	bw.WriteByte(redeflateRecordEnd)
+	if err := bw.Flush(); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	if d.reproduced == 0 {
+		return errors.New("no deflate streams that zlib can reproduce")
+	}
+	// every stream was already checked on its own, and compression.Compress checks that the whole thing comes back out the same
+	log.Println("Reproduced", d.reproduced, "deflate streams with zlib", zlibVersion())
+	return nil
+}
+
+func (n *RedeflateCompression) Decompress(in io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zr := zstd.NewReader(in)
+		defer zr.Close()
+		bw := bufio.NewWriterSize(pw, 128*1024)
+		err := readRedeflate(bufio.NewReader(zr), bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+func (n *RedeflateCompression) AlgName() string {
+	return "redeflate"
+}
+
+func (n *RedeflateCompression) Fallible() bool {
+	return true
+}
+
+func (n *RedeflateCompression) DecompressionTrollBashCommandIncludingThePipe() string {
+	return " | gb redeflate-decompress"
+}
+
+// redeflate doesn't hold the whole file, just what's been read since the last record was written
+// that's one deflate stream and whatever's right before it, so a big zip of small files is fine, it's only a huge png or zip member that's big in memory
+const redeflateMaxPending = 1024 * 1024
+
+type redeflater struct {
+	r          *bufio.Reader
+	w          *bufio.Writer
+	pending    []byte // read but not written yet, deflateCandidate offsets are into this
+	reproduced int
+}
+
+// reads n more bytes into pending, false if the input ends first
+func (d *redeflater) read(n int) bool {
+	buf := bytes.NewBuffer(d.pending)
+	_, err := io.CopyN(buf, d.r, int64(n))
+	d.pending = buf.Bytes()
+	if err != nil && err != io.EOF {
+		panic(err)
+	}
+	return err == nil
+}
+
+// reads one deflate stream into pending, stopping exactly where it ends. false if it isn't one
+func (d *redeflater) readDeflateStream() bool {
+	rec := &recordingReader{r: d.r, buf: bytes.NewBuffer(d.pending)}
+	_, err := io.Copy(io.Discard, flate.NewReader(rec)) // recordingReader is an io.ByteReader, so flate doesn't read past the end of the stream
+	d.pending = rec.buf.Bytes()
+	return err == nil
+}
+
+// reads up to and including the next sig, false if the input ends first
+func (d *redeflater) scanTo(sig []byte) bool {
+	for {
+		if len(d.pending) > redeflateMaxPending {
+			d.flush(len(sig) - 1)
+		}
+		b, err := d.r.ReadByte()
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			panic(err)
+		}
+		d.pending = append(d.pending, b)
+		if bytes.HasSuffix(d.pending, sig) {
+			return true
+		}
+	}
+}
+
+// writes all but the last keep bytes of pending as is
+func (d *redeflater) flush(keep int) {
+	writeRedeflateLiteral(d.w, d.pending[:len(d.pending)-keep])
+	d.pending = append([]byte{}, d.pending[len(d.pending)-keep:]...)
+}
+
+func (d *redeflater) try(cand deflateCandidate) {
+	end, ok := writeRedeflateRecord(d.w, d.pending, 0, cand)
+	if !ok {
+		return
+	}
+	d.pending = append([]byte{}, d.pending[end:]...)
+	d.reproduced++
+}
+
+// everything that's left is written as is
+func (d *redeflater) copyRest() {
+	for {
+		d.flush(0)
+		if !d.read(redeflateMaxPending) {
+			d.flush(0)
+			return
+		}
+	}
+}
+
+type recordingReader struct {
+	r   *bufio.Reader
+	buf *bytes.Buffer
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf.Write(p[:n])
+	return n, err
+}
+
+func (rr *recordingReader) ReadByte() (byte, error) {
+	b, err := rr.r.ReadByte()
+	if err == nil {
+		rr.buf.WriteByte(b)
+	}
+	return b, err
+}
+
+// the IDAT chunks together are one zlib stream
+func (d *redeflater) png() {
+	if !d.read(len(pngSignature)) {
+		return
+	}
+	pieces := make([]filePiece, 0)
+	for {
+		if len(pieces) == 0 && len(d.pending) > redeflateMaxPending {
+			d.flush(0)
+		}
+		chunk := len(d.pending)
+		if !d.read(8) {
+			break
+		}
+		length := binary.BigEndian.Uint32(d.pending[chunk:])
+		typ := string(d.pending[chunk+4 : chunk+8])
+		if !d.read(int(length) + 4) {
+			break
+		}
+		if typ == "IDAT" {
+			pieces = append(pieces, filePiece{off: chunk + 8, len: int(length)})
+		} else if len(pieces) > 0 {
+			break // IDATs have to be consecutive
+		}
+	}
+	if len(pieces) == 0 || pieces[0].len < 2 {
+		return
+	}
+	windowBits, levels, ok := parseZlibHeader(d.pending[pieces[0].off:])
+	if !ok {
+		return
+	}
+	// libpng uses Z_FILTERED whenever there are row filters, which is almost always
+	d.try(deflateCandidate{pieces: pieces, prefixLen: 2, windowBits: windowBits, levels: levels, strategies: []int{zlibFiltered, zlibDefaultStrategy}})
+}
+
+func parseZlibHeader(header []byte) (windowBits int, levels []int, ok bool) {
+	cmf, flg := int(header[0]), int(header[1])
+	if cmf&0x0f != 8 || (cmf*256+flg)%31 != 0 || flg&0x20 != 0 {
+		return 0, nil, false // not deflate, or has a preset dictionary
+	}
+	windowBits = cmf>>4 + 8
+	if windowBits > 15 {
+		return 0, nil, false
+	}
+	if windowBits < 9 {
+		windowBits = 9 // zlib itself does this
+	}
+	switch flg >> 6 {
+	case 0:
+		levels = []int{1}
+	case 1:
+		levels = []int{2, 3, 4, 5}
+	case 2:
+		levels = []int{6}
+	default:
+		levels = []int{9, 7, 8}
+	}
+	return windowBits, levels, true
+}
+
+// every local file header that says deflate. this could be fooled by "PK\x03\x04" inside some other file's data, but that just means a candidate that doesn't work out
+func (d *redeflater) zip() {
+	for d.scanTo(zipLocalHeaderSignature) {
+		header := len(d.pending) - len(zipLocalHeaderSignature)
+		if !d.read(30 - len(zipLocalHeaderSignature)) {
+			return
+		}
+		flags := binary.LittleEndian.Uint16(d.pending[header+6:])
+		method := binary.LittleEndian.Uint16(d.pending[header+8:])
+		compressedSize := binary.LittleEndian.Uint32(d.pending[header+18:])
+		if !d.read(int(binary.LittleEndian.Uint16(d.pending[header+26:])) + int(binary.LittleEndian.Uint16(d.pending[header+28:]))) {
+			return
+		}
+		if method != 8 {
+			continue
+		}
+		dataOff := len(d.pending)
+		if flags&0x8 != 0 || compressedSize == 0xffffffff {
+			// the length isn't known (data descriptor, or zip64), so it's wherever the deflate stream ends
+			if !d.readDeflateStream() {
+				continue
+			}
+		} else if !d.read(int(compressedSize)) {
+			return
+		}
+		cand := deflateCandidate{pieces: []filePiece{{off: dataOff, len: len(d.pending) - dataOff}}, windowBits: 15, strategies: []int{zlibDefaultStrategy, zlibFiltered}}
+		// bits 1 and 2 are what the zip tool was told to do
+		switch (flags >> 1) & 3 {
+		case 0:
+			cand.levels = []int{6}
+		case 1:
+			cand.levels = []int{9, 8, 7}
+		default:
+			cand.levels = []int{1, 2}
+		}
+		d.try(cand)
+	}
+}
+
+// returns where in data this record ends, or false if the deflate stream can't be reproduced (and nothing was written)
+func writeRedeflateRecord(w *bufio.Writer, data []byte, cursor int, cand deflateCandidate) (int, bool) {
+	stream := make([]byte, 0)
+	for _, p := range cand.pieces {
+		stream = append(stream, data[p.off:p.off+p.len]...)
+	}
+	body := bytes.NewReader(stream[cand.prefixLen:])
+	inflated, err := io.ReadAll(flate.NewReader(body)) // bytes.Reader is an io.ByteReader, so flate doesn't read past the end of the stream
+	if err != nil {
+		return 0, false
+	}
+	deflated := stream[cand.prefixLen : len(stream)-body.Len()]
+	if len(deflated) < redeflateMinStreamSize {
+		return 0, false
+	}
+	pieces := cand.pieces
+	params, ok := findDeflateParams(inflated, deflated, cand)
+	if !ok {
+		return 0, false
+	}
+	writeRedeflateLiteral(w, data[cursor:pieces[0].off])
+	w.WriteByte(redeflateRecordDeflate)
+	writeUvarint(w, uint64(params.level))
+	writeUvarint(w, uint64(params.windowBits))
+	writeUvarint(w, uint64(params.memLevel))
+	writeUvarint(w, uint64(params.strategy))
+	writeRedeflateBytes(w, stream[:cand.prefixLen])
+	writeUvarint(w, uint64(len(deflated)))
+	writeUvarint(w, uint64(crc32.ChecksumIEEE(deflated)))
+	writeRedeflateBytes(w, stream[cand.prefixLen+len(deflated):])
+	writeUvarint(w, uint64(len(pieces)))
+	for i, p := range pieces {
+		writeUvarint(w, uint64(p.len))
+		if i == len(pieces)-1 {
+			writeRedeflateBytes(w, nil)
+		} else {
+			writeRedeflateBytes(w, data[p.off+p.len:pieces[i+1].off])
+		}
+	}
+	writeRedeflateBytes(w, inflated)
+	last := pieces[len(pieces)-1]
+	return last.off + last.len, true
+}
+
+func findDeflateParams(inflated []byte, deflated []byte, cand deflateCandidate) (deflateParams, bool) {
+	levels := append([]int{}, cand.levels...)
+	for _, level := range []int{6, 9, 1, 2, 3, 4, 5, 7, 8} {
+		if !containsInt(levels, level) {
+			levels = append(levels, level)
+		}
+	}
+	for _, memLevel := range []int{8, 9} {
+		for _, level := range levels {
+			for _, strategy := range cand.strategies {
+				if strategy == zlibFiltered && level <= 3 {
+					continue // the fast levels ignore Z_FILTERED
+				}
+				params := deflateParams{level: level, windowBits: cand.windowBits, memLevel: memLevel, strategy: strategy}
+				if deflateMatches(params, inflated, deflated) {
+					return params, true
+				}
+			}
+		}
+	}
+	return deflateParams{}, false
+}
+
+func containsInt(list []int, x int) bool {
+	for _, y := range list {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
+
+// usually a wrong guess is obvious within the first few KB of output, so this stops as soon as it differs
+func deflateMatches(params deflateParams, inflated []byte, deflated []byte) bool {
+	z := newZlibDeflater(params)
+	defer z.free()
+	pos := 0
+	ok := z.write(inflated, true, func(out []byte) bool {
+		if pos+len(out) > len(deflated) || !bytes.Equal(out, deflated[pos:pos+len(out)]) {
+			return false
+		}
+		pos += len(out)
+		return true
+	})
+	return ok && pos == len(deflated)
+}
+
+func writeRedeflateLiteral(w *bufio.Writer, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	w.WriteByte(redeflateRecordLiteral)
+	writeRedeflateBytes(w, data)
+}
+
+func writeRedeflateBytes(w *bufio.Writer, data []byte) {
+	writeUvarint(w, uint64(len(data)))
+	w.Write(data)
+}
+
+func writeUvarint(w *bufio.Writer, x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], x)])
+}
+
+func readRedeflate(r *bufio.Reader, out io.Writer) error {
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != redeflateVersion {
+		return errors.New("unknown redeflate version " + strconv.Itoa(int(version)))
+	}
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case redeflateRecordLiteral:
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			if _, err := io.CopyN(out, r, int64(n)); err != nil {
+				return err
+			}
+		case redeflateRecordDeflate:
+			if err := readRedeflateRecord(r, out); err != nil {
+				return err
+			}
+		case redeflateRecordEnd:
+			return nil
+		default:
+			return errors.New("unknown redeflate record " + strconv.Itoa(int(typ)))
+		}
+	}
+}
+
+func readRedeflateRecord(r *bufio.Reader, out io.Writer) error {
+	var header [4]uint64
+	for i := range header {
+		x, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		header[i] = x
+	}
+	params := deflateParams{level: int(header[0]), windowBits: int(header[1]), memLevel: int(header[2]), strategy: int(header[3])}
+	prefix, err := readRedeflateBytes(r)
+	if err != nil {
+		return err
+	}
+	deflatedLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	deflatedCRC, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	suffix, err := readRedeflateBytes(r)
+	if err != nil {
+		return err
+	}
+	numPieces, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	pw := &pieceWriter{out: out}
+	for i := uint64(0); i < numPieces; i++ {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		gap, err := readRedeflateBytes(r)
+		if err != nil {
+			return err
+		}
+		pw.lens = append(pw.lens, int(length))
+		pw.gaps = append(pw.gaps, gap)
+	}
+	inflatedLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	var inflated bytes.Buffer
+	if _, err := io.CopyN(&inflated, r, int64(inflatedLen)); err != nil {
+		return err
+	}
+	// the whole stream is made before any of it is written, so that nothing is written if it's wrong
+	var deflated bytes.Buffer
+	z := newZlibDeflater(params)
+	defer z.free()
+	z.write(inflated.Bytes(), true, func(out []byte) bool {
+		deflated.Write(out)
+		return true
+	})
+	if uint64(deflated.Len()) != deflatedLen || uint64(crc32.ChecksumIEEE(deflated.Bytes())) != deflatedCRC {
+		return errors.New("zlib " + zlibVersion() + " did NOT reproduce the original deflate stream, this needs the zlib that gb was built with when this file was backed up")
+	}
+	for _, data := range [][]byte{prefix, deflated.Bytes(), suffix} {
+		if _, err := pw.Write(data); err != nil {
+			return err
+		}
+	}
+	if pw.idx != len(pw.lens) {
+		return errors.New("redeflate stream is shorter than its pieces")
+	}
+	return nil
+}
+
+func readRedeflateBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+// writes the stream back into its pieces, with whatever was between them (e.g. png chunk crcs and headers) in the gaps
+type pieceWriter struct {
+	out  io.Writer
+	lens []int
+	gaps [][]byte
+	idx  int
+	done int // of the current piece
+}
+
+func (pw *pieceWriter) Write(data []byte) (int, error) {
+	written := 0
+	for {
+		// a piece that's full is followed by its gap, even at the very end
+		for pw.idx < len(pw.lens) && pw.done == pw.lens[pw.idx] {
+			if _, err := pw.out.Write(pw.gaps[pw.idx]); err != nil {
+				return written, err
+			}
+			pw.idx++
+			pw.done = 0
+		}
+		if len(data) == 0 {
+			return written, nil
+		}
+		if pw.idx == len(pw.lens) {
+			return written, errors.New("redeflate stream is longer than its pieces")
+		}
+		n := pw.lens[pw.idx] - pw.done
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := pw.out.Write(data[:n]); err != nil {
+			return written, err
+		}
+		pw.done += n
+		written += n
+		data = data[n:]
+	}
+}
@@ -0,0 +1,64 @@
+package compression
+
+import (
+	"bufio"
+	"io"
+	"log"
+
+	"github.com/DataDog/zstd"
+)
+
+// compression_sampling: before compressing, trial compress the start of the file with the fastest zstd level
+// if that barely does anything, don't bother compressing the file at all, and if a file on the no_compression_exts list turns out to be compressible, compress it anyway
+const sampleSize = 64 * 1024
+const sampleMinSavings = 0.05
+
+// what sampling decided, when it overruled SelectCompressionForPath. this is stored in blob_entries.sampled, and is empty string otherwise
+const (
+	SampledCompressed = "compressed" // compressed despite its extension being in no_compression_exts
+	SampledSkipped    = "skipped"    // not compressed, even though its extension would have been
+)
+
+func sample(compOptions []Compression, in io.Reader) ([]Compression, io.Reader, string) {
+	listed := skippedByExtensionList(compOptions[0])
+	if !listed && !defaultZstd(compOptions[0]) {
+		return compOptions, in, "" // lepton knows what it's doing, and whatever compression_rules asked for (even uncompressed) is what it gets
+	}
+	buffered := bufio.NewReaderSize(in, sampleSize)
+	head, err := buffered.Peek(sampleSize)
+	if err != nil && err != io.EOF {
+		panic(err)
+	}
+	compressible := sampleCompressible(head)
+	if listed && compressible {
+		log.Println("Sampling says this file is compressible, despite its extension being in no_compression_exts, so compressing it anyway")
+		return []Compression{&ZstdCompression{}, &NoCompression{}}, buffered, SampledCompressed
+	}
+	if !listed && !compressible {
+		log.Println("Sampling says this file is incompressible, so not compressing it with", compOptions[0].AlgName())
+		return []Compression{&NoCompression{}}, buffered, SampledSkipped
+	}
+	return compOptions, buffered, ""
+}
+
+func sampleCompressible(head []byte) bool {
+	if len(head) == 0 {
+		return false
+	}
+	compressed, err := zstd.CompressLevel(nil, head, 1)
+	if err != nil {
+		panic(err)
+	}
+	return float64(len(compressed)) < float64(len(head))*(1-sampleMinSavings)
+}
+
+func skippedByExtensionList(c Compression) bool {
+	n, ok := c.(*NoCompression)
+	return ok && n.fromExtensionList
+}
+
+// the zstd that anything not otherwise special gets, which would happily "compress" random bytes
+func defaultZstd(c Compression) bool {
+	z, ok := c.(*ZstdCompression)
+	return ok && !z.fromRule
+}
@@ -0,0 +1,44 @@
+package compression
+
+import (
+	"io"
+
+	"github.com/leijurv/gb/utils"
+	"github.com/ulikunitz/xz"
+)
+
+type XzCompression struct{}
+
+func (n *XzCompression) Compress(out io.Writer, in io.Reader) error {
+	w, err := xz.NewWriter(out)
+	if err != nil {
+		return err
+	}
+	utils.Copy(w, in)
+	return w.Close()
+}
+
+func (n *XzCompression) Decompress(in io.Reader) io.ReadCloser {
+	// xz.NewReader reads the stream header right away, so do it lazily like lepton, so that this doesn't block
+	pr, pw := io.Pipe()
+	go func() {
+		r, err := xz.NewReader(in)
+		if err == nil {
+			_, err = io.Copy(pw, r)
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+func (n *XzCompression) AlgName() string {
+	return "xz"
+}
+
+func (n *XzCompression) Fallible() bool {
+	return false
+}
+
+func (n *XzCompression) DecompressionTrollBashCommandIncludingThePipe() string {
+	return " | xz -d"
+}
@@ -0,0 +1,108 @@
+package compression
+
+/*
+#cgo LDFLAGS: -lz
+#include <stdlib.h>
+#include <string.h>
+#include <zlib.h>
+
+static int gb_deflate_init(z_stream *strm, int level, int window_bits, int mem_level, int strategy) {
+	return deflateInit2(strm, level, Z_DEFLATED, -window_bits, mem_level, strategy);
+}
+*/
+import "C"
+
+import (
+	"strconv"
+	"unsafe"
+)
+
+// a raw deflate stream made by zlib is entirely determined by the data and these, so if we guess them right, the exact compressed bytes can be made again
+type deflateParams struct {
+	level      int
+	windowBits int
+	memLevel   int
+	strategy   int
+}
+
+const (
+	zlibDefaultStrategy = int(C.Z_DEFAULT_STRATEGY)
+	zlibFiltered        = int(C.Z_FILTERED)
+)
+
+const zlibBufSize = 64 * 1024
+
+func zlibVersion() string {
+	return C.GoString(C.zlibVersion())
+}
+
+// everything zlib touches is allocated in C, so there are no go pointers to worry about
+type zlibDeflater struct {
+	strm *C.z_stream
+	in   unsafe.Pointer
+	out  unsafe.Pointer
+}
+
+func newZlibDeflater(p deflateParams) *zlibDeflater {
+	z := &zlibDeflater{
+		strm: (*C.z_stream)(C.calloc(1, C.size_t(unsafe.Sizeof(C.z_stream{})))),
+		in:   C.malloc(zlibBufSize),
+		out:  C.malloc(zlibBufSize),
+	}
+	ret := C.gb_deflate_init(z.strm, C.int(p.level), C.int(p.windowBits), C.int(p.memLevel), C.int(p.strategy))
+	if ret != C.Z_OK {
+		z.free()
+		panic("deflateInit2 failed with " + strconv.Itoa(int(ret)))
+	}
+	return z
+}
+
+// compress data, calling emit with the output as it comes out. returns early with false if emit does
+func (z *zlibDeflater) write(data []byte, finish bool, emit func([]byte) bool) bool {
+	for {
+		n := len(data)
+		if n > zlibBufSize {
+			n = zlibBufSize
+		}
+		last := n == len(data)
+		if n > 0 {
+			C.memcpy(z.in, unsafe.Pointer(&data[0]), C.size_t(n))
+		}
+		data = data[n:]
+		z.strm.next_in = (*C.Bytef)(z.in)
+		z.strm.avail_in = C.uInt(n)
+		flush := C.int(C.Z_NO_FLUSH)
+		if last && finish {
+			flush = C.Z_FINISH
+		}
+		for {
+			z.strm.next_out = (*C.Bytef)(z.out)
+			z.strm.avail_out = zlibBufSize
+			ret := C.deflate(z.strm, flush)
+			if ret == C.Z_STREAM_ERROR {
+				panic("zlib deflate failed")
+			}
+			produced := zlibBufSize - int(z.strm.avail_out)
+			if produced > 0 && !emit(C.GoBytes(z.out, C.int(produced))) {
+				return false
+			}
+			if flush == C.Z_FINISH {
+				if ret == C.Z_STREAM_END {
+					break
+				}
+			} else if z.strm.avail_out != 0 {
+				break
+			}
+		}
+		if last {
+			return true
+		}
+	}
+}
+
+func (z *zlibDeflater) free() {
+	C.deflateEnd(z.strm)
+	C.free(unsafe.Pointer(z.strm))
+	C.free(z.in)
+	C.free(z.out)
+}
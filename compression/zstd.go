@@ -2,25 +2,46 @@ package compression
 
 import (
 	"io"
+	"strconv"
 
 	"github.com/DataDog/zstd"
 	"github.com/leijurv/gb/utils"
 )
 
-type ZstdCompression struct{}
+type ZstdCompression struct {
+	Level int       // 0 is zstd's default. only affects compression, so it isn't part of the alg name
+	Dict  *ZstdDict // trained with `gb train-dict`, or nil
+
+	fromRule bool // chosen by compression_rules, which sampling leaves alone
+}
 
 func (n *ZstdCompression) Compress(out io.Writer, in io.Reader) error {
-	w := zstd.NewWriter(out)
+	level := n.Level
+	if level == 0 {
+		level = zstd.DefaultCompression
+	}
+	var w *zstd.Writer
+	if n.Dict == nil {
+		w = zstd.NewWriterLevel(out, level)
+	} else {
+		w = zstd.NewWriterLevelDict(out, level, n.Dict.Content)
+	}
 	utils.Copy(w, in)
 	return w.Close()
 }
 
 func (n *ZstdCompression) Decompress(in io.Reader) io.ReadCloser {
-	return zstd.NewReader(in)
+	if n.Dict == nil {
+		return zstd.NewReader(in)
+	}
+	return zstd.NewReaderDict(in, n.Dict.Content)
 }
 
 func (n *ZstdCompression) AlgName() string {
-	return "zstd"
+	if n.Dict == nil {
+		return "zstd"
+	}
+	return zstdDictAlgPrefix + strconv.FormatInt(n.Dict.ID, 10)
 }
 
 func (n *ZstdCompression) Fallible() bool {
@@ -28,5 +49,9 @@ func (n *ZstdCompression) Fallible() bool {
 }
 
 func (n *ZstdCompression) DecompressionTrollBashCommandIncludingThePipe() string {
-	return " | zstd -d"
+	if n.Dict == nil {
+		return " | zstd -d"
+	}
+	// see ZstdDictExportCommand
+	return " | zstd -d -D " + n.AlgName()
 }
@@ -0,0 +1,99 @@
+package compression
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/db"
+)
+
+// blob entries compressed with a trained dictionary have compression_alg "zstd-dict-<dict_id>", see the zstd_dictionaries table
+const zstdDictAlgPrefix = "zstd-dict-"
+
+type ZstdDict struct {
+	ID      int64
+	Content []byte
+}
+
+// dictionaries never change once trained, but ids are only unique within one database, so cache by hash
+var zstdDictCacheLock sync.Mutex
+var zstdDictCache = make(map[string][]byte)
+
+// which dictionary (or nil for none) each extension gets, since asking the database for every small file adds up
+// the database it's for is remembered too, so that it's forgotten if the database changes
+var zstdDictForExtLock sync.Mutex
+var zstdDictForExt = make(map[string]*ZstdDict)
+var zstdDictForExtDB string
+
+// call when a dictionary is added, so that the next file picks it up
+func ForgetZstdDictChoices() {
+	zstdDictForExtLock.Lock()
+	defer zstdDictForExtLock.Unlock()
+	zstdDictForExt = make(map[string]*ZstdDict)
+}
+
+func IsZstdDictAlgName(algName string) bool {
+	return strings.HasPrefix(algName, zstdDictAlgPrefix)
+}
+
+func zstdDictByAlgName(algName string) *ZstdDict {
+	id, err := strconv.ParseInt(strings.TrimPrefix(algName, zstdDictAlgPrefix), 10, 64)
+	if err != nil {
+		return nil
+	}
+	return zstdDictByID(id)
+}
+
+func zstdDictByID(id int64) *ZstdDict {
+	var hash []byte
+	err := db.DB.QueryRow("SELECT hash FROM zstd_dictionaries WHERE dict_id = ?", id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	db.Must(err)
+	zstdDictCacheLock.Lock()
+	defer zstdDictCacheLock.Unlock()
+	content, ok := zstdDictCache[hex.EncodeToString(hash)]
+	if !ok {
+		db.Must(db.DB.QueryRow("SELECT content FROM zstd_dictionaries WHERE dict_id = ?", id).Scan(&content))
+		zstdDictCache[hex.EncodeToString(hash)] = content
+	}
+	return &ZstdDict{ID: id, Content: content}
+}
+
+// the newest dictionary trained on this extension, otherwise the newest one trained on anything, otherwise nil
+func zstdDictForPath(path string, size int64) *ZstdDict {
+	if size > config.Config().ZstdDictMaxSize {
+		return nil
+	}
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	zstdDictForExtLock.Lock()
+	defer zstdDictForExtLock.Unlock()
+	if zstdDictForExtDB != config.Config().DatabaseLocation {
+		zstdDictForExt = make(map[string]*ZstdDict)
+		zstdDictForExtDB = config.Config().DatabaseLocation
+	}
+	dict, ok := zstdDictForExt[ext]
+	if ok {
+		return dict
+	}
+	var id int64
+	err := db.DB.QueryRow("SELECT dict_id FROM zstd_dictionaries WHERE extension = ? OR extension = '' ORDER BY extension = '', dict_id DESC LIMIT 1", ext).Scan(&id)
+	if err != sql.ErrNoRows {
+		db.Must(err)
+		dict = zstdDictByID(id)
+	}
+	zstdDictForExt[ext] = dict
+	return dict
+}
+
+// zstd can't decompress without the dictionary, so to decompress an entry by hand, it has to be written to a file first
+func ZstdDictExportCommand(algName string) string {
+	id := strings.TrimPrefix(algName, zstdDictAlgPrefix)
+	return "sqlite3 " + config.Config().DatabaseLocation + " \"SELECT writefile('" + algName + "', content) FROM zstd_dictionaries WHERE dict_id = " + id + "\""
+}
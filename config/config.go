@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
@@ -15,30 +16,50 @@ var DatabaseLocation string
 var inited = false
 
 type ConfigData struct {
-	MinBlobSize            int64    `json:"min_blob_size"`
-	MinBlobCount           int64    `json:"min_blob_count"`
-	MinCompressSize        int64    `json:"min_compress_size"`
-	DatabaseLocation       string   `json:"database_location"`
-	PaddingMinBytes        int64    `json:"padding_min_bytes"`
-	PaddingMaxBytes        int64    `json:"padding_max_bytes"`
-	PaddingMinPercent      float64  `json:"padding_min_percent"`
-	PaddingMaxPercent      float64  `json:"padding_max_percent"`
-	NumHasherThreads       int      `json:"num_hasher_threads"`
-	NumUploaderThreads     int      `json:"num_uploader_threads"`
-	UploadStatusInterval   int      `json:"upload_status_print_interval"`
-	NoCompressionExts      []string `json:"no_compression_exts"`
-	Includes               []string `json:"includes"`
-	ExcludeSuffixes        []string `json:"exclude_suffixes"`
-	ExcludePrefixes        []string `json:"exclude_prefixes"`
-	DedupeExclude          []string `json:"dedupe_exclude"`
-	IgnorePermissionErrors bool     `json:"ignore_permission_errors"`
-	ShareUsePasswordURL    bool     `json:"share_use_password_url"`
-	SharePasswordURL       string   `json:"share_password_url"`
-	ShareUrlPasswordLength int      `json:"share_url_password_length"`
-	DisableLeptonGo        bool     `json:"disable_lepton_go"`
-	SkipHashFailures       bool     `json:"skip_hash_failures"`
-	UseGitignore           bool     `json:"use_gitignore"`
-	DefaultStorage         string   `json:"default_storage"`
+	MinBlobSize             int64             `json:"min_blob_size"`
+	MinBlobCount            int64             `json:"min_blob_count"`
+	MinCompressSize         int64             `json:"min_compress_size"`
+	DatabaseLocation        string            `json:"database_location"`
+	PaddingMinBytes         int64             `json:"padding_min_bytes"`
+	PaddingMaxBytes         int64             `json:"padding_max_bytes"`
+	PaddingMinPercent       float64           `json:"padding_min_percent"`
+	PaddingMaxPercent       float64           `json:"padding_max_percent"`
+	NumHasherThreads        int               `json:"num_hasher_threads"`
+	NumUploaderThreads      int               `json:"num_uploader_threads"`
+	NumRestoreThreads       int               `json:"num_restore_threads"`
+	UploadStatusInterval    int               `json:"upload_status_print_interval"`
+	NoCompressionExts       []string          `json:"no_compression_exts"`
+	Includes                []string          `json:"includes"`
+	ExcludeSuffixes         []string          `json:"exclude_suffixes"`
+	ExcludePrefixes         []string          `json:"exclude_prefixes"`
+	DedupeExclude           []string          `json:"dedupe_exclude"`
+	IgnorePermissionErrors  bool              `json:"ignore_permission_errors"`
+	ShareUsePasswordURL     bool              `json:"share_use_password_url"`
+	SharePasswordURL        string            `json:"share_password_url"`
+	ShareUrlPasswordLength  int               `json:"share_url_password_length"`
+	DisableLeptonGo         bool              `json:"disable_lepton_go"`
+	Redeflate               bool              `json:"redeflate"`
+	SkipHashFailures        bool              `json:"skip_hash_failures"`
+	UseGitignore            bool              `json:"use_gitignore"`
+	DefaultStorage          string            `json:"default_storage"`
+	DBBackupMaxIncrementals int               `json:"db_backup_max_incrementals"`
+	PublicKey               string            `json:"public_key"`
+	PrivateKeyFile          string            `json:"private_key_file"`
+	BlobEncryption          string            `json:"blob_encryption"`
+	CompressionRules        []CompressionRule `json:"compression_rules"`
+	ZstdDictMaxSize         int64             `json:"zstd_dict_max_size"`
+	CompressionSampling     bool              `json:"compression_sampling"`
+	ContentIndex            bool              `json:"content_index"`
+	ContentIndexExts        []string          `json:"content_index_exts"`
+	ContentIndexMaxSize     int64             `json:"content_index_max_size"`
+}
+
+// exactly one of Extension or PathPrefix
+type CompressionRule struct {
+	Extension  string `json:"extension,omitempty"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	Algorithm  string `json:"algorithm"`
+	Level      int    `json:"level,omitempty"` // only for zstd, 0 is zstd's default
 }
 
 func Config() ConfigData {
@@ -57,6 +78,7 @@ var config = ConfigData{
 	PaddingMaxPercent:    0.1, // percent means percent. this is 0.1% not 10%!!
 	NumHasherThreads:     2,
 	NumUploaderThreads:   8,
+	NumRestoreThreads:    8,
 	UploadStatusInterval: 5, // interval between "Bytes written:" prints, in seconds [-1 to disable prints]
 	NoCompressionExts: []string{
 		"mp4",
@@ -130,6 +152,71 @@ var config = ConfigData{
 	DisableLeptonGo:        false,
 	SkipHashFailures:       false,
 	UseGitignore:           false,
+	// store pngs and zips (docx, jar, epub, ...) as their inflated contents plus whatever it takes for zlib to make the exact same bytes again, then zstd'd
+	// this is slow to compress (it has to guess the zlib settings), and files that zlib didn't make just fall back to no compression
+	// off by default because getting the exact bytes back needs a zlib that deflates the same way as the one gb was built with when the file was backed up
+	// with a different zlib (an upgrade, zlib-ng, another machine) restoring those files fails, rather than writing something that isn't what was backed up, and they can only be restored by a gb built with a zlib that deflates the same way
+	// png, zip and jar are in no_compression_exts by default, which wins over this, so take them out of it for this to apply to them
+	Redeflate: false,
+	// "" is AES-CTR, which is what gb has always used. "aes-gcm-chunked" authenticates every 64KiB of every entry, so tampering is detected before anything is decompressed
+	// webshare can only decrypt AES-CTR, so files that are shared are always AES-CTR regardless
+	BlobEncryption:   "",
+	CompressionRules: []CompressionRule{
+		// the compression to use instead of zstd, e.g. lz4 for a fast machine with a fat pipe, or xz / brotli for cold archival data
+		// an extension rule applies anywhere, and wins over everything else (even no_compression_exts and lepton for jpgs)
+		// a path prefix rule only replaces the default zstd, you REALLY SHOULD include the trailing /, and the longest matching prefix wins
+		// e.g.
+		// {"extension": "log", "algorithm": "xz"},
+		// {"path_prefix": "/path/to/archive/", "algorithm": "brotli"},
+		// {"extension": "json", "algorithm": "zstd", "level": 19},
+		// algorithms: "" (none), "zstd", "xz", "brotli", "lz4"
+	},
+	// files up to this size that would be compressed with zstd use the newest dictionary from `gb train-dict` for their extension (or the newest one for any extension), if there is one
+	ZstdDictMaxSize: 128 * 1024,
+	// trial compress the start of each file, to skip compressing random looking files with the default zstd, and to compress files in no_compression_exts that turn out to be compressible anyway
+	// whatever compression_rules pick is left alone
+	CompressionSampling: false,
+	// while backing up, put the words of text files into a full text index, so `gb grep` can find them without downloading anything
+	// the index is next to the database, encrypted with a key derived from the database key. it isn't backed up, since `gb reindex` can always make it again (which is also how to index what was backed up before turning this on)
+	// all of the index is held in memory while it's used, and rewritten in full each time a backup adds to it, so how big it can get is limited by RAM
+	ContentIndex: false,
+	// files with these extensions are indexed if they're valid utf8, and anything else is indexed if it looks like text
+	ContentIndexExts: []string{
+		"txt",
+		"md",
+		"rst",
+		"org",
+		"tex",
+		"csv",
+		"tsv",
+		"json",
+		"yaml",
+		"yml",
+		"toml",
+		"ini",
+		"conf",
+		"xml",
+		"html",
+		"htm",
+		"css",
+		"js",
+		"ts",
+		"go",
+		"py",
+		"rb",
+		"rs",
+		"java",
+		"c",
+		"h",
+		"cpp",
+		"sh",
+		"sql",
+		"log",
+		"srt",
+		"eml",
+	},
+	// bigger files aren't indexed
+	ContentIndexMaxSize: 1024 * 1024,
 }
 
 /*
@@ -205,6 +292,9 @@ func sanity() {
 	if config.NumUploaderThreads < 1 {
 		panic("NumUploaderThreads must be at least 1")
 	}
+	if config.NumRestoreThreads < 1 {
+		panic("NumRestoreThreads must be at least 1")
+	}
 	if config.UploadStatusInterval < -1 || config.UploadStatusInterval == 0 {
 		panic("UploadStatusInterval must be -1 or positive")
 	}
@@ -213,6 +303,21 @@ func sanity() {
 	mustBeLower(config.ExcludeSuffixes)
 	mustBeLower(config.DedupeExclude)
 	mustEndWithSlash(config.Includes)
+	for _, rule := range config.CompressionRules {
+		if (rule.Extension == "") == (rule.PathPrefix == "") {
+			panic("each compression rule must have exactly one of extension or path_prefix")
+		}
+		mustBeLower([]string{rule.Extension, rule.PathPrefix})
+		if strings.HasPrefix(rule.Extension, ".") {
+			panic(rule.Extension + " in compression rules should not start with a .")
+		}
+		if !slices.Contains(compressionRuleAlgorithms, rule.Algorithm) {
+			panic("unknown algorithm \"" + rule.Algorithm + "\" in compression_rules, must be one of \"" + strings.Join(compressionRuleAlgorithms, "\", \"") + "\"")
+		}
+		if rule.Level != 0 && (rule.Algorithm != "zstd" || rule.Level < 1 || rule.Level > 22) {
+			panic("a level in compression rules is only for zstd, and must be 1 to 22")
+		}
+	}
 	if len(config.Includes) == 0 {
 		panic("No include paths")
 	}
@@ -224,11 +329,27 @@ func sanity() {
 	if config.DatabaseLocation != dbAbs {
 		panic("DatabaseLocation must be absolute path")
 	}
+	if config.DBBackupMaxIncrementals < 0 {
+		panic("db_backup_max_incrementals must be 0 (every database backup is a full backup) or positive")
+	}
+	if config.PrivateKeyFile != "" && !filepath.IsAbs(config.PrivateKeyFile) {
+		panic("PrivateKeyFile must be absolute path")
+	}
+	if config.BlobEncryption != "" && config.BlobEncryption != "aes-gcm-chunked" {
+		panic("BlobEncryption must be \"\" (AES-CTR) or \"aes-gcm-chunked\"")
+	}
+	mustBeLower(config.ContentIndexExts)
+	if config.ContentIndexMaxSize < 1 {
+		panic("ContentIndexMaxSize must be positive")
+	}
 	if config.ShareUrlPasswordLength < 8 {
 		panic("gb cannot in good conscience condone such an insecure password length")
 	}
 }
 
+// what compression.ByAlgName knows (config can't import compression, since compression imports config)
+var compressionRuleAlgorithms = []string{"", "zstd", "lepton", "xz", "brotli", "lz4", "redeflate"}
+
 func mustBeLower(data []string) {
 	for _, str := range data {
 		if strings.ToLower(str) != str {
@@ -295,7 +416,43 @@ func SetTestConfig(databaseLocation string) {
 	config.MinBlobSize = 1000
 }
 
+// SetDBBackupMaxIncrementals sets the DBBackupMaxIncrementals config option (for testing).
+func SetDBBackupMaxIncrementals(value int) {
+	config.DBBackupMaxIncrementals = value
+}
+
+// SetKeyPair sets the PublicKey and PrivateKeyFile config options (for testing).
+func SetKeyPair(publicKey string, privateKeyFile string) {
+	config.PublicKey = publicKey
+	config.PrivateKeyFile = privateKeyFile
+}
+
+// SetBlobEncryption sets the BlobEncryption config option (for testing).
+func SetBlobEncryption(value string) {
+	config.BlobEncryption = value
+}
+
+// SetCompressionRules sets the CompressionRules config option (for testing).
+func SetCompressionRules(rules []CompressionRule) {
+	config.CompressionRules = rules
+}
+
+// SetCompressionSampling sets the CompressionSampling config option (for testing).
+func SetCompressionSampling(value bool) {
+	config.CompressionSampling = value
+}
+
+// SetRedeflate sets the Redeflate config option (for testing).
+func SetRedeflate(value bool) {
+	config.Redeflate = value
+}
+
 // SetSkipHashFailures sets the SkipHashFailures config option (for testing).
 func SetSkipHashFailures(value bool) {
 	config.SkipHashFailures = value
 }
+
+// SetContentIndex sets the ContentIndex config option (for testing).
+func SetContentIndex(value bool) {
+	config.ContentIndex = value
+}
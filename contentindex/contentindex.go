@@ -0,0 +1,330 @@
+package contentindex
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/crypto"
+	"github.com/leijurv/gb/db"
+	"github.com/mattn/go-sqlite3"
+)
+
+// the full text index of every text file that's been backed up with content_index on
+// it's its own database next to the main one, since there's no need to back it up (`gb reindex` can always make it again)
+// the fts table is contentless, so what's stored is which words are in which hash, not the text itself. but that's still enough to tell what a file says, so it's encrypted
+// to keep it that way it's only ever decrypted into memory: all of it is loaded when it's first used, and Save re-encrypts and rewrites the whole thing
+// so how big the index can get is limited by RAM, and every Save costs as much as the whole index, not just what was added
+// (fts4 rather than fts5, since that's what go-sqlite3 has without build tags)
+
+var lock sync.Mutex
+var indexDB *sql.DB
+var indexPath string
+var changed bool
+
+func Path() string {
+	return config.Config().DatabaseLocation + "-contentindex"
+}
+
+// the index is encrypted with a key derived from the database key, so there's nothing more to keep safe
+func indexKey(dbKey []byte) []byte {
+	domain := sha256.Sum256([]byte("gb content index key"))
+	return crypto.ComputeMAC(domain[:], dbKey)
+}
+
+func currentIndexKey() []byte {
+	var key []byte
+	err := db.DB.QueryRow("SELECT key FROM db_key").Scan(&key)
+	if err == db.ErrNoRows {
+		panic("there's no database key yet, so there's nothing to encrypt the content index with")
+	}
+	db.Must(err)
+	return indexKey(key)
+}
+
+func loaded() bool {
+	return indexDB != nil && indexPath == Path()
+}
+
+// must hold lock
+func open() *sql.DB {
+	if !loaded() {
+		load(Path(), currentIndexKey())
+	}
+	return indexDB
+}
+
+// must hold lock
+func load(path string, key []byte) {
+	if indexDB != nil {
+		indexDB.Close()
+		indexDB = nil
+	}
+	mem, err := sql.Open("sqlite3", ":memory:")
+	db.Must(err)
+	// every connection to :memory: is a different database, so there must only ever be the one
+	mem.SetMaxOpenConns(1)
+	mem.SetMaxIdleConns(1)
+	mem.SetConnMaxLifetime(0)
+	enc, err := os.ReadFile(path)
+	if err == nil {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Println("The content index at", path, "can't be decrypted with this database's key. If it's from some other database, delete it, and `gb reindex` will make a new one")
+					panic(r)
+				}
+			}()
+			deserialize(mem, crypto.DecryptDatabaseV2(enc, key))
+		}()
+	} else if !os.IsNotExist(err) {
+		panic(err)
+	}
+	_, err = mem.Exec(`
+	CREATE TABLE IF NOT EXISTS hashes (
+
+		docid INTEGER NOT NULL PRIMARY KEY, /* the docid of this hash's row in content */
+		hash  BLOB    NOT NULL, /* sha256 of the file that was indexed */
+
+		UNIQUE(hash),
+		CHECK(LENGTH(hash) == 32)
+	);
+	CREATE VIRTUAL TABLE IF NOT EXISTS content USING fts4(content="", body, tokenize=unicode61);
+	/* hashes that were looked at and definitely aren't text, so that reindex doesn't fetch them again */
+	CREATE TABLE IF NOT EXISTS binary (
+
+		hash BLOB NOT NULL PRIMARY KEY,
+
+		CHECK(LENGTH(hash) == 32)
+	);
+	`)
+	db.Must(err)
+	indexDB = mem
+	indexPath = path
+	changed = false
+}
+
+func raw(mem *sql.DB, f func(conn *sqlite3.SQLiteConn)) {
+	conn, err := mem.Conn(context.Background())
+	db.Must(err)
+	defer conn.Close()
+	db.Must(conn.Raw(func(driverConn any) error {
+		f(driverConn.(*sqlite3.SQLiteConn))
+		return nil
+	}))
+}
+
+func deserialize(mem *sql.DB, data []byte) {
+	scratch, err := (&sqlite3.SQLiteDriver{}).Open(":memory:")
+	db.Must(err)
+	defer scratch.Close()
+	src := scratch.(*sqlite3.SQLiteConn)
+	db.Must(src.Deserialize(data, "main"))
+	// a deserialized database can't grow past the size it was, so copy it into one that can
+	raw(mem, func(dst *sqlite3.SQLiteConn) {
+		backup, err := dst.Backup("main", src, "main")
+		db.Must(err)
+		done, err := backup.Step(-1)
+		db.Must(err)
+		if !done {
+			panic("content index wasn't copied all at once")
+		}
+		db.Must(backup.Finish())
+	})
+}
+
+// must hold lock
+func save(key []byte) {
+	var data []byte
+	raw(indexDB, func(conn *sqlite3.SQLiteConn) {
+		var err error
+		data, err = conn.Serialize("main")
+		db.Must(err)
+	})
+	tmp := indexPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	db.Must(err)
+	out := crypto.EncryptDatabaseV2(f, key)
+	_, err = out.Write(data)
+	db.Must(err)
+	hash := sha256.Sum256(data)
+	_, err = out.Write(crypto.ComputeMAC(hash[:], key))
+	db.Must(err)
+	db.Must(f.Close())
+	db.Must(os.Rename(tmp, indexPath))
+	changed = false
+}
+
+// write out whatever's been added to the index since it was loaded
+func Save() {
+	lock.Lock()
+	defer lock.Unlock()
+	if !loaded() || !changed {
+		return
+	}
+	save(currentIndexKey())
+	log.Println("Saved the content index")
+}
+
+// re-encrypt the index for a new database key. the index is read with the old key before update is called, and only written under the new key once update (which is what actually replaces the key in the database) has succeeded
+func Rekey(oldKey []byte, newKey []byte, update func()) {
+	lock.Lock()
+	defer lock.Unlock()
+	if !loaded() {
+		if _, err := os.Stat(Path()); os.IsNotExist(err) {
+			update()
+			return
+		}
+		load(Path(), indexKey(oldKey))
+	}
+	update()
+	save(indexKey(newKey))
+	log.Println("Re-encrypted the content index with the new database key")
+}
+
+// forget the index that's in memory without saving it, so the next use loads it from disk again (for testing)
+func Unload() {
+	lock.Lock()
+	defer lock.Unlock()
+	if indexDB != nil {
+		indexDB.Close()
+		indexDB = nil
+	}
+}
+
+// collects what's read from a file as it's backed up, so that it can be indexed afterwards
+type Collector struct {
+	path     string
+	max      int64
+	buf      bytes.Buffer
+	overflow bool
+}
+
+// nil if the index is off, or this file is too big to be indexed
+func NewCollector(path string, size int64) *Collector {
+	if !config.Config().ContentIndex || size == 0 || size > config.Config().ContentIndexMaxSize {
+		return nil
+	}
+	return &Collector{path: path, max: config.Config().ContentIndexMaxSize}
+}
+
+func (c *Collector) Write(p []byte) (int, error) {
+	if c.overflow {
+		return len(p), nil
+	}
+	if int64(c.buf.Len()+len(p)) > c.max {
+		// it grew while it was being backed up
+		c.overflow = true
+		c.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+// whether what was read can't be text no matter what the file is called
+func (c *Collector) binary() bool {
+	data := c.buf.Bytes()
+	return !c.overflow && len(data) > 0 && (!utf8.Valid(data) || bytes.IndexByte(data, 0) != -1)
+}
+
+// what was read, if it's text
+func (c *Collector) text() ([]byte, bool) {
+	data := c.buf.Bytes()
+	if c.overflow || len(data) == 0 || c.binary() {
+		return nil, false
+	}
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(c.path)), ".")
+	for _, textExt := range config.Config().ContentIndexExts {
+		if ext == textExt {
+			return data, true
+		}
+	}
+	return data, strings.HasPrefix(http.DetectContentType(data), "text/")
+}
+
+// index what c collected under hash, if it's text and that hash isn't already indexed
+// c can be nil, in which case this does nothing
+// this only changes the index in memory, it's written out by Save
+func Add(hash []byte, c *Collector) {
+	if c == nil {
+		return
+	}
+	data, ok := c.text()
+	if !ok {
+		if c.binary() {
+			addBinary(hash)
+		}
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	tx, err := open().Begin()
+	db.Must(err)
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT OR IGNORE INTO hashes (hash) VALUES (?)", hash)
+	db.Must(err)
+	inserted, err := res.RowsAffected()
+	db.Must(err)
+	if inserted == 0 {
+		return
+	}
+	docid, err := res.LastInsertId()
+	db.Must(err)
+	_, err = tx.Exec("INSERT INTO content (docid, body) VALUES (?, ?)", docid, string(data))
+	db.Must(err)
+	db.Must(tx.Commit())
+	changed = true
+	log.Println("Added", c.path, "to the content index")
+}
+
+// remember that hash isn't text
+// whether a file that's valid utf8 is text depends on its name and content_index_exts, so those aren't remembered, only the ones that can never be text
+func addBinary(hash []byte) {
+	lock.Lock()
+	defer lock.Unlock()
+	res, err := open().Exec("INSERT OR IGNORE INTO binary (hash) VALUES (?)", hash)
+	db.Must(err)
+	inserted, err := res.RowsAffected()
+	db.Must(err)
+	if inserted > 0 {
+		changed = true
+	}
+}
+
+// whether hash is in the index already, or is known not to be text
+func Has(hash []byte) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	var found bool
+	db.Must(open().QueryRow("SELECT EXISTS(SELECT 1 FROM hashes WHERE hash = ?) OR EXISTS(SELECT 1 FROM binary WHERE hash = ?)", hash, hash).Scan(&found))
+	return found
+}
+
+// the hash of every indexed file that matches query, which is in sqlite's full text query syntax (e.g. "quick brown" in quotes for a phrase, or quick* for a prefix)
+func Matches(query string) [][]byte {
+	lock.Lock()
+	defer lock.Unlock()
+	if _, err := os.Stat(Path()); os.IsNotExist(err) && !loaded() {
+		panic("there's no content index at " + Path() + ", turn on content_index in the config, and it'll be built as files are backed up (or run `gb reindex` to build it from what's already backed up)")
+	}
+	rows, err := open().Query("SELECT hashes.hash FROM content INNER JOIN hashes ON hashes.docid = content.docid WHERE content.body MATCH ?", query)
+	db.Must(err)
+	defer rows.Close()
+	ret := make([][]byte, 0)
+	for rows.Next() {
+		var hash []byte
+		db.Must(rows.Scan(&hash))
+		ret = append(ret, hash)
+	}
+	db.Must(rows.Err())
+	return ret
+}
@@ -0,0 +1,59 @@
+package contentindex
+
+import (
+	"crypto/sha256"
+	"io"
+	"log"
+	"os"
+
+	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/download"
+	"github.com/leijurv/gb/storage_base"
+	"github.com/leijurv/gb/utils"
+)
+
+// index everything that's backed up but isn't in the index yet, such as whatever was backed up before content_index was turned on
+// each one is read from disk if it's still there unchanged, and is downloaded from stor otherwise
+// returns how many files it looked at
+func Reindex(stor storage_base.Storage) int {
+	type toIndex struct {
+		hash []byte
+		path string
+	}
+	// the path to read it from is the one that has it now if there is one, since that's likely still on disk, and otherwise the one that had it most recently
+	rows, err := db.DB.Query(`
+		SELECT sizes.hash, (SELECT files.path FROM files WHERE files.hash = sizes.hash ORDER BY files.end IS NOT NULL, files.start DESC LIMIT 1) AS path
+		FROM sizes
+		WHERE sizes.size BETWEEN 1 AND ? AND path IS NOT NULL
+		ORDER BY path`, config.Config().ContentIndexMaxSize)
+	db.Must(err)
+	todo := make([]toIndex, 0)
+	for rows.Next() {
+		var item toIndex
+		db.Must(rows.Scan(&item.hash, &item.path))
+		todo = append(todo, item)
+	}
+	db.Must(rows.Err())
+	rows.Close()
+
+	var fromDisk, downloaded int
+	for _, item := range todo {
+		if Has(item.hash) {
+			continue
+		}
+		c := &Collector{path: item.path, max: config.Config().ContentIndexMaxSize}
+		if data, err := os.ReadFile(item.path); err == nil && sha256.Sum256(data) == utils.SliceToArr(item.hash) {
+			c.buf.Write(data)
+			fromDisk++
+		} else {
+			_, err := io.Copy(&c.buf, download.CatEz(item.hash, stor))
+			db.Must(err)
+			downloaded++
+		}
+		Add(item.hash, c)
+	}
+	Save()
+	log.Println("Looked at", fromDisk+downloaded, "files that weren't in the content index,", fromDisk, "read from disk and", downloaded, "downloaded")
+	return fromDisk + downloaded
+}
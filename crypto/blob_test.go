@@ -41,3 +41,70 @@ func TestSeeking(t *testing.T) {
 		}
 	}
 }
+
+func encryptEntry(t *testing.T, data []byte, alg string) ([]byte, []byte) {
+	var encBuf bytes.Buffer
+	w, key := EncryptBlobEntry(&encBuf, 1337, alg)
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return encBuf.Bytes(), key
+}
+
+func readRange(enc []byte, alg string, key []byte, start int64, length int64) ([]byte, error) {
+	fetchStart, fetchLength := BlobEntryRange(alg, int64(len(enc)), start, length)
+	return ioutil.ReadAll(DecryptBlobEntryRange(bytes.NewReader(enc[fetchStart:fetchStart+fetchLength]), alg, key, 1337, int64(len(enc)), start, length))
+}
+
+func TestChunkedGCMRanges(t *testing.T) {
+	chunk := ChunkedGCMChunkSize
+	for _, size := range []int{0, 1, chunk - 1, chunk, chunk + 1, 3*chunk + 5} {
+		data := RandBytes(size)
+		for _, alg := range []string{BlobEncryptionCTR, BlobEncryptionChunkedGCM} {
+			enc, key := encryptEntry(t, data, alg)
+			if BlobEntryPlaintextLength(alg, int64(len(enc))) != int64(size) {
+				t.Fatalf("%q size %d: wrong plaintext length", alg, size)
+			}
+			for _, r := range [][2]int{{0, size}, {0, 0}, {size, 0}, {size / 2, size / 2}, {size / 3, size / 3}, {size - size/4, size / 4}} {
+				dec, err := readRange(enc, alg, key, int64(r[0]), int64(r[1]))
+				if err != nil {
+					t.Fatalf("%q size %d range %v: %v", alg, size, r, err)
+				}
+				if !bytes.Equal(dec, data[r[0]:r[0]+r[1]]) {
+					t.Errorf("%q size %d range %v: wrong data", alg, size, r)
+				}
+			}
+		}
+	}
+}
+
+func TestChunkedGCMTampering(t *testing.T) {
+	data := RandBytes(2*ChunkedGCMChunkSize + 100)
+	enc, key := encryptEntry(t, data, BlobEncryptionChunkedGCM)
+
+	flipped := append([]byte{}, enc...)
+	flipped[ChunkedGCMChunkSize+100] ^= 1
+	if _, err := readRange(flipped, BlobEncryptionChunkedGCM, key, 0, int64(len(data))); err != ErrBlobEntryTampered {
+		t.Errorf("flipped bit should fail authentication, got %v", err)
+	}
+	// the first chunk is still fine on its own
+	if dec, err := readRange(flipped, BlobEncryptionChunkedGCM, key, 0, 100); err != nil || !bytes.Equal(dec, data[:100]) {
+		t.Errorf("untouched chunk should still be readable, got %v", err)
+	}
+
+	// dropping the final chunk leaves a valid looking entry that ends in a non-final chunk
+	truncated := enc[:2*(ChunkedGCMChunkSize+16)]
+	if _, err := readRange(truncated, BlobEncryptionChunkedGCM, key, 0, BlobEntryPlaintextLength(BlobEncryptionChunkedGCM, int64(len(truncated)))); err != ErrBlobEntryTampered {
+		t.Errorf("truncation should fail authentication, got %v", err)
+	}
+
+	swapped := append([]byte{}, enc[ChunkedGCMChunkSize+16:2*(ChunkedGCMChunkSize+16)]...)
+	swapped = append(swapped, enc[:ChunkedGCMChunkSize+16]...)
+	swapped = append(swapped, enc[2*(ChunkedGCMChunkSize+16):]...)
+	if _, err := readRange(swapped, BlobEncryptionChunkedGCM, key, 0, int64(len(data))); err != ErrBlobEntryTampered {
+		t.Errorf("reordered chunks should fail authentication, got %v", err)
+	}
+}
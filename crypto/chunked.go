@@ -0,0 +1,251 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// blob entry encryption algorithms, as stored in blob_entries.encryption_alg
+const (
+	BlobEncryptionCTR        = ""                // the original format. no integrity of its own, that comes from the sha256 check after decompression
+	BlobEncryptionChunkedGCM = "aes-gcm-chunked" // authenticated, and still seekable
+)
+
+// aes-gcm-chunked: the entry is split into chunks of ChunkedGCMChunkSize bytes, each sealed on its own with a 16 byte tag
+// nonce is the big endian chunk index, plus a flag in the last byte on the final chunk, so that chunks can't be reordered, dropped, or truncated off the end
+// an empty entry is still one (empty) final chunk, i.e. just a tag
+// the key is unique per entry, so there's no need for anything else in the nonce (the offset in the blob doesn't matter, unlike with CTR)
+const ChunkedGCMChunkSize = 64 * 1024
+const chunkedGCMOverhead = 16
+const chunkedGCMStoredChunkSize = ChunkedGCMChunkSize + chunkedGCMOverhead
+
+var ErrBlobEntryTampered = errors.New("blob entry failed authentication: it was corrupted or tampered with")
+
+func chunkedGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return gcm
+}
+
+func chunkNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type chunkedGCMWriter struct {
+	out   io.Writer
+	gcm   cipher.AEAD
+	buf   []byte
+	index int64
+}
+
+func (w *chunkedGCMWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if len(w.buf) == ChunkedGCMChunkSize {
+			// there's more data, so this chunk isn't the final one
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):ChunkedGCMChunkSize], data)
+		w.buf = w.buf[:len(w.buf)+n]
+		data = data[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *chunkedGCMWriter) flush(final bool) error {
+	sealed := w.gcm.Seal(nil, chunkNonce(w.index, final), w.buf, nil)
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.out.Write(sealed)
+	return err
+}
+
+// writes the final chunk. must be called, otherwise the entry is unreadable
+func (w *chunkedGCMWriter) Close() error {
+	if w.gcm == nil {
+		panic("closed twice")
+	}
+	err := w.flush(true)
+	w.gcm = nil
+	return err
+}
+
+type nopCloseWriter struct {
+	io.Writer
+}
+
+func (nopCloseWriter) Close() error {
+	return nil
+}
+
+// the writer must be closed once the entry is complete
+func EncryptBlobEntry(out io.Writer, seekOffset int64, alg string) (io.WriteCloser, []byte) {
+	switch alg {
+	case BlobEncryptionCTR:
+		writer, key := EncryptBlob(out, seekOffset)
+		return nopCloseWriter{writer}, key
+	case BlobEncryptionChunkedGCM:
+		key := RandBytes(16)
+		return &chunkedGCMWriter{out: out, gcm: chunkedGCM(key), buf: make([]byte, 0, ChunkedGCMChunkSize)}, key
+	default:
+		panic("unknown blob encryption " + alg)
+	}
+}
+
+// how many bytes an entry of storedLength bytes (blob_entries.final_size) decrypts to
+func BlobEntryPlaintextLength(alg string, storedLength int64) int64 {
+	switch alg {
+	case BlobEncryptionCTR:
+		return storedLength
+	case BlobEncryptionChunkedGCM:
+		if storedLength < chunkedGCMOverhead {
+			panic("aes-gcm-chunked entry is too short")
+		}
+		chunks := (storedLength + chunkedGCMStoredChunkSize - 1) / chunkedGCMStoredChunkSize
+		return storedLength - chunks*chunkedGCMOverhead
+	default:
+		panic("unknown blob encryption " + alg)
+	}
+}
+
+// to read [start, start+length) of the decrypted entry, which bytes of the stored entry (relative to the entry's offset in the blob) need to be fetched
+func BlobEntryRange(alg string, storedLength int64, start int64, length int64) (int64, int64) {
+	if start < 0 || length < 0 || start+length > BlobEntryPlaintextLength(alg, storedLength) {
+		panic("range out of bounds")
+	}
+	switch alg {
+	case BlobEncryptionCTR:
+		return start, length
+	case BlobEncryptionChunkedGCM:
+		firstChunk := firstChunkOfRange(storedLength, start)
+		lastChunk := firstChunk
+		if length > 0 {
+			lastChunk = (start + length - 1) / ChunkedGCMChunkSize
+		}
+		fetchStart := firstChunk * chunkedGCMStoredChunkSize
+		fetchEnd := (lastChunk + 1) * chunkedGCMStoredChunkSize
+		if fetchEnd > storedLength {
+			fetchEnd = storedLength
+		}
+		return fetchStart, fetchEnd - fetchStart
+	default:
+		panic("unknown blob encryption " + alg)
+	}
+}
+
+func firstChunkOfRange(storedLength int64, start int64) int64 {
+	chunk := start / ChunkedGCMChunkSize
+	finalIndex := (storedLength - 1) / chunkedGCMStoredChunkSize
+	if chunk > finalIndex {
+		// an empty range at the very end of an entry that's a multiple of the chunk size
+		return finalIndex
+	}
+	return chunk
+}
+
+// in must be the stored bytes given by BlobEntryRange for the same arguments
+// entryOffset is where the entry starts in the blob (CTR needs it, GCM doesn't)
+// returns exactly [start, start+length) of the decrypted entry. with GCM, every chunk is authenticated before any of it is returned, and tampering is a read error
+func DecryptBlobEntryRange(in io.Reader, alg string, key []byte, entryOffset int64, storedLength int64, start int64, length int64) io.Reader {
+	fetchStart, fetchLength := BlobEntryRange(alg, storedLength, start, length)
+	switch alg {
+	case BlobEncryptionCTR:
+		return io.LimitReader(DecryptBlobEntry(in, entryOffset+fetchStart, key), length)
+	case BlobEncryptionChunkedGCM:
+		return &chunkedGCMReader{
+			in:         io.LimitReader(in, fetchLength),
+			gcm:        chunkedGCM(key),
+			index:      fetchStart / chunkedGCMStoredChunkSize,
+			finalIndex: (storedLength - 1) / chunkedGCMStoredChunkSize,
+			skip:       start - firstChunkOfRange(storedLength, start)*ChunkedGCMChunkSize,
+			remaining:  length,
+			chunk:      make([]byte, chunkedGCMStoredChunkSize),
+		}
+	default:
+		panic("unknown blob encryption " + alg)
+	}
+}
+
+// the whole entry, given a reader of its stored bytes
+func DecryptFullBlobEntry(in io.Reader, alg string, key []byte, entryOffset int64, storedLength int64) io.Reader {
+	return DecryptBlobEntryRange(in, alg, key, entryOffset, storedLength, 0, BlobEntryPlaintextLength(alg, storedLength))
+}
+
+type chunkedGCMReader struct {
+	in         io.Reader
+	gcm        cipher.AEAD
+	index      int64
+	finalIndex int64
+	skip       int64
+	remaining  int64
+	started    bool
+	chunk      []byte
+	plain      []byte
+	err        error
+}
+
+func (r *chunkedGCMReader) Read(p []byte) (int, error) {
+	// even an empty range reads (and authenticates) a chunk, so that an empty entry is still checked, and fully consumed from in
+	for !r.started || (len(r.plain) == 0 && r.remaining > 0) {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.started = true
+		r.err = r.readChunk()
+	}
+	if r.remaining == 0 {
+		if r.err != nil && r.err != io.EOF {
+			return 0, r.err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+func (r *chunkedGCMReader) readChunk() error {
+	n, err := io.ReadFull(r.in, r.chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if r.index != r.finalIndex || n < chunkedGCMOverhead {
+			return ErrBlobEntryTampered // truncated
+		}
+	} else if err != nil {
+		return err
+	}
+	plain, err := r.gcm.Open(r.chunk[:0], chunkNonce(r.index, r.index == r.finalIndex), r.chunk[:n], nil)
+	if err != nil {
+		return ErrBlobEntryTampered
+	}
+	r.index++
+	if r.skip > int64(len(plain)) {
+		return ErrBlobEntryTampered
+	}
+	r.plain = plain[r.skip:]
+	r.skip = 0
+	if r.index > r.finalIndex {
+		return io.EOF
+	}
+	return nil
+}
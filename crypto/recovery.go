@@ -0,0 +1,148 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	bip39 "github.com/tyler-smith/go-bip39"
+	"golang.org/x/crypto/argon2"
+)
+
+// alternatives to writing down the plain bip39 mnemonic of the database key:
+// 1. the key encrypted with a passphrase (argon2id), printed as a string
+// 2. the key split into shamir shares, each printed as its own (15 word) bip39 mnemonic
+
+const passphrasePrefix = "gbpass1-"
+
+// argon2id parameters, stored alongside the salt so they can be increased later without breaking old ones
+const argonTime = 3
+const argonMemory = 64 * 1024 // KiB, this is the second recommended option from RFC 9106
+const argonThreads = 4
+
+func WrapKeyWithPassphrase(key []byte, passphrase string) string {
+	return wrapKeyWithParams(key, passphrase, argonTime, argonMemory, argonThreads)
+}
+
+func wrapKeyWithParams(key []byte, passphrase string, time uint32, memory uint32, threads uint8) string {
+	salt := RandBytes(16)
+	header := new(bytes.Buffer)
+	header.Write(salt)
+	binary.Write(header, binary.BigEndian, time)
+	binary.Write(header, binary.BigEndian, memory)
+	header.WriteByte(threads)
+	gcm := passphraseGCM(passphrase, salt, time, memory, threads)
+	nonce := RandBytes(gcm.NonceSize())
+	header.Write(nonce)
+	// the header is authenticated too, so the parameters can't be tampered with
+	sealed := gcm.Seal(header.Bytes(), nonce, key, header.Bytes())
+	return passphrasePrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func IsPassphraseWrappedKey(wrapped string) bool {
+	return strings.HasPrefix(strings.TrimSpace(wrapped), passphrasePrefix)
+}
+
+func UnwrapKeyWithPassphrase(wrapped string, passphrase string) ([]byte, error) {
+	if !IsPassphraseWrappedKey(wrapped) {
+		return nil, errors.New("not a passphrase wrapped key")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(wrapped), passphrasePrefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 16+4+4+1+12 {
+		return nil, errors.New("passphrase wrapped key is truncated")
+	}
+	salt := data[:16]
+	time := binary.BigEndian.Uint32(data[16:20])
+	memory := binary.BigEndian.Uint32(data[20:24])
+	threads := data[24]
+	if time == 0 || threads == 0 || memory > 4*1024*1024 {
+		return nil, errors.New("unreasonable argon2id parameters")
+	}
+	gcm := passphraseGCM(passphrase, salt, time, memory, threads)
+	headerLen := 25 + gcm.NonceSize()
+	key, err := gcm.Open(nil, data[25:headerLen], data[headerLen:], data[:headerLen])
+	if err != nil {
+		return nil, errors.New("wrong passphrase (or the wrapped key was mistyped)")
+	}
+	return key, nil
+}
+
+func passphraseGCM(passphrase string, salt []byte, time uint32, memory uint32, threads uint8) cipher.AEAD {
+	block, err := aes.NewCipher(argon2.IDKey([]byte(passphrase), salt, time, memory, threads, 32))
+	if err != nil {
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return gcm
+}
+
+// a share is 20 bytes of bip39 entropy (15 words):
+// x, threshold, 2 byte random id of this split (so shares from different splits aren't mixed up), then the 16 bytes of y
+type KeyShare struct {
+	ShamirShare
+	Threshold int
+	SplitID   [2]byte
+}
+
+func SplitKeyMnemonics(key []byte, threshold int, count int) []string {
+	if len(key) != 16 {
+		panic("bad key")
+	}
+	var splitID [2]byte
+	copy(splitID[:], RandBytes(2))
+	mnemonics := make([]string, 0)
+	for _, share := range ShamirSplit(key, threshold, count) {
+		entropy := append([]byte{share.X, byte(threshold), splitID[0], splitID[1]}, share.Y...)
+		mnemonic, err := bip39.NewMnemonic(entropy)
+		if err != nil {
+			panic(err)
+		}
+		mnemonics = append(mnemonics, mnemonic)
+	}
+	return mnemonics
+}
+
+func ParseKeyShareMnemonic(mnemonic string) (KeyShare, error) {
+	entropy, err := bip39.EntropyFromMnemonic(strings.TrimSpace(mnemonic))
+	if err != nil {
+		return KeyShare{}, err
+	}
+	if len(entropy) != 20 {
+		return KeyShare{}, errors.New("not a key share (a key share is 15 words)")
+	}
+	if entropy[0] == 0 || entropy[1] == 0 {
+		return KeyShare{}, errors.New("invalid key share")
+	}
+	return KeyShare{
+		ShamirShare: ShamirShare{X: entropy[0], Y: entropy[4:]},
+		Threshold:   int(entropy[1]),
+		SplitID:     [2]byte{entropy[2], entropy[3]},
+	}, nil
+}
+
+func CombineKeyShares(shares []KeyShare) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	raw := make([]ShamirShare, 0)
+	for _, share := range shares {
+		if share.SplitID != shares[0].SplitID || share.Threshold != shares[0].Threshold {
+			return nil, errors.New("these shares are not all from the same split")
+		}
+		raw = append(raw, share.ShamirShare)
+	}
+	if len(shares) < shares[0].Threshold {
+		return nil, errors.New("not enough shares")
+	}
+	return ShamirCombine(raw)
+}
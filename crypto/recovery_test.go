@@ -0,0 +1,119 @@
+package crypto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestShamir(t *testing.T) {
+	secret := RandBytes(16)
+	shares := ShamirSplit(secret, 3, 5)
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4, 0}, {0, 1, 2, 3, 4}} {
+		picked := make([]ShamirShare, 0)
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		combined, err := ShamirCombine(picked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(combined, secret) {
+			t.Errorf("subset %v did not recover the secret", subset)
+		}
+	}
+	combined, err := ShamirCombine(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(combined, secret) {
+		t.Error("two shares of a 3-of-5 split should not recover the secret")
+	}
+}
+
+func TestKeyShareMnemonics(t *testing.T) {
+	key := RandBytes(16)
+	mnemonics := SplitKeyMnemonics(key, 2, 3)
+	if len(mnemonics) != 3 || len(strings.Fields(mnemonics[0])) != 15 {
+		t.Fatalf("expected 3 mnemonics of 15 words, got %v", mnemonics)
+	}
+	shares := make([]KeyShare, 0)
+	for _, mnemonic := range []string{mnemonics[2], mnemonics[0]} {
+		share, err := ParseKeyShareMnemonic(mnemonic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares = append(shares, share)
+	}
+	combined, err := CombineKeyShares(shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(combined, key) {
+		t.Error("did not recover the key")
+	}
+	if _, err := CombineKeyShares(shares[:1]); err == nil {
+		t.Error("one share of a 2-of-3 split should be rejected")
+	}
+	other, err := ParseKeyShareMnemonic(SplitKeyMnemonics(key, 2, 3)[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.SplitID != shares[0].SplitID { // 1 in 65536 chance they collide
+		if _, err := CombineKeyShares([]KeyShare{shares[0], other}); err == nil {
+			t.Error("shares from different splits should be rejected")
+		}
+	}
+}
+
+func TestPassphraseWrappedKey(t *testing.T) {
+	key := RandBytes(16)
+	wrapped := wrapKeyWithParams(key, "correct horse battery staple", 1, 1024, 1)
+	if !IsPassphraseWrappedKey(wrapped) {
+		t.Fatal("not recognized")
+	}
+	unwrapped, err := UnwrapKeyWithPassphrase(wrapped, "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Error("did not recover the key")
+	}
+	if _, err := UnwrapKeyWithPassphrase(wrapped, "correct horse battery stapler"); err == nil {
+		t.Error("wrong passphrase should fail")
+	}
+	tampered := []byte(wrapped)
+	tampered[len(passphrasePrefix)+24] ^= 1 // base64 character 24 is within the argon2id time parameter
+	if _, err := UnwrapKeyWithPassphrase(string(tampered), "correct horse battery staple"); err == nil {
+		t.Error("tampered parameters should fail")
+	}
+
+	unwrapped, err = UnwrapKeyWithPassphrase(WrapKeyWithPassphrase(key, "hunter2"), "hunter2")
+	if err != nil || !bytes.Equal(unwrapped, key) {
+		t.Error("did not recover the key with the default parameters")
+	}
+}
+
+func TestSealedKey(t *testing.T) {
+	priv, pub := GenerateKeyPair()
+	key := RandBytes(16)
+	sealed := SealKey(key, pub)
+	if len(sealed) != SealedKeyLength || bytes.Equal(sealed, SealKey(key, pub)) {
+		t.Fatal("sealing should be randomized and 64 bytes")
+	}
+	unsealed, err := UnsealKey(sealed, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unsealed, key) {
+		t.Error("did not recover the key")
+	}
+	other, _ := GenerateKeyPair()
+	if _, err := UnsealKey(sealed, other); err == nil {
+		t.Error("the wrong private key should fail")
+	}
+	sealed[40] ^= 1
+	if _, err := UnsealKey(sealed, priv); err == nil {
+		t.Error("a modified sealed key should fail")
+	}
+}
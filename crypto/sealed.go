@@ -0,0 +1,93 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// "write-only" mode: each blob entry key is sealed to an X25519 public key, so a machine that only has the public key can back up, but can't read any of it back
+// sealed key format: ephemeral public key (32 bytes) || AES-GCM of the 16 byte entry key (16 bytes + 16 byte tag) = 64 bytes
+// the AES key is sha256(shared secret || ephemeral public || recipient public), which is unique per seal, so a zero nonce is fine
+
+const SealedKeyLength = 32 + 16 + 16
+
+func GenerateKeyPair() (*ecdh.PrivateKey, *ecdh.PublicKey) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return priv, priv.PublicKey()
+}
+
+func ParsePublicKey(encoded string) (*ecdh.PublicKey, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+func ParsePrivateKey(encoded string) (*ecdh.PrivateKey, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+func SealKey(key []byte, recipient *ecdh.PublicKey) []byte {
+	if len(key) != 16 {
+		panic("bad key")
+	}
+	ephemeral, ephemeralPublic := GenerateKeyPair()
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		panic(err)
+	}
+	sealed := sealGCM(shared, ephemeralPublic, recipient).Seal(ephemeralPublic.Bytes(), make([]byte, 12), key, nil)
+	if len(sealed) != SealedKeyLength {
+		panic("sanity check")
+	}
+	return sealed
+}
+
+func UnsealKey(sealed []byte, priv *ecdh.PrivateKey) ([]byte, error) {
+	if len(sealed) != SealedKeyLength {
+		return nil, errors.New("sealed key is the wrong length")
+	}
+	ephemeralPublic, err := ecdh.X25519().NewPublicKey(sealed[:32])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(ephemeralPublic)
+	if err != nil {
+		return nil, err
+	}
+	key, err := sealGCM(shared, ephemeralPublic, priv.PublicKey()).Open(nil, make([]byte, 12), sealed[32:], nil)
+	if err != nil {
+		return nil, errors.New("unable to unseal key, is this the right private key?")
+	}
+	return key, nil
+}
+
+func sealGCM(shared []byte, ephemeralPublic *ecdh.PublicKey, recipient *ecdh.PublicKey) cipher.AEAD {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeralPublic.Bytes())
+	h.Write(recipient.Bytes())
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return gcm
+}
@@ -0,0 +1,97 @@
+package crypto
+
+import (
+	"errors"
+)
+
+// shamir secret sharing over GF(2^8), one independent polynomial per byte of the secret
+// same field as AES (x^8 + x^4 + x^3 + x + 1)
+
+func gfMul(a byte, b byte) byte {
+	var result byte
+	for b > 0 {
+		if b&1 != 0 {
+			result ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return result
+}
+
+func gfInverse(a byte) byte {
+	if a == 0 {
+		panic("zero has no inverse")
+	}
+	// a^254 = a^-1 since the multiplicative group has order 255
+	result := byte(1)
+	for i := 0; i < 254; i++ {
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+type ShamirShare struct {
+	X byte
+	Y []byte
+}
+
+// split secret into count shares, any threshold of which can recover it
+func ShamirSplit(secret []byte, threshold int, count int) []ShamirShare {
+	if threshold < 1 || threshold > count || count > 255 {
+		panic("need 1 <= threshold <= count <= 255")
+	}
+	shares := make([]ShamirShare, count)
+	for i := range shares {
+		shares[i] = ShamirShare{X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+	coefficients := make([]byte, threshold)
+	for idx, b := range secret {
+		coefficients[0] = b
+		copy(coefficients[1:], RandBytes(threshold-1))
+		for i := range shares {
+			// horner's method
+			var y byte
+			for j := threshold - 1; j >= 0; j-- {
+				y = gfMul(y, shares[i].X) ^ coefficients[j]
+			}
+			shares[i].Y[idx] = y
+		}
+	}
+	return shares
+}
+
+// lagrange interpolation at x=0. with fewer than threshold shares this returns garbage, not an error, that's the whole point
+func ShamirCombine(shares []ShamirShare) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if share.X == 0 || seen[share.X] {
+			return nil, errors.New("shares must have distinct nonzero x")
+		}
+		if len(share.Y) != len(shares[0].Y) {
+			return nil, errors.New("shares are of different lengths")
+		}
+		seen[share.X] = true
+	}
+	secret := make([]byte, len(shares[0].Y))
+	for i, share := range shares {
+		// basis polynomial evaluated at 0: product of x_j / (x_j - x_i), and subtraction is xor
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfMul(other.X, gfInverse(other.X^share.X)))
+			}
+		}
+		for idx := range secret {
+			secret[idx] ^= gfMul(basis, share.Y[idx])
+		}
+	}
+	return secret, nil
+}
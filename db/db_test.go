@@ -61,6 +61,37 @@ func TestInitialSetup(t *testing.T) {
 		if !areForeignKeysEnforced(t) {
 			t.Errorf("schema three should stay with foreign keys enforced")
 		}
+		err = schemaVersionFour()
+		if err != nil {
+			t.Error(err)
+		}
+		if determineDatabaseLayer() != DATABASE_LAYER_4 {
+			t.Errorf("schema version four should work")
+		}
+		if !areForeignKeysEnforced(t) {
+			t.Errorf("schema four should stay with foreign keys enforced")
+		}
+		err = schemaVersionFive()
+		if err != nil {
+			t.Error(err)
+		}
+		if determineDatabaseLayer() != DATABASE_LAYER_5 {
+			t.Errorf("schema version five should work")
+		}
+		err = schemaVersionSix()
+		if err != nil {
+			t.Error(err)
+		}
+		if determineDatabaseLayer() != DATABASE_LAYER_6 {
+			t.Errorf("schema version six should work")
+		}
+		err = schemaVersionSeven()
+		if err != nil {
+			t.Error(err)
+		}
+		if determineDatabaseLayer() != DATABASE_LAYER_7 {
+			t.Errorf("schema version seven should work")
+		}
 	})
 }
 
@@ -118,6 +149,79 @@ func TestLayerThreeDoesntWorkTwice(t *testing.T) {
 	})
 }
 
+func TestLayerFourDoesntWorkTwice(t *testing.T) {
+	WithTestingDatabase(t, false, func() {
+		Must(schemaVersionOne())
+		Must(schemaVersionTwo())
+		Must(schemaVersionThree())
+		err := schemaVersionFour()
+		if err != nil {
+			t.Error(err)
+		}
+		err = schemaVersionFour()
+		if err == nil || err.Error() != "duplicate column name: sealed_key" {
+			t.Errorf("shouldn't work twice, got: %v", err)
+		}
+		if !areForeignKeysEnforced(t) {
+			t.Errorf("foreign keys should be re-enabled")
+		}
+	})
+}
+
+func TestLayerFiveDoesntWorkTwice(t *testing.T) {
+	WithTestingDatabase(t, false, func() {
+		Must(schemaVersionOne())
+		Must(schemaVersionTwo())
+		Must(schemaVersionThree())
+		Must(schemaVersionFour())
+		err := schemaVersionFive()
+		if err != nil {
+			t.Error(err)
+		}
+		err = schemaVersionFive()
+		if err == nil || err.Error() != "duplicate column name: encryption_alg" {
+			t.Errorf("shouldn't work twice, got: %v", err)
+		}
+	})
+}
+
+func TestLayerSixDoesntWorkTwice(t *testing.T) {
+	WithTestingDatabase(t, false, func() {
+		Must(schemaVersionOne())
+		Must(schemaVersionTwo())
+		Must(schemaVersionThree())
+		Must(schemaVersionFour())
+		Must(schemaVersionFive())
+		err := schemaVersionSix()
+		if err != nil {
+			t.Error(err)
+		}
+		err = schemaVersionSix()
+		if err == nil || err.Error() != "table zstd_dictionaries already exists" {
+			t.Errorf("shouldn't work twice, got: %v", err)
+		}
+	})
+}
+
+func TestLayerSevenDoesntWorkTwice(t *testing.T) {
+	WithTestingDatabase(t, false, func() {
+		Must(schemaVersionOne())
+		Must(schemaVersionTwo())
+		Must(schemaVersionThree())
+		Must(schemaVersionFour())
+		Must(schemaVersionFive())
+		Must(schemaVersionSix())
+		err := schemaVersionSeven()
+		if err != nil {
+			t.Error(err)
+		}
+		err = schemaVersionSeven()
+		if err == nil || err.Error() != "duplicate column name: sampled" {
+			t.Errorf("shouldn't work twice, got: %v", err)
+		}
+	})
+}
+
 func TestConstraints(t *testing.T) {
 	WithTestingDatabase(t, true, func() {
 		_, err := DB.Exec("INSERT INTO sizes (hash, size) VALUES (?, ?)", make([]byte, 5), 0)
@@ -249,6 +353,45 @@ func TestLayerTwoMigration(t *testing.T) {
 	})
 }
 
+func TestLayerFourMigration(t *testing.T) {
+	WithTestingDatabase(t, false, func() {
+		Must(schemaVersionOne())
+		Must(schemaVersionTwo())
+		Must(schemaVersionThree())
+		Must(insertTestSize())
+		_, err := DB.Exec("INSERT INTO blobs(blob_id, padding_key, size, final_hash) VALUES (?, ?, 1337, ?)", testingHash("blob"), testingHash("padding")[:16], testingHash("post"))
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = DB.Exec("INSERT INTO blob_entries(blob_id, hash, encryption_key, final_size, offset, compression_alg) VALUES (?, ?, ?, 5021, 0, '')", testingHash("blob"), testingHash("file"), testingHash("key")[:16])
+		if err != nil {
+			t.Error(err)
+		}
+		Must(schemaVersionFour())
+		var key []byte
+		var sealed []byte
+		err = DB.QueryRow("SELECT encryption_key, sealed_key FROM blob_entries WHERE blob_id = ? AND hash = ?", testingHash("blob"), testingHash("file")).Scan(&key, &sealed)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(key, testingHash("key")[:16]) || sealed != nil {
+			t.Errorf("wrong")
+		}
+		_, err = DB.Exec("UPDATE blob_entries SET encryption_key = NULL")
+		if err == nil {
+			t.Errorf("an entry with neither an encryption key nor a sealed key should not be allowed")
+		}
+		_, err = DB.Exec("UPDATE blob_entries SET sealed_key = ?", make([]byte, 64))
+		if err == nil {
+			t.Errorf("an entry with both an encryption key and a sealed key should not be allowed")
+		}
+		_, err = DB.Exec("UPDATE blob_entries SET sealed_key = ?, encryption_key = NULL", make([]byte, 64))
+		if err != nil {
+			t.Errorf("an entry with only a sealed key should be allowed: %v", err)
+		}
+	})
+}
+
 func TestStartsWithPattern(t *testing.T) {
 	WithTestingDatabase(t, false, func() {
 		pattern := "abc"
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// incremental database backups are a list of the pages of the sqlite file that changed since the previous backup in the chain
+// the session extension isn't available through go-sqlite3, and a rowid delta of files / blob_entries would miss every "UPDATE files SET end = ?"
+// so, this works one level lower, on the raw pages of the closed database file, which catches everything (inserts, updates, deletes, vacuums, schema changes)
+
+var deltaMagic = []byte("GBDBINC1")
+
+type DeltaHeader struct {
+	Full     int64    // timestamp of the full backup at the start of this chain
+	Previous int64    // timestamp of the backup (full or incremental) that this delta applies on top of
+	Current  int64    // timestamp of this backup
+	PageSize int64    // sqlite page size
+	Size     int64    // size of the database file after applying this delta
+	Hash     [32]byte // sha256 of the entire database file after applying this delta
+}
+
+// read the page size out of the 100 byte header at the beginning of every sqlite database file
+func PageSize(header []byte) (int64, error) {
+	if len(header) < 100 || !bytes.Equal(header[:16], []byte("SQLite format 3\x00")) {
+		return 0, errors.New("not an sqlite database")
+	}
+	size := int64(binary.BigEndian.Uint16(header[16:18]))
+	if size == 1 {
+		size = 65536 // yes this is how sqlite does it
+	}
+	if size < 512 || size&(size-1) != 0 {
+		return 0, errors.New("invalid sqlite page size")
+	}
+	return size, nil
+}
+
+// sha256 of each page, concatenated, along with the sha256 and size of the entire file
+func HashPages(in io.Reader, pageSize int64) ([]byte, [32]byte, int64) {
+	hashes := make([]byte, 0)
+	whole := sha256.New()
+	page := make([]byte, pageSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(in, page)
+		if n > 0 {
+			h := sha256.Sum256(page[:n])
+			hashes = append(hashes, h[:]...)
+			whole.Write(page[:n])
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	var fileHash [32]byte
+	copy(fileHash[:], whole.Sum(nil))
+	return hashes, fileHash, size
+}
+
+// indexes of the pages whose hashes differ (or are new) between two outputs of HashPages
+func ChangedPages(prevHashes []byte, currHashes []byte) []int64 {
+	changed := make([]int64, 0)
+	for i := int64(0); i*32 < int64(len(currHashes)); i++ {
+		if (i+1)*32 > int64(len(prevHashes)) || !bytes.Equal(prevHashes[i*32:(i+1)*32], currHashes[i*32:(i+1)*32]) {
+			changed = append(changed, i)
+		}
+	}
+	return changed
+}
+
+func WriteDelta(out io.Writer, header DeltaHeader, file io.ReaderAt, changed []int64) {
+	write := func(data any) {
+		if err := binary.Write(out, binary.BigEndian, data); err != nil {
+			panic(err)
+		}
+	}
+	write(deltaMagic)
+	write(header.Full)
+	write(header.Previous)
+	write(header.Current)
+	write(header.PageSize)
+	write(header.Size)
+	write(header.Hash)
+	page := make([]byte, header.PageSize)
+	for _, idx := range changed {
+		length := header.PageSize
+		if remain := header.Size - idx*header.PageSize; remain < length {
+			length = remain // there is no reason for an sqlite file to not be a multiple of the page size, but, just in case
+		}
+		if _, err := file.ReadAt(page[:length], idx*header.PageSize); err != nil {
+			panic(err)
+		}
+		write(idx)
+		write(page[:length])
+	}
+}
+
+func ReadDeltaHeader(delta []byte) DeltaHeader {
+	r := bytes.NewReader(delta)
+	magic := make([]byte, len(deltaMagic))
+	var header DeltaHeader
+	for _, field := range []any{magic, &header.Full, &header.Previous, &header.Current, &header.PageSize, &header.Size, &header.Hash} {
+		if err := binary.Read(r, binary.BigEndian, field); err != nil {
+			panic("incremental database backup is truncated")
+		}
+	}
+	if !bytes.Equal(magic, deltaMagic) {
+		panic("this is not an incremental database backup")
+	}
+	return header
+}
+
+// apply the changed pages on top of the previous database file, and verify that we end up with exactly what was backed up
+func ApplyDelta(base []byte, delta []byte) []byte {
+	header := ReadDeltaHeader(delta)
+	records := delta[len(deltaMagic)+8*5+32:]
+	result := make([]byte, header.Size)
+	copy(result, base) // this also takes care of truncation, if the database shrank (e.g. VACUUM)
+	for len(records) > 0 {
+		if len(records) < 8 {
+			panic("incremental database backup is truncated")
+		}
+		idx := int64(binary.BigEndian.Uint64(records[:8]))
+		records = records[8:]
+		start := idx * header.PageSize
+		length := header.PageSize
+		if remain := header.Size - start; remain < length {
+			length = remain
+		}
+		if length <= 0 || int64(len(records)) < length {
+			panic("incremental database backup has a page out of range")
+		}
+		copy(result[start:start+length], records[:length])
+		records = records[length:]
+	}
+	if sha256.Sum256(result) != header.Hash {
+		panic("applying the incremental database backup did not result in the expected database. the chain is broken or out of order")
+	}
+	return result
+}
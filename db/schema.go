@@ -7,6 +7,10 @@ const (
 	DATABASE_LAYER_1     // original schema, as of 2019
 	DATABASE_LAYER_2     // hash_pre_enc removed, hash_post_enc renamed to final_hash, encryption_key renamed to padding_key, encryption_key added to blob_entries
 	DATABASE_LAYER_3     // blob_entries_by_blob_id index replaced with unique blob_entries_by_blob_id_and_hash, unique index on blob_storage(blob_id, storage_id), shares table added
+	DATABASE_LAYER_4     // blob_entries.encryption_key made nullable, blob_entries.sealed_key added (public key "write-only" mode)
+	DATABASE_LAYER_5     // blob_entries.encryption_alg added (chunked AES-GCM)
+	DATABASE_LAYER_6     // zstd_dictionaries table added
+	DATABASE_LAYER_7     // blob_entries.sampled added (what compression_sampling decided)
 )
 
 func initialSetup() {
@@ -21,6 +25,18 @@ func initialSetup() {
 		Must(schemaVersionThree())
 		fallthrough
 	case DATABASE_LAYER_3:
+		Must(schemaVersionFour())
+		fallthrough
+	case DATABASE_LAYER_4:
+		Must(schemaVersionFive())
+		fallthrough
+	case DATABASE_LAYER_5:
+		Must(schemaVersionSix())
+		fallthrough
+	case DATABASE_LAYER_6:
+		Must(schemaVersionSeven())
+		fallthrough
+	case DATABASE_LAYER_7:
 		// up to date
 	}
 }
@@ -293,6 +309,112 @@ func schemaVersionThree() error {
 	return nil
 }
 
+func schemaVersionFour() error {
+	_, err := DB.Exec("PRAGMA foreign_keys = OFF")
+	Must(err)
+	defer func() {
+		// even if this fails (this has to be after the rollback, since this pragma is a no-op inside a transaction)
+		_, err := DB.Exec("PRAGMA foreign_keys = ON")
+		Must(err)
+	}()
+	tx, err := DB.Begin()
+	Must(err)
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+	ALTER TABLE blob_entries ADD COLUMN sealed_key BLOB; /* just so this fails if it's already been done, the constraints need the table to be rebuilt anyway */
+
+	CREATE TABLE blob_entries_temp (
+
+		hash            BLOB    NOT NULL, /* hash of what this is storing */
+		blob_id         BLOB    NOT NULL, /* blob this is in */
+		encryption_key  BLOB,             /* random bytes. old blobs will have the same key for each entry (compatibility); new blobs will have different keys for each entry. NULL if sealed_key is used instead */
+		sealed_key      BLOB,             /* the encryption key, sealed to the configured public key, so that only the private key can decrypt it. NULL if encryption_key is used instead */
+		final_size      INTEGER NOT NULL, /* the length of this entry in bytes, i.e. size after compression, if any, has taken place */
+		offset          INTEGER NOT NULL, /* where in the blob does this start. also, for compatibility reasons, where in the AES CTR stream does this entry's encryption begin */
+		compression_alg TEXT    NOT NULL, /* what kind of compression was done (empty string if not compressed) */
+
+		CHECK(final_size >= 0),
+		CHECK(offset >= 0),
+		CHECK(encryption_key IS NULL OR LENGTH(encryption_key) == 16),
+		CHECK(sealed_key IS NULL OR LENGTH(sealed_key) == 64),
+		CHECK((encryption_key IS NULL) != (sealed_key IS NULL)), /* exactly one */
+
+		FOREIGN KEY(hash)    REFERENCES sizes(hash)    ON UPDATE RESTRICT ON DELETE RESTRICT,
+		FOREIGN KEY(blob_id) REFERENCES blobs(blob_id) ON UPDATE CASCADE  ON DELETE CASCADE
+	);
+
+	INSERT INTO blob_entries_temp(hash, blob_id, encryption_key, sealed_key, final_size, offset, compression_alg) SELECT hash, blob_id, encryption_key, sealed_key, final_size, offset, compression_alg FROM blob_entries;
+
+	DROP INDEX blob_entries_by_blob_id_and_hash;
+	DROP INDEX blob_entries_by_hash;
+	DROP TABLE blob_entries;
+
+	ALTER TABLE blob_entries_temp RENAME TO blob_entries;
+
+	CREATE UNIQUE INDEX blob_entries_by_blob_id_and_hash ON blob_entries(blob_id, hash);
+	CREATE INDEX blob_entries_by_hash ON blob_entries(hash);
+	`)
+	if err != nil {
+		return err
+	}
+	Must(tx.Commit())
+	return nil
+}
+
+func schemaVersionFive() error {
+	tx, err := DB.Begin()
+	Must(err)
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+	ALTER TABLE blob_entries ADD COLUMN encryption_alg TEXT NOT NULL DEFAULT ''; /* how this entry was encrypted (empty string is AES-CTR, the original format) */
+	`)
+	if err != nil {
+		return err
+	}
+	Must(tx.Commit())
+	return nil
+}
+
+func schemaVersionSix() error {
+	tx, err := DB.Begin()
+	Must(err)
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+	CREATE TABLE zstd_dictionaries (
+
+		dict_id   INTEGER NOT NULL PRIMARY KEY, /* blob entries compressed with this dictionary have compression_alg "zstd-dict-<dict_id>" */
+		extension TEXT    NOT NULL, /* it was trained on (and is used for) small files with this extension, or any small file if empty string */
+		content   BLOB    NOT NULL, /* the dictionary itself. there is also a copy in each storage, encrypted with the database key */
+		hash      BLOB    NOT NULL, /* sha256 of content */
+		created   INTEGER NOT NULL, /* when it was trained (unix seconds) */
+
+		UNIQUE(hash),
+		CHECK(LENGTH(content) > 0),
+		CHECK(LENGTH(hash) == 32),
+		CHECK(created > 0)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	Must(tx.Commit())
+	return nil
+}
+
+func schemaVersionSeven() error {
+	tx, err := DB.Begin()
+	Must(err)
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+	ALTER TABLE blob_entries ADD COLUMN sampled TEXT NOT NULL DEFAULT ''; /* what compression_sampling did: "compressed" despite no_compression_exts, "skipped" compressing, or empty string if it wasn't sampled or sampling agreed */
+	`)
+	if err != nil {
+		return err
+	}
+	Must(tx.Commit())
+	return nil
+}
+
 func query(query string) string {
 	rows, err := DB.Query(query)
 	Must(err)
@@ -316,16 +438,23 @@ func determineDatabaseLayer() DatabaseLayer {
 	// determine layer by tables
 	expectedTablesLayer2 := "blob_entries,blob_storage,blobs,db_key,files,sizes,storage,"
 	expectedTablesLayer3 := "blob_entries,blob_storage,blobs,db_key,files,share_entries,shares,sizes,storage,"
-	isLayer3Tables := tables == expectedTablesLayer3
+	expectedTablesLayer6 := "blob_entries,blob_storage,blobs,db_key,files,share_entries,shares,sizes,storage,zstd_dictionaries,"
+	isLayer6Tables := tables == expectedTablesLayer6
+	isLayer3Tables := tables == expectedTablesLayer3 || isLayer6Tables
 	if tables != expectedTablesLayer2 && !isLayer3Tables {
-		panic("gb.db doesn't have the tables that I expect. expected '" + expectedTablesLayer2 + "' or '" + expectedTablesLayer3 + "' but got '" + tables + "'")
+		panic("gb.db doesn't have the tables that I expect. expected '" + expectedTablesLayer2 + "' or '" + expectedTablesLayer3 + "' or '" + expectedTablesLayer6 + "' but got '" + tables + "'")
 	}
 
 	// check indexes match the layer determined by tables
 	indexes := query("SELECT name FROM sqlite_master WHERE type = 'index' ORDER BY name")
 	expectedIndexesLayer2 := "blob_entries_by_blob_id,blob_entries_by_hash,blob_storage_by_blob_id,files_by_hash,files_by_path,files_by_path_and_end,files_by_path_curr,sizes_by_size,sqlite_autoindex_blob_storage_1,sqlite_autoindex_blobs_1,sqlite_autoindex_blobs_2,sqlite_autoindex_files_1,sqlite_autoindex_sizes_1,sqlite_autoindex_storage_1,sqlite_autoindex_storage_2,sqlite_autoindex_storage_3,"
 	expectedIndexesLayer3 := "blob_entries_by_blob_id_and_hash,blob_entries_by_hash,blob_storage_by_blob_id_and_storage_id,files_by_hash,files_by_path,files_by_path_and_end,files_by_path_curr,share_entries_by_hash,shares_by_shared_at,sizes_by_size,sqlite_autoindex_blob_storage_1,sqlite_autoindex_blobs_1,sqlite_autoindex_blobs_2,sqlite_autoindex_files_1,sqlite_autoindex_share_entries_1,sqlite_autoindex_share_entries_2,sqlite_autoindex_shares_1,sqlite_autoindex_shares_2,sqlite_autoindex_sizes_1,sqlite_autoindex_storage_1,sqlite_autoindex_storage_2,sqlite_autoindex_storage_3,"
-	if isLayer3Tables {
+	expectedIndexesLayer6 := expectedIndexesLayer3 + "sqlite_autoindex_zstd_dictionaries_1,"
+	if isLayer6Tables {
+		if indexes != expectedIndexesLayer6 {
+			panic("gb.db has layer 6 tables but indexes don't match. expected '" + expectedIndexesLayer6 + "' but got '" + indexes + "'")
+		}
+	} else if isLayer3Tables {
 		if indexes != expectedIndexesLayer3 {
 			panic("gb.db has layer 3 tables but indexes don't match. expected '" + expectedIndexesLayer3 + "' but got '" + indexes + "'")
 		}
@@ -344,8 +473,27 @@ func determineDatabaseLayer() DatabaseLayer {
 	if blob_cols != expectedBlobCols {
 		panic("the 'blobs' table doesn't have the columns that I expect. expected '" + expectedBlobCols + "' but got '" + blob_cols + "'")
 	}
-	if isLayer3Tables {
+	if !isLayer3Tables {
+		return DATABASE_LAYER_2
+	}
+
+	// distinguish layer 3 from layer 4 by blob_entries columns
+	blobEntryCols := query("SELECT name FROM PRAGMA_TABLE_INFO('blob_entries')")
+	if blobEntryCols == "hash,blob_id,encryption_key,final_size,offset,compression_alg," {
 		return DATABASE_LAYER_3
 	}
-	return DATABASE_LAYER_2
+	if blobEntryCols == "hash,blob_id,encryption_key,sealed_key,final_size,offset,compression_alg," {
+		return DATABASE_LAYER_4
+	}
+	if blobEntryCols == "hash,blob_id,encryption_key,sealed_key,final_size,offset,compression_alg,encryption_alg," {
+		if !isLayer6Tables {
+			return DATABASE_LAYER_5
+		}
+		return DATABASE_LAYER_6
+	}
+	expectedBlobEntryCols := "hash,blob_id,encryption_key,sealed_key,final_size,offset,compression_alg,encryption_alg,sampled,"
+	if blobEntryCols != expectedBlobEntryCols || !isLayer6Tables {
+		panic("the 'blob_entries' table doesn't have the columns that I expect. expected '" + expectedBlobEntryCols + "' but got '" + blobEntryCols + "'")
+	}
+	return DATABASE_LAYER_7
 }
@@ -68,14 +68,19 @@ CREATE TABLE blob_entries (
 
 	hash            BLOB    NOT NULL, /* hash of what this is storing */
 	blob_id         BLOB    NOT NULL, /* blob this is in */
-	encryption_key  BLOB    NOT NULL, /* random bytes. old blobs will have the same key for each entry (compatibility); new blobs will have different keys for each entry */
-	final_size      INTEGER NOT NULL, /* the length of this entry in bytes, i.e. size after compression, if any, has taken place */
+	encryption_key  BLOB,             /* random bytes. old blobs will have the same key for each entry (compatibility); new blobs will have different keys for each entry. NULL if sealed_key is used instead */
+	sealed_key      BLOB,             /* the encryption key, sealed to the configured public key, so that only the private key can decrypt it. NULL if encryption_key is used instead */
+	final_size      INTEGER NOT NULL, /* the length of this entry in bytes, i.e. size after compression, if any, has taken place (and after encryption, for aes-gcm-chunked, which adds a tag per chunk) */
 	offset          INTEGER NOT NULL, /* where in the blob does this start. also, for compatibility reasons, where in the AES CTR stream does this entry's encryption begin */
 	compression_alg TEXT    NOT NULL, /* what kind of compression was done (empty string if not compressed) */
+	encryption_alg  TEXT    NOT NULL DEFAULT '', /* how this entry was encrypted (empty string is AES-CTR, the original format, otherwise aes-gcm-chunked) */
+	sampled         TEXT    NOT NULL DEFAULT '', /* what compression_sampling did: "compressed" despite no_compression_exts, "skipped" compressing, or empty string if it wasn't sampled or sampling agreed */
 
 	CHECK(final_size >= 0),
 	CHECK(offset >= 0),
-	CHECK(LENGTH(encryption_key) == 16),
+	CHECK(encryption_key IS NULL OR LENGTH(encryption_key) == 16),
+	CHECK(sealed_key IS NULL OR LENGTH(sealed_key) == 64),
+	CHECK((encryption_key IS NULL) != (sealed_key IS NULL)), /* exactly one */
 
 	FOREIGN KEY(hash)    REFERENCES sizes(hash)    ON UPDATE RESTRICT ON DELETE RESTRICT,
 	FOREIGN KEY(blob_id) REFERENCES blobs(blob_id) ON UPDATE CASCADE  ON DELETE CASCADE
@@ -167,3 +172,17 @@ CREATE TABLE share_entries (
 	FOREIGN KEY(blob_id, storage_id)  REFERENCES blob_storage(blob_id, storage_id) ON UPDATE CASCADE  ON DELETE RESTRICT
 );
 CREATE INDEX share_entries_by_hash ON share_entries(hash);
+
+CREATE TABLE zstd_dictionaries (
+
+	dict_id   INTEGER NOT NULL PRIMARY KEY, /* blob entries compressed with this dictionary have compression_alg "zstd-dict-<dict_id>" */
+	extension TEXT    NOT NULL, /* it was trained on (and is used for) small files with this extension, or any small file if empty string */
+	content   BLOB    NOT NULL, /* the dictionary itself. there is also a copy in each storage, encrypted with the database key */
+	hash      BLOB    NOT NULL, /* sha256 of content */
+	created   INTEGER NOT NULL, /* when it was trained (unix seconds) */
+
+	UNIQUE(hash),
+	CHECK(LENGTH(content) > 0),
+	CHECK(LENGTH(hash) == 32),
+	CHECK(created > 0)
+);
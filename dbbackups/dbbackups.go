@@ -0,0 +1,261 @@
+package dbbackups
+
+import (
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leijurv/gb/crypto"
+	"github.com/leijurv/gb/storage_base"
+	"github.com/leijurv/gb/utils"
+)
+
+// every BackupDB writes a new db-v2backup-<timestamp> (or db-v2backup-<full>-incremental-<timestamp>) to every storage
+// this is for looking at them, and getting rid of old ones
+
+type DBBackup struct {
+	storage_base.ListedFile
+	Filename  string
+	Full      int64 // timestamp of the full backup. for a full backup, this is the same as Timestamp
+	Timestamp int64
+	Legacy    bool
+}
+
+func (b DBBackup) Incremental() bool {
+	return b.Full != b.Timestamp
+}
+
+func (b DBBackup) Time() time.Time {
+	return time.Unix(b.Timestamp, 0)
+}
+
+func ParseFilename(filename string) (DBBackup, bool) {
+	var rest string
+	var legacy bool
+	if strings.HasPrefix(filename, "db-backup-") {
+		rest = strings.TrimPrefix(filename, "db-backup-")
+		legacy = true
+	} else if strings.HasPrefix(filename, "db-v2backup-") {
+		rest = strings.TrimPrefix(filename, "db-v2backup-")
+	} else {
+		return DBBackup{}, false
+	}
+	parts := strings.Split(rest, "-incremental-")
+	if len(parts) > 2 || (legacy && len(parts) != 1) {
+		return DBBackup{}, false
+	}
+	full, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return DBBackup{}, false
+	}
+	timestamp := full
+	if len(parts) == 2 {
+		timestamp, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || timestamp <= full {
+			return DBBackup{}, false
+		}
+	}
+	return DBBackup{Filename: filename, Full: full, Timestamp: timestamp, Legacy: legacy}, true
+}
+
+// all database backups in this storage, oldest first
+func List(stor storage_base.Storage) []DBBackup {
+	backups := make([]DBBackup, 0)
+	for _, file := range stor.ListPrefix("db-") {
+		backup, ok := ParseFilename("db-" + file.Name)
+		if !ok {
+			continue
+		}
+		backup.ListedFile = file
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].Timestamp != backups[j].Timestamp {
+			return backups[i].Timestamp < backups[j].Timestamp
+		}
+		return backups[i].Filename < backups[j].Filename
+	})
+	return backups
+}
+
+func PrintList(stor storage_base.Storage) {
+	backups := List(stor)
+	log.Println(len(backups), "database backups in", stor)
+	var total int64
+	for _, backup := range backups {
+		kind := "full"
+		if backup.Legacy {
+			kind = "full (legacy encryption)"
+		}
+		if backup.Incremental() {
+			kind = "incremental on top of " + strconv.FormatInt(backup.Full, 10)
+		}
+		log.Println(backup.Time().Format(time.RFC3339), utils.FormatCommas(backup.Size), "bytes", backup.Filename, kind)
+		total += backup.Size
+	}
+	log.Println("Total:", utils.FormatCommas(total), "bytes")
+}
+
+// download this backup and check its MAC (or GCM tag, for legacy ones)
+func Verify(stor storage_base.Storage, backup DBBackup, key []byte) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Database backup", backup.Filename, "in", stor, "failed verification:", r)
+			ok = false
+		}
+	}()
+	reader := stor.DownloadSection(backup.Path, 0, backup.Size)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		panic(err)
+	}
+	if int64(len(data)) != backup.Size {
+		panic("size mismatch")
+	}
+	if backup.Legacy {
+		crypto.LegacyDecryptDatabase(data, key)
+	} else {
+		crypto.DecryptDatabaseV2(data, key)
+	}
+	return true
+}
+
+// how many restore points to keep. a restore point is kept if it's one of the newest Keep, or the newest one of one of the newest Daily days (etc)
+type RetentionPolicy struct {
+	Keep    int
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+func (p RetentionPolicy) Empty() bool {
+	return p.Keep == 0 && p.Daily == 0 && p.Weekly == 0 && p.Monthly == 0
+}
+
+// which backups the policy keeps. backups must be sorted oldest first, as returned by List
+func (p RetentionPolicy) Select(backups []DBBackup) map[string]bool {
+	keep := make(map[string]bool)
+	bucketed := func(count int, bucket func(DBBackup) string) {
+		seen := make(map[string]bool)
+		for i := len(backups) - 1; i >= 0 && len(seen) < count; i-- {
+			b := bucket(backups[i])
+			if !seen[b] {
+				seen[b] = true
+				keep[backups[i].Filename] = true
+			}
+		}
+	}
+	bucketed(p.Keep, func(b DBBackup) string { return b.Filename })
+	bucketed(p.Daily, func(b DBBackup) string { return b.Time().Format("2006-01-02") })
+	bucketed(p.Weekly, func(b DBBackup) string {
+		year, week := b.Time().ISOWeek()
+		return strconv.Itoa(year) + "-" + strconv.Itoa(week)
+	})
+	bucketed(p.Monthly, func(b DBBackup) string { return b.Time().Format("2006-01") })
+	return keep
+}
+
+// an incremental is useless without its full backup and every incremental before it in the chain
+func Chain(backups []DBBackup, backup DBBackup) []DBBackup {
+	ret := make([]DBBackup, 0)
+	for _, b := range backups {
+		if !b.Legacy && !backup.Legacy && b.Full == backup.Full && b.Timestamp <= backup.Timestamp {
+			ret = append(ret, b)
+		}
+	}
+	if len(ret) == 0 {
+		ret = append(ret, backup) // legacy
+	}
+	if ret[0].Incremental() {
+		log.Println("The full backup that", backup.Filename, "is based on is missing")
+	}
+	return ret
+}
+
+// delete the database backups that the policy doesn't keep
+// the newest backup that actually decrypts (along with the rest of its chain, if it's an incremental) is always kept no matter what, and if there isn't one, nothing is deleted
+func Prune(stor storage_base.Storage, key []byte, policy RetentionPolicy, dryRun bool) {
+	if policy.Empty() {
+		panic("refusing to prune without any retention policy, that would delete everything except the newest backup")
+	}
+	backups := List(stor)
+	keep := policy.Select(backups)
+
+	newestVerified := false
+	for i := len(backups) - 1; i >= 0 && !newestVerified; i-- {
+		c := Chain(backups, backups[i])
+		if c[0].Incremental() {
+			continue
+		}
+		newestVerified = true
+		for _, b := range c {
+			if !Verify(stor, b, key) {
+				newestVerified = false
+				break
+			}
+		}
+		if newestVerified {
+			log.Println("Newest verified database backup in", stor, "is", backups[i].Filename)
+			keep[backups[i].Filename] = true
+		}
+	}
+	if !newestVerified {
+		panic("could not verify a single database backup in " + stor.String() + ", so not deleting anything")
+	}
+
+	for _, backup := range backups {
+		if keep[backup.Filename] {
+			for _, b := range Chain(backups, backup) {
+				keep[b.Filename] = true
+			}
+		}
+	}
+
+	var freed int64
+	for _, backup := range backups {
+		if keep[backup.Filename] {
+			log.Println("Keeping", backup.Filename)
+			continue
+		}
+		freed += backup.Size
+		if dryRun {
+			log.Println("Would delete", backup.Filename)
+			continue
+		}
+		log.Println("Deleting", backup.Filename)
+		stor.DeleteBlob(backup.Path)
+	}
+	if dryRun {
+		log.Println("Dry run, would have freed", utils.FormatCommas(freed), "bytes")
+	} else {
+		log.Println("Freed", utils.FormatCommas(freed), "bytes")
+	}
+}
+
+// delete every database backup from before timestamp, but only once the newest one from at or after timestamp is verified with key
+// (e.g. after rotating the database key, everything from before the rotation is readable with the old key)
+func DeleteBefore(stor storage_base.Storage, timestamp int64, key []byte) {
+	backups := List(stor)
+	if len(backups) == 0 || backups[len(backups)-1].Timestamp < timestamp {
+		panic("there is no database backup in " + stor.String() + " from after " + strconv.FormatInt(timestamp, 10) + ", so not deleting anything")
+	}
+	newest := backups[len(backups)-1]
+	for _, b := range Chain(backups, newest) {
+		if b.Timestamp < timestamp || !Verify(stor, b, key) {
+			panic("could not verify " + b.Filename + " in " + stor.String() + ", so not deleting anything")
+		}
+	}
+	var freed int64
+	for _, backup := range backups {
+		if backup.Timestamp < timestamp {
+			log.Println("Deleting", backup.Filename)
+			stor.DeleteBlob(backup.Path)
+			freed += backup.Size
+		}
+	}
+	log.Println("Freed", utils.FormatCommas(freed), "bytes")
+}
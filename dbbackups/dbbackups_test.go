@@ -0,0 +1,115 @@
+package dbbackups
+
+import (
+	"crypto/sha256"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/leijurv/gb/crypto"
+	"github.com/leijurv/gb/storage_base"
+)
+
+func uploadFakeBackup(t *testing.T, stor *storage_base.MockStorage, filename string, key []byte) {
+	upload := stor.BeginDatabaseUpload(filename)
+	out := crypto.EncryptDatabaseV2(upload.Writer(), key)
+	payload := []byte("not actually a database " + filename)
+	if _, err := out.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(payload)
+	if _, err := out.Write(crypto.ComputeMAC(hash[:], key)); err != nil {
+		t.Fatal(err)
+	}
+	upload.End()
+}
+
+func remaining(stor *storage_base.MockStorage) []string {
+	names := make([]string, 0)
+	for _, backup := range List(stor) {
+		names = append(names, backup.Filename)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestParseFilename(t *testing.T) {
+	for name, expected := range map[string]DBBackup{
+		"db-backup-100":                   {Filename: "db-backup-100", Full: 100, Timestamp: 100, Legacy: true},
+		"db-v2backup-100":                 {Filename: "db-v2backup-100", Full: 100, Timestamp: 100},
+		"db-v2backup-100-incremental-200": {Filename: "db-v2backup-100-incremental-200", Full: 100, Timestamp: 200},
+	} {
+		backup, ok := ParseFilename(name)
+		if !ok || backup != expected {
+			t.Errorf("%s: got %+v %v", name, backup, ok)
+		}
+	}
+	for _, name := range []string{"db-v2backup-", "db-v2backup-abc", "db-backup-100-incremental-200", "db-v2backup-200-incremental-100", "0a/1b/0a1b"} {
+		if _, ok := ParseFilename(name); ok {
+			t.Errorf("%s should not parse", name)
+		}
+	}
+}
+
+func TestRetentionPolicySelect(t *testing.T) {
+	day := int64(24 * 60 * 60)
+	base := time.Date(2024, 6, 10, 12, 0, 0, 0, time.Local).Unix()
+	backups := make([]DBBackup, 0)
+	for _, ts := range []int64{base - 40*day, base - 2*day, base - day, base - day + 60, base} {
+		backup, _ := ParseFilename("db-v2backup-" + strconv.FormatInt(ts, 10))
+		backups = append(backups, backup)
+	}
+	keep := RetentionPolicy{Daily: 2}.Select(backups)
+	if len(keep) != 2 || !keep[backups[4].Filename] || !keep[backups[3].Filename] {
+		t.Errorf("daily: got %v", keep)
+	}
+	keep = RetentionPolicy{Keep: 1, Monthly: 2}.Select(backups)
+	if len(keep) != 2 || !keep[backups[4].Filename] || !keep[backups[0].Filename] {
+		t.Errorf("monthly: got %v", keep)
+	}
+}
+
+func TestPruneKeepsNewestVerifiedChain(t *testing.T) {
+	key := crypto.RandBytes(16)
+	stor := storage_base.NewMockStorage(crypto.RandBytes(32))
+	uploadFakeBackup(t, stor, "db-v2backup-50", key)
+	uploadFakeBackup(t, stor, "db-v2backup-100", key)
+	uploadFakeBackup(t, stor, "db-v2backup-100-incremental-200", key)
+	uploadFakeBackup(t, stor, "db-v2backup-300", crypto.RandBytes(16)) // MAC won't verify
+
+	Prune(stor, key, RetentionPolicy{Keep: 1}, true)
+	if len(remaining(stor)) != 4 {
+		t.Fatalf("dry run deleted something: %v", remaining(stor))
+	}
+
+	Prune(stor, key, RetentionPolicy{Keep: 1}, false)
+	got := remaining(stor)
+	expected := []string{"db-v2backup-100", "db-v2backup-100-incremental-200", "db-v2backup-300"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestPruneRefusesWithoutVerifiedBackup(t *testing.T) {
+	key := crypto.RandBytes(16)
+	stor := storage_base.NewMockStorage(crypto.RandBytes(32))
+	uploadFakeBackup(t, stor, "db-v2backup-100", crypto.RandBytes(16))
+	uploadFakeBackup(t, stor, "db-v2backup-200", crypto.RandBytes(16))
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic")
+			}
+		}()
+		Prune(stor, key, RetentionPolicy{Keep: 1}, false)
+	}()
+	if len(remaining(stor)) != 2 {
+		t.Errorf("deleted something even though nothing verified: %v", remaining(stor))
+	}
+}
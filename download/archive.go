@@ -0,0 +1,142 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/storage_base"
+	"github.com/leijurv/gb/utils"
+)
+
+// like restore, but instead of writing to disk, everything at src is written into one tar or zip, to output (or stdout if output is "-")
+// nothing on disk is used as a source, everything is fetched from storage
+func RestoreArchive(src string, format string, output string, timestamp int64, filter RestoreFilter, stor storage_base.Storage) {
+	if format != "tar" && format != "zip" {
+		panic("unknown archive format " + format + ", must be tar or zip")
+	}
+	if timestamp == 0 {
+		timestamp = time.Now().Unix()
+	}
+	var err error
+	src, err = filepath.Abs(src)
+	if err != nil {
+		panic(err)
+	}
+	log.Println("src:", src)
+	log.Println("format:", format)
+	log.Println("timestamp:", timestamp)
+
+	items, srcFile := itemsAt(src, timestamp)
+	items = filterItems(items, src, srcFile, filter)
+	if !srcFile && !strings.HasSuffix(src, "/") {
+		src += "/"
+	}
+	entries := make([]Item, 0, len(items))
+	for _, item := range items {
+		if utils.IsDatabaseFile(item.origPath) {
+			continue
+		}
+		// the name in the archive goes where destPath would
+		if srcFile {
+			item.destPath = filepath.Base(src)
+		} else {
+			item.destPath = item.origPath[len(src):]
+		}
+		entries = append(entries, item)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].destPath < entries[j].destPath
+	})
+
+	var out io.Writer
+	if output == "-" {
+		out = os.Stdout
+	} else {
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			panic(err)
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				panic(err)
+			}
+		}()
+		out = f
+	}
+
+	tx, err := db.DB.Begin()
+	db.Must(err)
+	defer tx.Rollback()
+
+	var w archiveWriter
+	switch format {
+	case "tar":
+		w = &tarArchiveWriter{tar.NewWriter(out)}
+	case "zip":
+		w = &zipArchiveWriter{zip.NewWriter(out)}
+	}
+	var sum int64
+	for _, item := range entries {
+		log.Println("Adding", item.origPath, "as", item.destPath)
+		entry := w.create(item)
+		// CatReadCloser verifies the hash once it has read everything
+		r := CatReadCloser(item.hash, tx, stor)
+		utils.Copy(entry, r)
+		r.Close()
+		sum += item.size
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	log.Println("Wrote", len(entries), "files totaling", utils.FormatCommas(sum), "bytes into a", format)
+}
+
+type archiveWriter interface {
+	// the returned writer must be given exactly item.size bytes before the next create or Close
+	create(item Item) io.Writer
+	Close() error
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+}
+
+func (w *tarArchiveWriter) create(item Item) io.Writer {
+	err := w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     item.destPath,
+		Mode:     int64(item.permissions.Perm()),
+		Size:     item.size,
+		ModTime:  time.Unix(item.fsModified, 0),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return w
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (w *zipArchiveWriter) create(item Item) io.Writer {
+	header := &zip.FileHeader{
+		Name:     item.destPath,
+		Method:   zip.Deflate,
+		Modified: time.Unix(item.fsModified, 0),
+	}
+	header.SetMode(item.permissions.Perm())
+	entry, err := w.CreateHeader(header)
+	if err != nil {
+		panic(err)
+	}
+	return entry
+}
@@ -16,8 +16,9 @@ import (
 type BlobEntryInfo struct {
 	BlobID         []byte
 	Offset         int64
-	Length         int64
+	Length         int64 // stored length in the blob (final_size)
 	CompressionAlg string
+	Encryption     string
 	Key            []byte
 	StoragePath    string
 	ExpectedSize   int64 // decompressed size from sizes table
@@ -68,7 +69,9 @@ func LookupBlobEntry(hash []byte, tx *sql.Tx, stor storage_base.Storage) BlobEnt
 	var offset int64
 	var length int64
 	var compressionAlg string
+	var encryption string
 	var key []byte
+	var sealedKey []byte
 	var path string
 	var expectedSize int64
 
@@ -78,7 +81,9 @@ func LookupBlobEntry(hash []byte, tx *sql.Tx, stor storage_base.Storage) BlobEnt
 			blob_entries.offset,
 			blob_entries.final_size,
 			blob_entries.compression_alg,
+			blob_entries.encryption_alg,
 			blob_entries.encryption_key,
+			blob_entries.sealed_key,
 			blob_storage.path,
 			sizes.size
 		FROM blob_entries
@@ -86,7 +91,7 @@ func LookupBlobEntry(hash []byte, tx *sql.Tx, stor storage_base.Storage) BlobEnt
 			INNER JOIN blob_storage ON blob_storage.blob_id = blobs.blob_id
 			INNER JOIN sizes ON sizes.hash = blob_entries.hash
 		WHERE blob_entries.hash = ? AND blob_storage.storage_id = ?`,
-		hash, stor.GetID()).Scan(&blobID, &offset, &length, &compressionAlg, &key, &path, &expectedSize)
+		hash, stor.GetID()).Scan(&blobID, &offset, &length, &compressionAlg, &encryption, &key, &sealedKey, &path, &expectedSize)
 	db.Must(err)
 
 	return BlobEntryInfo{
@@ -94,7 +99,8 @@ func LookupBlobEntry(hash []byte, tx *sql.Tx, stor storage_base.Storage) BlobEnt
 		Offset:         offset,
 		Length:         length,
 		CompressionAlg: compressionAlg,
-		Key:            key,
+		Encryption:     encryption,
+		Key:            EntryKey(key, sealedKey),
 		StoragePath:    path,
 		ExpectedSize:   expectedSize,
 	}
@@ -103,7 +109,12 @@ func LookupBlobEntry(hash []byte, tx *sql.Tx, stor storage_base.Storage) BlobEnt
 func CatReadCloser(hash []byte, tx *sql.Tx, stor storage_base.Storage) io.ReadCloser {
 	info := LookupBlobEntry(hash, tx, stor)
 	reader := utils.ReadCloserToReader(stor.DownloadSection(info.StoragePath, info.Offset, info.Length))
-	decrypted := crypto.DecryptBlobEntry(reader, info.Offset, info.Key)
+	return entryReader(reader, info, hash)
+}
+
+// decrypt, decompress and verify one blob entry, given a reader positioned at its start
+func entryReader(in io.Reader, info BlobEntryInfo, hash []byte) io.ReadCloser {
+	decrypted := crypto.DecryptFullBlobEntry(io.LimitReader(in, info.Length), info.Encryption, info.Key, info.Offset, info.Length)
 	decompressed := compression.ByAlgName(info.CompressionAlg).Decompress(decrypted)
 	return WrapWithHashVerification(decompressed, hash, info.ExpectedSize)
 }
@@ -0,0 +1,134 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/leijurv/gb/config"
+)
+
+// progress of a restore, so that `gb restore --resume` can skip whatever already finished
+// like -backupstate, this lives next to the database. there's one per src and dest, and it's deleted once the restore completes
+// it's a header followed by one line per finished destination, only ever appended to, so if gb dies partway through a line, just that line is ignored
+type restoreCheckpoint struct {
+	lock sync.Mutex
+	path string
+	f    *os.File
+}
+
+type checkpointHeader struct {
+	Src       string
+	Dest      string
+	Timestamp int64
+}
+
+type checkpointEntry struct {
+	Path string
+	Hash []byte
+}
+
+func checkpointPath(src string, dest string) string {
+	h := sha256.Sum256([]byte(src + "\x00" + dest))
+	return config.Config().DatabaseLocation + "-restorestate-" + hex.EncodeToString(h[:8])
+}
+
+// the timestamp the interrupted restore was restoring to, and every destination it finished (path to hash)
+func loadCheckpoint(src string, dest string) (int64, map[string][]byte) {
+	path := checkpointPath(src, dest)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			panic("there's no interrupted restore of " + src + " to " + dest + " to resume")
+		}
+		panic(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var header checkpointHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil {
+		panic("unable to read " + path)
+	}
+	if header.Src != src || header.Dest != dest {
+		panic("sanity check " + path)
+	}
+	done := make(map[string][]byte)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry checkpointEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Println("Ignoring a line of", path, "that was cut off:", err)
+			continue
+		}
+		done[entry.Path] = entry.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	log.Println("Resuming a restore to timestamp", header.Timestamp, "which had finished", len(done), "destinations")
+	return header.Timestamp, done
+}
+
+// resume continues the existing checkpoint, otherwise any existing one is replaced
+func startCheckpoint(src string, dest string, timestamp int64, resume bool) *restoreCheckpoint {
+	path := checkpointPath(src, dest)
+	var f *os.File
+	var err error
+	if resume {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	} else {
+		if _, err := os.Stat(path); err == nil {
+			log.Println("There was an unfinished restore of", src, "to", dest, "but this is starting over, since it wasn't run with --resume")
+		}
+		f, err = os.Create(path)
+	}
+	if err != nil {
+		panic(err)
+	}
+	c := &restoreCheckpoint{path: path, f: f}
+	if resume {
+		// the previous run could have been killed partway through writing a line, so make sure the next one starts on its own
+		c.write([]byte("\n"))
+	} else if err := json.NewEncoder(f).Encode(checkpointHeader{Src: src, Dest: dest, Timestamp: timestamp}); err != nil {
+		panic(err)
+	}
+	log.Println("Saving restore progress to", path, "so that this can be continued with --resume if it's interrupted")
+	return c
+}
+
+func (c *restoreCheckpoint) write(data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, err := c.f.Write(data); err != nil {
+		panic(err)
+	}
+}
+
+// every destination of rest is completely written, with the right mtime
+func (c *restoreCheckpoint) done(rest *Restoration) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for path := range rest.destinations {
+		if err := enc.Encode(checkpointEntry{Path: path, Hash: rest.hash}); err != nil {
+			panic(err)
+		}
+	}
+	c.write(buf.Bytes()) // in one write, so that a destination is never recorded without the others
+}
+
+// the restore completed, so there's nothing left to resume
+func (c *restoreCheckpoint) finish() {
+	if err := c.f.Close(); err != nil {
+		panic(err)
+	}
+	if err := os.Remove(c.path); err != nil {
+		panic(err)
+	}
+}
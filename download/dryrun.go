@@ -0,0 +1,234 @@
+package download
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/storage_base"
+	"github.com/leijurv/gb/utils"
+)
+
+// what `gb restore --dry-run --json` prints, instead of doing any of it
+type dryRunPlan struct {
+	Src       string `json:"src"`
+	Dest      string `json:"dest"`
+	Timestamp int64  `json:"timestamp"`
+
+	Restorations []dryRunRestoration `json:"restorations"`
+	// destinations that already have the right contents, so they won't be touched
+	Skipped []dryRunSkipped `json:"skipped"`
+	// every read from storage, in terms of the blobs they come from. gaps between entries are read and thrown away, so they count too
+	Downloads []dryRunDownload `json:"downloads"`
+	// hashes that would have to come from storage, but aren't in any
+	Unavailable []string `json:"unavailable"`
+
+	WriteCount             int              `json:"write_count"`
+	OverwriteCount         int              `json:"overwrite_count"`
+	SkippedCount           int              `json:"skipped_count"`
+	LocalBytes             int64            `json:"local_bytes"`
+	DownloadBytes          int64            `json:"download_bytes"`
+	DownloadBytesByStorage map[string]int64 `json:"download_bytes_by_storage"`
+}
+
+type dryRunRestoration struct {
+	Hash         string              `json:"hash"`
+	Size         int64               `json:"size"`
+	Destinations []dryRunDestination `json:"destinations"`
+	// exactly one of these is set
+	LocalSource   string          `json:"local_source,omitempty"`
+	StorageSource *dryRunLocation `json:"storage_source,omitempty"`
+	// other places this could be fetched from if the first one fails
+	Fallbacks []dryRunLocation `json:"fallbacks,omitempty"`
+}
+
+type dryRunDestination struct {
+	Path        string `json:"path"`
+	OrigPath    string `json:"orig_path"`
+	Overwrite   bool   `json:"overwrite"` // something different is there now
+	FsModified  int64  `json:"fs_modified"`
+	Permissions string `json:"permissions"`
+}
+
+type dryRunLocation struct {
+	Storage string `json:"storage"`
+	Blob    string `json:"blob"`
+	Offset  int64  `json:"offset"`
+	Length  int64  `json:"length"`
+}
+
+type dryRunSkipped struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+type dryRunDownload struct {
+	Storage string   `json:"storage"`
+	Blob    string   `json:"blob"`
+	Offset  int64    `json:"offset"`
+	Length  int64    `json:"length"`
+	Hashes  []string `json:"hashes"`
+}
+
+// every destination in the plan, to its hash
+func planDestinations(plan map[[32]byte]*Restoration) map[string][]byte {
+	ret := make(map[string][]byte)
+	for _, rest := range plan {
+		for path := range rest.destinations {
+			ret[path] = rest.hash
+		}
+	}
+	return ret
+}
+
+// allDestinations is planDestinations from before statSources removed the ones that are already in place
+func buildDryRunPlan(src string, dest string, timestamp int64, plan map[[32]byte]*Restoration, allDestinations map[string][]byte, stor storage_base.Storage) dryRunPlan {
+	labels := make(map[[32]byte]string)
+	rows, err := db.DB.Query("SELECT storage_id, readable_label FROM storage")
+	db.Must(err)
+	for rows.Next() {
+		var storageID []byte
+		var label string
+		db.Must(rows.Scan(&storageID, &label))
+		labels[utils.SliceToArr(storageID)] = label
+	}
+	db.Must(rows.Err())
+	rows.Close()
+	location := func(loc entryLocation) dryRunLocation {
+		return dryRunLocation{
+			Storage: labels[utils.SliceToArr(loc.stor.GetID())],
+			Blob:    loc.StoragePath,
+			Offset:  loc.Offset,
+			Length:  loc.Length,
+		}
+	}
+
+	ret := dryRunPlan{
+		Src:                    src,
+		Dest:                   dest,
+		Timestamp:              timestamp,
+		Restorations:           make([]dryRunRestoration, 0),
+		Skipped:                make([]dryRunSkipped, 0),
+		Downloads:              make([]dryRunDownload, 0),
+		Unavailable:            make([]string, 0),
+		DownloadBytesByStorage: make(map[string]int64),
+	}
+	remaining := planDestinations(plan)
+	for path, hash := range allDestinations {
+		if _, ok := remaining[path]; !ok {
+			ret.Skipped = append(ret.Skipped, dryRunSkipped{Path: path, Hash: hex.EncodeToString(hash)})
+		}
+	}
+	sort.Slice(ret.Skipped, func(i, j int) bool {
+		return ret.Skipped[i].Path < ret.Skipped[j].Path
+	})
+	ret.SkippedCount = len(ret.Skipped)
+
+	locations := locateEntries(plan, stor)
+	fromStorage := make([]*Restoration, 0)
+	for _, rest := range plan {
+		r := dryRunRestoration{
+			Hash:         hex.EncodeToString(rest.hash),
+			Size:         rest.size,
+			Destinations: make([]dryRunDestination, 0, len(rest.destinations)),
+		}
+		for path, item := range rest.destinations {
+			_, err := os.Lstat(path)
+			overwrite := err == nil
+			if overwrite {
+				ret.OverwriteCount++
+			} else {
+				ret.WriteCount++
+			}
+			r.Destinations = append(r.Destinations, dryRunDestination{
+				Path:        path,
+				OrigPath:    item.origPath,
+				Overwrite:   overwrite,
+				FsModified:  item.fsModified,
+				Permissions: item.permissions.String(),
+			})
+		}
+		sort.Slice(r.Destinations, func(i, j int) bool {
+			return r.Destinations[i].Path < r.Destinations[j].Path
+		})
+		locs := locations[utils.SliceToArr(rest.hash)]
+		if rest.nominatedSource != nil {
+			r.LocalSource = *rest.nominatedSource
+			ret.LocalBytes += rest.size
+		} else if len(locs) == 0 {
+			ret.Unavailable = append(ret.Unavailable, r.Hash)
+		} else {
+			first := location(locs[0])
+			r.StorageSource = &first
+			locs = locs[1:]
+			fromStorage = append(fromStorage, rest)
+		}
+		for _, loc := range locs {
+			r.Fallbacks = append(r.Fallbacks, location(loc))
+		}
+		ret.Restorations = append(ret.Restorations, r)
+	}
+	sort.Slice(ret.Restorations, func(i, j int) bool {
+		return ret.Restorations[i].Destinations[0].Path < ret.Restorations[j].Destinations[0].Path
+	})
+	sort.Strings(ret.Unavailable)
+
+	for _, r := range groupIntoRanges(fromStorage, locations) {
+		d := dryRunDownload{
+			Storage: labels[utils.SliceToArr(r.stor.GetID())],
+			Blob:    r.path,
+			Offset:  r.start,
+			Length:  r.end - r.start,
+			Hashes:  make([]string, 0, len(r.restorations)),
+		}
+		for _, rest := range r.restorations {
+			d.Hashes = append(d.Hashes, hex.EncodeToString(rest.hash))
+		}
+		ret.Downloads = append(ret.Downloads, d)
+		ret.DownloadBytes += d.Length
+		ret.DownloadBytesByStorage[d.Storage] += d.Length
+	}
+	return ret
+}
+
+func (p dryRunPlan) print(asJSON bool) {
+	if asJSON {
+		// the log goes to stderr, so this can be piped straight into something else
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(p); err != nil {
+			panic(err)
+		}
+		return
+	}
+	for _, r := range p.Restorations {
+		source := "copied from " + r.LocalSource
+		if r.StorageSource != nil {
+			source = "downloaded from " + r.StorageSource.Storage + " blob " + r.StorageSource.Blob
+		} else if r.LocalSource == "" {
+			source = "NOT AVAILABLE from any storage"
+		}
+		for _, d := range r.Destinations {
+			action := "Write"
+			if d.Overwrite {
+				action = "Overwrite"
+			}
+			log.Println(action, d.Path, "with", r.Hash, source)
+		}
+	}
+	for _, s := range p.Skipped {
+		log.Println("Skip", s.Path, "since it already has the right contents")
+	}
+	log.Println("Would write", p.WriteCount, "new files, overwrite", p.OverwriteCount, "and skip", p.SkippedCount)
+	log.Println("Would copy", utils.FormatCommas(p.LocalBytes), "bytes from files already on disk, and download", utils.FormatCommas(p.DownloadBytes), "bytes in", len(p.Downloads), "reads")
+	for label, bytes := range p.DownloadBytesByStorage {
+		log.Println(utils.FormatCommas(bytes), "bytes from", label)
+	}
+	if len(p.Unavailable) > 0 {
+		log.Println("WARNING:", len(p.Unavailable), "hashes are not in any storage, so this restore would fail")
+	}
+	log.Println("This was a dry run, nothing was changed")
+}
@@ -0,0 +1,371 @@
+package download
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/storage"
+	"github.com/leijurv/gb/storage_base"
+	"github.com/leijurv/gb/utils"
+)
+
+// entries in the same blob that are closer together than this are fetched in one read, throwing away whatever is between them
+const restoreMaxGap = 4 * 1024 * 1024
+
+// one place a hash can be downloaded from
+type entryLocation struct {
+	BlobEntryInfo
+	stor storage_base.Storage
+}
+
+// some entries of one blob in one storage, that are read in one go, in order of offset
+type blobRange struct {
+	stor  storage_base.Storage
+	path  string
+	start int64
+	end   int64
+
+	restorations []*Restoration
+}
+
+// what a restore worker does next. either a range from storage, or a restoration that can be copied from disk (which is really a range of nothing)
+type restoreJob struct {
+	blobRange *blobRange
+	local     *Restoration
+}
+
+// every place each hash is, with stor first
+func locateEntries(plan map[[32]byte]*Restoration, stor storage_base.Storage) map[[32]byte][]entryLocation {
+	storages := make(map[[32]byte]storage_base.Storage)
+	for _, s := range storage.GetAll() {
+		storages[utils.SliceToArr(s.GetID())] = s
+	}
+	tx, err := db.DB.Begin()
+	db.Must(err)
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`
+		SELECT
+			blob_entries.blob_id,
+			blob_entries.offset,
+			blob_entries.final_size,
+			blob_entries.compression_alg,
+			blob_entries.encryption_alg,
+			blob_entries.encryption_key,
+			blob_entries.sealed_key,
+			blob_storage.storage_id,
+			blob_storage.path
+		FROM blob_entries
+			INNER JOIN blob_storage ON blob_storage.blob_id = blob_entries.blob_id
+		WHERE blob_entries.hash = ?`)
+	db.Must(err)
+	defer stmt.Close()
+	ret := make(map[[32]byte][]entryLocation)
+	for hash, rest := range plan {
+		func() {
+			rows, err := stmt.Query(hash[:])
+			db.Must(err)
+			defer rows.Close()
+			locations := make([]entryLocation, 0)
+			for rows.Next() {
+				var loc entryLocation
+				var key []byte
+				var sealedKey []byte
+				var storageID []byte
+				db.Must(rows.Scan(&loc.BlobID, &loc.Offset, &loc.Length, &loc.CompressionAlg, &loc.Encryption, &key, &sealedKey, &storageID, &loc.StoragePath))
+				loc.Key = EntryKey(key, sealedKey)
+				loc.ExpectedSize = rest.size
+				loc.stor = storages[utils.SliceToArr(storageID)]
+				if loc.stor == nil {
+					panic("blob_storage refers to a storage that doesn't exist " + hex.EncodeToString(storageID))
+				}
+				locations = append(locations, loc)
+			}
+			db.Must(rows.Err())
+			sort.SliceStable(locations, func(i, j int) bool {
+				return locations[i].stor == stor && locations[j].stor != stor
+			})
+			ret[hash] = locations
+		}()
+	}
+	return ret
+}
+
+// restorations that need to come from storage are grouped by where they'd first be fetched from
+func groupIntoRanges(restorations []*Restoration, locations map[[32]byte][]entryLocation) []*blobRange {
+	byBlob := make(map[string][]*Restoration)
+	keys := make([]string, 0)
+	for _, rest := range restorations {
+		loc := locations[utils.SliceToArr(rest.hash)][0]
+		key := hex.EncodeToString(loc.stor.GetID()) + loc.StoragePath
+		if _, ok := byBlob[key]; !ok {
+			keys = append(keys, key)
+		}
+		byBlob[key] = append(byBlob[key], rest)
+	}
+	sort.Strings(keys)
+	ranges := make([]*blobRange, 0)
+	for _, key := range keys {
+		inBlob := byBlob[key]
+		first := func(rest *Restoration) entryLocation {
+			return locations[utils.SliceToArr(rest.hash)][0]
+		}
+		sort.Slice(inBlob, func(i, j int) bool {
+			return first(inBlob[i]).Offset < first(inBlob[j]).Offset
+		})
+		var current *blobRange
+		for _, rest := range inBlob {
+			loc := first(rest)
+			if current == nil || loc.Offset-current.end > restoreMaxGap {
+				current = &blobRange{stor: loc.stor, path: loc.StoragePath, start: loc.Offset, end: loc.Offset}
+				ranges = append(ranges, current)
+			}
+			current.restorations = append(current.restorations, rest)
+			if loc.Offset+loc.Length > current.end {
+				current.end = loc.Offset + loc.Length
+			}
+		}
+	}
+	return ranges
+}
+
+// runs execute, turning any panic (a download error, a hash mismatch, ...) into an error so that something else can be tried
+func tryExecute(rest Restoration, fetch func() io.Reader) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	execute(rest, fetch)
+	return nil
+}
+
+// shared by all the restore workers
+type restoreProgress struct {
+	lock       sync.Mutex
+	errors     map[[32]byte][]string // everything that went wrong for each hash, so that a final failure isn't just reported as whatever went wrong last
+	checkpoint *restoreCheckpoint
+	start      time.Time
+	total      int64
+	done       int64
+}
+
+func (p *restoreProgress) add(rest *Restoration, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key := utils.SliceToArr(rest.hash)
+	p.errors[key] = append(p.errors[key], err.Error())
+}
+
+func (p *restoreProgress) try(rest *Restoration, fetch func() io.Reader) error {
+	err := tryExecute(*rest, fetch)
+	if err != nil {
+		p.add(rest, err)
+		return err
+	}
+	p.checkpoint.done(rest)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done += rest.size
+	return nil
+}
+
+func (p *restoreProgress) status() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ret := "Restored " + utils.FormatCommas(p.done) + " of " + utils.FormatCommas(p.total) + " bytes"
+	elapsed := time.Since(p.start)
+	if p.done > 0 && p.done < p.total {
+		eta := time.Duration(float64(elapsed) * float64(p.total-p.done) / float64(p.done))
+		ret += ", ETA " + eta.Round(time.Second).String()
+	}
+	return ret
+}
+
+// download every restoration in plan (and copy the ones that have a local source), config.NumRestoreThreads at a time
+// anything that fails is retried from every other place it's stored, and only once everything else is done does this panic about what's left
+func executeAll(plan map[[32]byte]*Restoration, stor storage_base.Storage, checkpoint *restoreCheckpoint) {
+	fromStorage := make([]*Restoration, 0)
+	jobs := make([]restoreJob, 0)
+	for _, rest := range plan {
+		if rest.nominatedSource == nil {
+			fromStorage = append(fromStorage, rest)
+		} else {
+			jobs = append(jobs, restoreJob{local: rest})
+		}
+	}
+	locations := locateEntries(plan, stor)
+	for _, rest := range fromStorage {
+		if len(locations[utils.SliceToArr(rest.hash)]) == 0 {
+			panic("hash " + hex.EncodeToString(rest.hash) + " is not in any storage")
+		}
+	}
+	ranges := groupIntoRanges(fromStorage, locations)
+	for _, r := range ranges {
+		jobs = append(jobs, restoreJob{blobRange: r})
+	}
+	log.Println("Restoring with", config.Config().NumRestoreThreads, "threads:", len(fromStorage), "hashes from storage in", len(ranges), "reads, and", len(plan)-len(fromStorage), "copied from disk")
+
+	progress := &restoreProgress{errors: make(map[[32]byte][]string), checkpoint: checkpoint, start: time.Now()}
+	for _, rest := range plan {
+		progress.total += rest.size
+	}
+	if config.Config().UploadStatusInterval != -1 {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(time.Duration(config.Config().UploadStatusInterval) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					log.Println(progress.status())
+				}
+			}
+		}()
+	}
+	var failedLock sync.Mutex
+	failed := make([]*Restoration, 0)
+	fail := func(rest *Restoration) {
+		failedLock.Lock()
+		defer failedLock.Unlock()
+		failed = append(failed, rest)
+	}
+	todo := make(chan restoreJob)
+	var wg sync.WaitGroup
+	for i := 0; i < config.Config().NumRestoreThreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range todo {
+				if job.local != nil {
+					if !executeLocal(job.local, locations[utils.SliceToArr(job.local.hash)], progress) {
+						fail(job.local)
+					}
+					continue
+				}
+				for _, rest := range executeRange(job.blobRange, locations, progress) {
+					if !executeFallback(rest, locations[utils.SliceToArr(rest.hash)][1:], progress) {
+						fail(rest)
+					}
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		todo <- job
+	}
+	close(todo)
+	wg.Wait()
+	log.Println(progress.status())
+	if len(failed) > 0 {
+		var msg string
+		for _, rest := range failed {
+			log.Println("FAILED to restore", hex.EncodeToString(rest.hash), "from anywhere")
+			msg = hex.EncodeToString(rest.hash) + ": " + strings.Join(progress.errors[utils.SliceToArr(rest.hash)], ", then ")
+		}
+		panic(fmt.Sprint(len(failed), " hashes could not be restored, such as ", msg))
+	}
+}
+
+// if the local copy doesn't work out after all, it's fetched from storage instead
+func executeLocal(rest *Restoration, locations []entryLocation, progress *restoreProgress) bool {
+	err := progress.try(rest, func() io.Reader {
+		panic("a restoration with a local source shouldn't need to fetch")
+	})
+	if err == nil {
+		return true
+	}
+	log.Println("Copying locally from", *rest.nominatedSource, "FAILED due to", err, "so fetching from storage instead")
+	rest.nominatedSource = nil
+	return executeFallback(rest, locations, progress)
+}
+
+// read the whole range once, restoring each entry from it in turn. returns the restorations that failed, which should be retried from their other locations
+func executeRange(r *blobRange, locations map[[32]byte][]entryLocation, progress *restoreProgress) []*Restoration {
+	failed := make([]*Restoration, 0)
+	// everything from here on in the range is lost
+	abandon := func(remaining []*Restoration, err error) []*Restoration {
+		log.Println("Reading", r.path, "from", r.stor, "FAILED due to", err)
+		for _, rest := range remaining {
+			progress.add(rest, err)
+		}
+		return append(failed, remaining...)
+	}
+	var reader io.ReadCloser
+	err := func() (err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				err = fmt.Errorf("%v", rec)
+			}
+		}()
+		reader = r.stor.DownloadSection(r.path, r.start, r.end-r.start)
+		return nil
+	}()
+	if err != nil {
+		return abandon(r.restorations, err)
+	}
+	defer reader.Close()
+	pos := r.start
+	for i, rest := range r.restorations {
+		loc := locations[utils.SliceToArr(rest.hash)][0]
+		// skip over the gap to the start of this entry
+		if _, err := io.CopyN(io.Discard, reader, loc.Offset-pos); err != nil {
+			return abandon(r.restorations[i:], err)
+		}
+		entry := &countingReader{in: io.LimitReader(reader, loc.Length)}
+		err := progress.try(rest, func() io.Reader {
+			return utils.ReadCloserToReader(entryReader(entry, loc.BlobEntryInfo, rest.hash))
+		})
+		if err != nil {
+			log.Println("Restoring", hex.EncodeToString(rest.hash), "from", r.stor, "FAILED due to", err)
+			failed = append(failed, rest)
+		}
+		// whether or not that worked, the rest of the range can still be used, as long as the reader ends up at the end of this entry
+		if _, err := io.Copy(io.Discard, entry); err != nil {
+			return abandon(r.restorations[i+1:], err)
+		}
+		if entry.n != loc.Length {
+			return abandon(r.restorations[i+1:], io.ErrUnexpectedEOF)
+		}
+		pos = loc.Offset + loc.Length
+	}
+	return failed
+}
+
+type countingReader struct {
+	in io.Reader
+	n  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.in.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// try each location in turn until one works
+func executeFallback(rest *Restoration, locations []entryLocation, progress *restoreProgress) bool {
+	for _, loc := range locations {
+		log.Println("Retrying", hex.EncodeToString(rest.hash), "from", loc.stor)
+		err := progress.try(rest, func() io.Reader {
+			reader := utils.ReadCloserToReader(loc.stor.DownloadSection(loc.StoragePath, loc.Offset, loc.Length))
+			return utils.ReadCloserToReader(entryReader(reader, loc.BlobEntryInfo, rest.hash))
+		})
+		if err == nil {
+			log.Println("Retrying", hex.EncodeToString(rest.hash), "from", loc.stor, "worked")
+			return true
+		}
+		log.Println("Retrying", hex.EncodeToString(rest.hash), "from", loc.stor, "FAILED due to", err)
+	}
+	return false
+}
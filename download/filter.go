@@ -0,0 +1,125 @@
+package download
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// which of the files being restored to actually restore. the zero value restores everything
+type RestoreFilter struct {
+	// globs against the path relative to what's being restored
+	// one without a / matches any single path component, so "*.psd" is every psd and "node_modules" is everything in any node_modules
+	// one with a / matches from the start of the relative path, so "a/*/c" is also everything inside a/b/c
+	Include []string
+	Exclude []string
+	// regexes against the full original path
+	IncludeRegex []string
+	ExcludeRegex []string
+	NewerThan    int64 // fs_modified strictly after this, or 0 for any
+	LargerThan   int64 // in bytes, or 0 for any
+}
+
+func (f RestoreFilter) IsEmpty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0 && len(f.IncludeRegex) == 0 && len(f.ExcludeRegex) == 0 && f.NewerThan == 0 && f.LargerThan == 0
+}
+
+type compiledRestoreFilter struct {
+	RestoreFilter
+	includeRegex []*regexp.Regexp
+	excludeRegex []*regexp.Regexp
+}
+
+func (f RestoreFilter) compile() compiledRestoreFilter {
+	for _, glob := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			panic("invalid glob " + glob + ": " + err.Error())
+		}
+	}
+	return compiledRestoreFilter{
+		RestoreFilter: f,
+		includeRegex:  compileRegexes(f.IncludeRegex),
+		excludeRegex:  compileRegexes(f.ExcludeRegex),
+	}
+}
+
+func compileRegexes(regexes []string) []*regexp.Regexp {
+	ret := make([]*regexp.Regexp, 0, len(regexes))
+	for _, r := range regexes {
+		ret = append(ret, regexp.MustCompile(r))
+	}
+	return ret
+}
+
+func (f compiledRestoreFilter) matches(item Item, relPath string) bool {
+	if f.NewerThan != 0 && item.fsModified <= f.NewerThan {
+		return false
+	}
+	if f.LargerThan != 0 && item.size <= f.LargerThan {
+		return false
+	}
+	if len(f.Include) > 0 || len(f.includeRegex) > 0 {
+		if !anyGlobMatches(f.Include, relPath) && !anyRegexMatches(f.includeRegex, item.origPath) {
+			return false
+		}
+	}
+	return !anyGlobMatches(f.Exclude, relPath) && !anyRegexMatches(f.excludeRegex, item.origPath)
+}
+
+func anyGlobMatches(globs []string, relPath string) bool {
+	components := strings.Split(relPath, "/")
+	for _, glob := range globs {
+		if strings.Contains(glob, "/") {
+			glob = strings.Trim(glob, "/")
+			for i := range components {
+				if ok, _ := filepath.Match(glob, strings.Join(components[:i+1], "/")); ok {
+					return true
+				}
+			}
+			continue
+		}
+		for _, component := range components {
+			if ok, _ := filepath.Match(glob, component); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func anyRegexMatches(regexes []*regexp.Regexp, path string) bool {
+	for _, r := range regexes {
+		if r.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// src is what's being restored, either the one file or the directory all the items are in
+func filterItems(items []Item, src string, srcFile bool, filter RestoreFilter) []Item {
+	if filter.IsEmpty() {
+		return items
+	}
+	if !srcFile && !strings.HasSuffix(src, "/") {
+		src += "/"
+	}
+	compiled := filter.compile()
+	ret := make([]Item, 0, len(items))
+	for _, item := range items {
+		relPath := filepath.Base(item.origPath)
+		if !srcFile {
+			relPath = item.origPath[len(src):]
+		}
+		if compiled.matches(item, relPath) {
+			ret = append(ret, item)
+		}
+	}
+	if len(ret) == 0 {
+		panic(fmt.Sprint("none of the ", len(items), " files in ", src, " match the filters"))
+	}
+	log.Println(len(ret), "of", len(items), "files match the filters")
+	return ret
+}
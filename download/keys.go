@@ -0,0 +1,56 @@
+package download
+
+import (
+	"crypto/ecdh"
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/crypto"
+)
+
+var privateKeyLock sync.Mutex
+var privateKey *ecdh.PrivateKey
+var privateKeyFile string
+
+func loadPrivateKey() *ecdh.PrivateKey {
+	privateKeyLock.Lock()
+	defer privateKeyLock.Unlock()
+	path := config.Config().PrivateKeyFile
+	if privateKey != nil && privateKeyFile == path {
+		return privateKey
+	}
+	if path == "" {
+		log.Println("This blob entry's key is sealed to a public key (it was backed up with public_key set in the config)")
+		log.Println("Set private_key_file in the config file to the private key from `gb generate-keypair` to read it")
+		panic("no private_key_file configured")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	priv, err := crypto.ParsePrivateKey(string(data))
+	if err != nil {
+		log.Println(path, "is not a valid private key")
+		panic(err)
+	}
+	privateKey = priv
+	privateKeyFile = path
+	return priv
+}
+
+// the key to decrypt a blob entry, given its encryption_key and sealed_key columns (exactly one of which is non-null)
+func EntryKey(key []byte, sealed []byte) []byte {
+	if key != nil {
+		return key
+	}
+	if sealed == nil {
+		panic("blob entry has neither an encryption_key nor a sealed_key")
+	}
+	key, err := crypto.UnsealKey(sealed, loadPrivateKey())
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
@@ -49,21 +49,33 @@ type Restoration struct {
 	sourcesOnDisk map[string]int64 // path to fsModified
 }
 
-func Restore(src string, dest string, timestamp int64, stor storage_base.Storage) {
-	restoreImpl(src, dest, timestamp, stor, true)
+type RestoreOptions struct {
+	// continue an interrupted restore of the same src to the same dest, to the same timestamp (which can be left as 0)
+	Resume bool
+	Filter RestoreFilter
+	// instead of everything as of a timestamp, only the files that were deleted after this timestamp and haven't come back since, as they were right before they were deleted
+	DeletedSince int64
+	// only print what would be done, without changing anything
+	DryRun bool
+	JSON   bool // print the dry run as json to stdout
+}
+
+func Restore(src string, dest string, timestamp int64, opts RestoreOptions, stor storage_base.Storage) {
+	restoreImpl(src, dest, timestamp, opts, stor, true)
 }
 
 func RestoreNonInteractive(src string, dest string, timestamp int64, stor storage_base.Storage) {
-	restoreImpl(src, dest, timestamp, stor, false)
+	restoreImpl(src, dest, timestamp, RestoreOptions{}, stor, false)
+}
+
+func RestoreWithOptionsNonInteractive(src string, dest string, timestamp int64, opts RestoreOptions, stor storage_base.Storage) {
+	restoreImpl(src, dest, timestamp, opts, stor, false)
 }
 
-func restoreImpl(src string, dest string, timestamp int64, stor storage_base.Storage, interactive bool) {
+func restoreImpl(src string, dest string, timestamp int64, opts RestoreOptions, stor storage_base.Storage, interactive bool) {
 	// concept: restore a directory
 	// src is where the directory was (is, in the database)
 	// dest is where the directory should be
-	if timestamp == 0 {
-		timestamp = time.Now().Unix()
-	}
 	if dest == "" {
 		dest = src
 	}
@@ -82,30 +94,33 @@ func restoreImpl(src string, dest string, timestamp int64, stor storage_base.Sto
 	}
 	// we should not consider what's on the filesystem at the source
 	// this is a restore :)
+	checkpointSrc, checkpointDest := src, dest
+	var finished map[string][]byte
+	if opts.Resume {
+		var resumeTimestamp int64
+		resumeTimestamp, finished = loadCheckpoint(checkpointSrc, checkpointDest)
+		if timestamp != 0 && timestamp != resumeTimestamp {
+			panic(fmt.Sprint("the interrupted restore was to timestamp ", resumeTimestamp, ", not ", timestamp))
+		}
+		timestamp = resumeTimestamp
+	}
+	if timestamp == 0 {
+		timestamp = time.Now().Unix()
+	}
 
 	log.Println("src:", src)
 	log.Println("dest:", dest)
 	log.Println("timestamp:", timestamp)
 
-	assumingFile := generatePlan(src, timestamp, true)
-	if len(assumingFile) > 1 {
-		panic("database should not allow this?")
-	}
-	assumingDir := generatePlan(src, timestamp, false)
-	srcFile := len(assumingFile) > 0
-	srcDir := len(assumingDir) > 0
-	if !srcFile && !srcDir {
-		panic(src + " did not exist in the database (as either a file or directory) as of that timestamp")
-	}
-	if srcFile && srcDir {
-		panic("Unclear if you mean the file or the directory (i.e. should I restore one file, or many). This should never happen. You can add a trailing / to indicate you mean a directory. If it's just 1 file, restore it manually using history and cat lol")
-	}
-	items := append(assumingFile, assumingDir...) // only one will have entries, as we just showed
-	for _, item := range items {                  // useless sanity check
-		if item.destPath != "" {
-			panic(item.destPath)
-		}
+	var items []Item
+	var srcFile bool
+	if opts.DeletedSince != 0 {
+		log.Println("only files deleted since:", opts.DeletedSince)
+		items, srcFile = deletedItemsAt(src, opts.DeletedSince)
+	} else {
+		items, srcFile = itemsAt(src, timestamp)
 	}
+	items = filterItems(items, src, srcFile, opts.Filter)
 	destStat, err := os.Stat(dest)
 	if err != nil {
 		// dest does NOT exist
@@ -153,6 +168,23 @@ func restoreImpl(src string, dest string, timestamp int64, stor storage_base.Sto
 			panic("what")
 		}
 	}
+	if opts.DeletedSince != 0 {
+		// the database thinks these are gone, but something could have been put back since the last backup, and that must not be touched
+		missing := make([]Item, 0, len(items))
+		for _, item := range items {
+			if _, err := os.Lstat(item.destPath); err == nil {
+				log.Println("Skipping", item.destPath, "since it exists now")
+				continue
+			} else if !os.IsNotExist(err) {
+				panic(err)
+			}
+			missing = append(missing, item)
+		}
+		if len(missing) == 0 {
+			panic("every file deleted from " + src + " since then is already back in place")
+		}
+		items = missing
+	}
 	description := "Destination path & restored from, timestamp when backup of source was taken, filesystem last modified timestamp as of that revision, size, permissions, hash"
 	log.Println()
 	log.Println(description)
@@ -197,7 +229,7 @@ func restoreImpl(src string, dest string, timestamp int64, stor storage_base.Sto
 	m := maxstart(items)
 	log.Println("NOTE: I am restoring to timestamp", time.Unix(timestamp, 0).Format(time.RFC3339), "BUT the most recent gb backup in which this data had been updated was at", time.Unix(m, 0).Format(time.RFC3339))
 	log.Println("NOTE: That disparity is", timestamp-m, "seconds")
-	if interactive {
+	if interactive && !opts.DryRun {
 		log.Println("Confirm? (yes: enter, no: ctrl+c) >")
 		bufio.NewReader(os.Stdin).ReadString('\n')
 	}
@@ -221,12 +253,21 @@ func restoreImpl(src string, dest string, timestamp int64, stor storage_base.Sto
 	}
 	//log.Println(plan)
 	locateSourcesOnDisk(plan)
+	// whatever the interrupted restore finished is just another source on disk, and statSources will check that it's still intact
+	for _, r := range plan {
+		for path, item := range r.destinations {
+			if hash, ok := finished[path]; ok && bytes.Equal(hash, r.hash) {
+				r.sourcesOnDisk[path] = item.fsModified
+			}
+		}
+	}
 	//log.Println(plan)
 	for _, r := range plan {
 		if len(r.destinations) == 0 || len(r.hash) == 0 {
 			panic("failed")
 		}
 	}
+	allDestinations := planDestinations(plan)
 	log.Println("Okay that was all database stuff, now I will stat your disk to see how much is already in place, how much I can pull from other files, and how much needs to be downloaded from storage")
 	statSources(plan)
 	cnt = 0
@@ -255,13 +296,54 @@ func restoreImpl(src string, dest string, timestamp int64, stor storage_base.Sto
 		}
 	}
 	log.Println("The answer is", sum, "bytes across", cnt, "distinct hashes, to be written to", cnt2, "places on disk")
+	if opts.DryRun {
+		buildDryRunPlan(checkpointSrc, checkpointDest, timestamp, plan, allDestinations, stor).print(opts.JSON)
+		return
+	}
 	if interactive {
 		log.Println("Confirm? (yes: enter, no: ctrl+c) >")
 		bufio.NewReader(os.Stdin).ReadString('\n')
 	}
-	for _, r := range plan {
-		execute(*r, stor)
+	checkpoint := startCheckpoint(checkpointSrc, checkpointDest, timestamp, opts.Resume)
+	executeAll(plan, stor, checkpoint)
+	checkpoint.finish()
+}
+
+// everything that was at src as of timestamp, and whether src was a single file (as opposed to a directory)
+func itemsAt(src string, timestamp int64) ([]Item, bool) {
+	return resolveItems(src, func(assumingFile bool) []Item {
+		return generatePlan(src, timestamp, assumingFile)
+	}, "as of that timestamp")
+}
+
+// the last revision of everything at src that was deleted after since, and hasn't come back
+func deletedItemsAt(src string, since int64) ([]Item, bool) {
+	return resolveItems(src, func(assumingFile bool) []Item {
+		return generateDeletedPlan(src, since, assumingFile)
+	}, "that was deleted since then and not brought back")
+}
+
+func resolveItems(src string, plan func(assumingFile bool) []Item, description string) ([]Item, bool) {
+	assumingFile := plan(true)
+	if len(assumingFile) > 1 {
+		panic("database should not allow this?")
+	}
+	assumingDir := plan(false)
+	srcFile := len(assumingFile) > 0
+	srcDir := len(assumingDir) > 0
+	if !srcFile && !srcDir {
+		panic(src + " did not exist in the database (as either a file or directory) " + description)
+	}
+	if srcFile && srcDir {
+		panic("Unclear if you mean the file or the directory (i.e. should I restore one file, or many). This should never happen. You can add a trailing / to indicate you mean a directory. If it's just 1 file, restore it manually using history and cat lol")
+	}
+	items := append(assumingFile, assumingDir...) // only one will have entries, as we just showed
+	for _, item := range items {                  // useless sanity check
+		if item.destPath != "" {
+			panic(item.destPath)
+		}
 	}
+	return items, srcFile
 }
 
 func min(x, y int) int {
@@ -271,7 +353,8 @@ func min(x, y int) int {
 	return y
 }
 
-func execute(rest Restoration, stor storage_base.Storage) {
+// fetch is only called if there's no source on disk, and at most once
+func execute(rest Restoration, fetch func() io.Reader) {
 	paths := make([]string, 0)
 	for path, _ := range rest.destinations {
 		paths = append(paths, path)
@@ -281,11 +364,11 @@ func execute(rest Restoration, stor storage_base.Storage) {
 	diskSource := rest.nominatedSource
 	for i := 0; i < len(paths); i += 500 {
 		chunk := paths[i:min(len(rest.destinations), i+500)]
-		diskSource = executeChunk(chunk, rest, diskSource, stor)
+		diskSource = executeChunk(chunk, rest, diskSource, fetch)
 	}
 }
 
-func executeChunk(chunk []string, rest Restoration, diskSource *string, stor storage_base.Storage) *string {
+func executeChunk(chunk []string, rest Restoration, diskSource *string, fetch func() io.Reader) *string {
 	handles := make([]*os.File, 0)
 	chunkDest := make([]Item, 0, len(chunk))
 	success := false
@@ -338,7 +421,7 @@ func executeChunk(chunk []string, rest Restoration, diskSource *string, stor sto
 	var src io.Reader
 	if diskSource == nil {
 		log.Println("Fetching from storage")
-		src = CatEz(rest.hash, stor)
+		src = fetch()
 	} else {
 		log.Println("Reading locally, from", *diskSource)
 		f, err := os.Open(*diskSource)
@@ -509,3 +592,29 @@ func generatePlan(path string, timestamp int64, assumingFile bool) []Item {
 	db.Must(rows.Err())
 	return plan
 }
+
+func generateDeletedPlan(path string, since int64, assumingFile bool) []Item {
+	// a path with no current revision, whose most recent revision ended after since
+	// files_by_path_and_end makes that most recent revision unique
+	query := "SELECT files.hash, files.path, files.fs_modified, files.permissions, files.start, sizes.size FROM files INNER JOIN sizes ON files.hash = sizes.hash WHERE files.end > ?1 AND files.end = (SELECT MAX(latest.end) FROM files latest WHERE latest.path = files.path) AND NOT EXISTS (SELECT 1 FROM files curr WHERE curr.path = files.path AND curr.end IS NULL) AND files.path "
+	var rows *sql.Rows
+	var err error
+	if assumingFile {
+		rows, err = db.DB.Query(query+" = ?", since, path)
+	} else {
+		if !strings.HasSuffix(path, "/") {
+			path += "/"
+		}
+		rows, err = db.DB.Query(query+db.StartsWithPattern(2), since, path)
+	}
+	db.Must(err)
+	defer rows.Close()
+	plan := make([]Item, 0)
+	for rows.Next() {
+		var item Item
+		db.Must(rows.Scan(&item.hash, &item.origPath, &item.fsModified, &item.permissions, &item.start, &item.size))
+		plan = append(plan, item)
+	}
+	db.Must(rows.Err())
+	return plan
+}
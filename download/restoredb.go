@@ -2,28 +2,139 @@ package download
 
 import (
 	"bufio"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/DataDog/zstd"
 	"github.com/leijurv/gb/config"
 	"github.com/leijurv/gb/crypto"
+	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/dbbackups"
+	"github.com/leijurv/gb/storage_base"
+	"github.com/leijurv/gb/utils"
 	bip39 "github.com/tyler-smith/go-bip39"
 )
 
 // just a simple utility to decrypt the database
 
-func RestoreDB(path string) {
-	log.Print("Enter database encryption mnemonic: ")
-	mnemonic, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-	RestoreDBNonInteractive(path, mnemonic)
+// incrementals: given a full backup, also replay every incremental next to it on top. given an incremental, its chain is always replayed, up to itself
+func RestoreDB(path string, incrementals bool) {
+	restoreDBImpl(path, incrementals, readKey())
 }
 
-func RestoreDBNonInteractive(path string, mnemonic string) {
-	outPath := path + ".decrypted"
-	log.Println("Output will be written to", outPath)
+func RestoreDBFromStorage(stor storage_base.Storage, timestamp int64, outDir string) {
+	restoreDBFromStorageImpl(stor, timestamp, outDir, readKey())
+}
+
+func readKey() []byte {
+	reader := bufio.NewReader(os.Stdin)
+	return DBKeyFromRecovery("Enter database encryption mnemonic, passphrase protected key, or one of your key shares: ", func(prompt string) string {
+		log.Print(prompt)
+		if prompt == passphrasePrompt {
+			return utils.ReadPassphrase(reader)
+		}
+		line, _ := reader.ReadString('\n')
+		return line
+	})
+}
+
+const passphrasePrompt = "Enter passphrase: "
+
+// the database key from any of the forms "gb mnemonic" can print it in: plain mnemonic, passphrase protected, or shamir shares
+// ask is called for the first input, and then for the passphrase or the rest of the shares if needed
+func DBKeyFromRecovery(prompt string, ask func(prompt string) string) []byte {
+	input := strings.TrimSpace(ask(prompt))
+	if crypto.IsPassphraseWrappedKey(input) {
+		key, err := crypto.UnwrapKeyWithPassphrase(input, strings.TrimSuffix(ask(passphrasePrompt), "\n"))
+		if err != nil {
+			panic(err)
+		}
+		return key
+	}
+	if len(strings.Fields(input)) == 15 {
+		share, err := crypto.ParseKeyShareMnemonic(input)
+		if err != nil {
+			panic(err)
+		}
+		shares := []crypto.KeyShare{share}
+		for len(shares) < share.Threshold {
+			share, err := crypto.ParseKeyShareMnemonic(ask("Enter key share " + strconv.Itoa(len(shares)+1) + " of " + strconv.Itoa(share.Threshold) + ": "))
+			if err != nil {
+				panic(err)
+			}
+			shares = append(shares, share)
+		}
+		key, err := crypto.CombineKeyShares(shares)
+		if err != nil {
+			panic(err)
+		}
+		return key
+	}
+	return keyFromMnemonic(input)
+}
+
+func keyFromMnemonic(mnemonic string) []byte {
+	key, err := bip39.EntropyFromMnemonic(mnemonic)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// find the newest database backup in storage (as of timestamp, if it isn't 0), download it (and, if it's an incremental, the rest of its chain) into outDir, and restore it
+func RestoreDBFromStorageNonInteractive(stor storage_base.Storage, timestamp int64, outDir string, mnemonic string) {
+	restoreDBFromStorageImpl(stor, timestamp, outDir, keyFromMnemonic(mnemonic))
+}
+
+func restoreDBFromStorageImpl(stor storage_base.Storage, timestamp int64, outDir string, key []byte) {
+	backups := dbbackups.List(stor)
+	var chosen *dbbackups.DBBackup
+	for i := range backups {
+		if timestamp == 0 || backups[i].Timestamp <= timestamp {
+			chosen = &backups[i]
+		}
+	}
+	if chosen == nil {
+		dbbackups.PrintList(stor)
+		panic("no database backup to restore")
+	}
+	log.Println("Restoring", chosen.Filename, "from", stor, "taken at", chosen.Time())
+	chain := dbbackups.Chain(backups, *chosen)
+	if chain[0].Incremental() {
+		panic("the full backup that " + chosen.Filename + " is based on is missing from storage")
+	}
+	paths := make([]string, 0)
+	for _, backup := range chain {
+		paths = append(paths, filepath.Join(outDir, backup.Filename))
+		log.Println("Downloading", backup.Filename, utils.FormatCommas(backup.Size), "bytes")
+		reader := stor.DownloadSection(backup.Path, 0, backup.Size)
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			panic(err)
+		}
+		if int64(len(data)) != backup.Size {
+			panic("size mismatch")
+		}
+		if err := ioutil.WriteFile(filepath.Join(outDir, backup.Filename), data, 0644); err != nil {
+			panic(err)
+		}
+	}
+	// exactly this chain, regardless of whatever else might be sitting in outDir
+	restoreDBChain(paths[0], paths[1:], key, chosen.Legacy)
+}
+
+func RestoreDBNonInteractive(path string, incrementals bool, mnemonic string) {
+	restoreDBImpl(path, incrementals, keyFromMnemonic(mnemonic))
+}
+
+func restoreDBImpl(path string, incrementals bool, key []byte) {
 	var legacy bool
 	if strings.Contains(path, "db-backup-") {
 		legacy = true
@@ -34,26 +145,108 @@ func RestoreDBNonInteractive(path string, mnemonic string) {
 			panic("the path contained neither \"db-backup-\" nor \"db-v2backup-\" so I don't know which encryption scheme it used")
 		}
 	}
+	fullPath, chain := incrementalChain(path, incrementals)
+	restoreDBChain(fullPath, chain, key, legacy)
+}
+
+func restoreDBChain(fullPath string, incrementals []string, key []byte, legacy bool) {
+	outPath := fullPath + ".decrypted"
+	if len(incrementals) > 0 {
+		outPath = incrementals[len(incrementals)-1] + ".decrypted"
+	}
+	log.Println("Output will be written to", outPath)
 	log.Println("You may want to replace your database file with that, just ensure that any files such as", config.Config().DatabaseLocation+"-wal", "or", config.Config().DatabaseLocation+"-shm", "are gone first")
-	log.Println("Restoring a database backup from", path)
-	encBytes, err := ioutil.ReadFile(path)
+	log.Println("Restoring a database backup from", fullPath)
+	database := decryptDatabase(readBackupFile(fullPath), key, legacy)
+	if len(incrementals) > 0 {
+		database = applyIncrementals(database, fullPath, incrementals, key)
+	}
+	err := ioutil.WriteFile(outPath, database, 0644)
 	if err != nil {
 		panic(err)
 	}
-	log.Println("Read", len(encBytes), "bytes")
-	database := decryptDatabase(encBytes, mnemonic, legacy)
-	err = ioutil.WriteFile(outPath, database, 0644)
+	log.Println("Successfully decrypted, decompressed, and written", len(database), "bytes to", outPath)
+}
+
+// given either a full backup or an incremental, find the full backup it's based on, and the incrementals (in order) to replay on top of it
+// for an incremental, that's the ones up to and including itself. for a full backup, that's none, unless all, in which case it's every incremental next to it
+func incrementalChain(path string, all bool) (string, []string) {
+	fullPath := path
+	var upTo int64 = -1
+	if idx := strings.LastIndex(filepath.Base(path), "-incremental-"); idx != -1 {
+		fullPath = filepath.Join(filepath.Dir(path), filepath.Base(path)[:idx])
+		var err error
+		upTo, err = strconv.ParseInt(filepath.Base(path)[idx+len("-incremental-"):], 10, 64)
+		if err != nil {
+			panic(err)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Dir(fullPath))
 	if err != nil {
 		panic(err)
 	}
-	log.Println("Successfully decrypted, decompressed, and written", len(database), "bytes to", outPath)
+	prefix := filepath.Base(fullPath) + "-incremental-"
+	timestamps := make([]int64, 0)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		ts, err := strconv.ParseInt(strings.TrimPrefix(entry.Name(), prefix), 10, 64)
+		if err != nil {
+			continue // e.g. a previous .decrypted output
+		}
+		if upTo == -1 || ts <= upTo {
+			timestamps = append(timestamps, ts)
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	incrementals := make([]string, 0)
+	for _, ts := range timestamps {
+		incrementals = append(incrementals, fullPath+"-incremental-"+strconv.FormatInt(ts, 10))
+	}
+	if upTo != -1 && (len(timestamps) == 0 || timestamps[len(timestamps)-1] != upTo) {
+		panic("sanity check")
+	}
+	if upTo == -1 && !all {
+		if len(incrementals) > 0 {
+			log.Println("Restoring exactly", fullPath, "and ignoring the", len(incrementals), "incremental backups on top of it next to it. To apply them too, give the newest incremental instead, or --incrementals")
+		}
+		return fullPath, nil
+	}
+	return fullPath, incrementals
+}
+
+func applyIncrementals(database []byte, fullPath string, incrementals []string, key []byte) []byte {
+	full, err := strconv.ParseInt(fullPath[strings.LastIndex(fullPath, "-")+1:], 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	previous := full
+	for _, path := range incrementals {
+		log.Println("Applying incremental database backup", path)
+		delta := decryptDatabase(readBackupFile(path), key, false)
+		header := db.ReadDeltaHeader(delta)
+		if header.Full != full || header.Previous != previous {
+			log.Println("Expected an incremental on top of", previous, "in the chain starting at", full, "but", path, "is on top of", header.Previous, "in the chain starting at", header.Full)
+			panic("incremental database backup chain is broken. are you missing one of the incrementals?")
+		}
+		database = db.ApplyDelta(database, delta)
+		previous = header.Current
+	}
+	log.Println("Applied", len(incrementals), "incremental database backups")
+	return database
 }
 
-func decryptDatabase(encBytes []byte, keyMnemonic string, legacy bool) []byte {
-	key, err := bip39.EntropyFromMnemonic(keyMnemonic)
+func readBackupFile(path string) []byte {
+	encBytes, err := ioutil.ReadFile(path)
 	if err != nil {
 		panic(err)
 	}
+	log.Println("Read", len(encBytes), "bytes from", path)
+	return encBytes
+}
+
+func decryptDatabase(encBytes []byte, key []byte, legacy bool) []byte {
 	var compressed []byte
 	if legacy {
 		compressed = crypto.LegacyDecryptDatabase(encBytes, key)
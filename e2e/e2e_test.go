@@ -1,24 +1,38 @@
 package e2e
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/leijurv/gb/backup"
+	"github.com/leijurv/gb/compression"
 	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/contentindex"
 	"github.com/leijurv/gb/crypto"
 	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/dbbackups"
 	"github.com/leijurv/gb/download"
+	"github.com/leijurv/gb/history"
 	"github.com/leijurv/gb/paranoia"
 	"github.com/leijurv/gb/repack"
 	"github.com/leijurv/gb/share"
+	"github.com/leijurv/gb/stats"
 	"github.com/leijurv/gb/storage"
 	"github.com/leijurv/gb/storage_base"
 	bip39 "github.com/tyler-smith/go-bip39"
@@ -347,7 +361,7 @@ func TestBackupIntegrity(t *testing.T) {
 	if !panicked {
 		t.Error("expected restore to panic due to corrupted blob")
 	}
-	if panicMsg != "hash verification failed in download/cat" {
+	if msg, _ := panicMsg.(string); !strings.Contains(msg, "hash verification failed in download/cat") || strings.Contains(msg, "hash verification failed in restore") {
 		t.Error("the failed hash should have been caught by cat, rather than in restore", panicMsg)
 	}
 
@@ -379,7 +393,8 @@ func TestBackupIntegrity(t *testing.T) {
 	if !panicked {
 		t.Error("expected restore to panic due to corrupted local source (size and mtime matches, but hash is unexpected)")
 	}
-	if panicMsg != "hash verification failed in restore" {
+	// and then it falls back to storage, which is still corrupted
+	if msg, _ := panicMsg.(string); !strings.Contains(msg, "hash verification failed in restore, then hash verification failed in download/cat") {
 		t.Error("unexpected:", panicMsg)
 	}
 
@@ -456,7 +471,7 @@ func TestRestoreDB(t *testing.T) {
 	}
 
 	// Call RestoreDBNonInteractive
-	download.RestoreDBNonInteractive(encryptedPath, mnemonic)
+	download.RestoreDBNonInteractive(encryptedPath, false, mnemonic)
 
 	// Read the decrypted output
 	decryptedPath := encryptedPath + ".decrypted"
@@ -471,6 +486,553 @@ func TestRestoreDB(t *testing.T) {
 	}
 }
 
+func TestIncrementalRestoreDB(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gb-e2e-incremental-db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "source")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mockStor := setupDB(t, tmpDir)
+	defer db.ShutdownDatabase()
+	config.SetDBBackupMaxIncrementals(5)
+	defer config.SetDBBackupMaxIncrementals(0)
+
+	dbKey := backup.DBKeyNonInteractive()
+	mnemonic, err := bip39.NewMnemonic(dbKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := config.Config().DatabaseLocation
+
+	// one full backup, then two incrementals on top of it
+	snapshots := make([][]byte, 0)
+	timestamps := make([]int64, 0)
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			db.SetupDatabase()
+		}
+		if err := os.WriteFile(filepath.Join(srcDir, "file"+strconv.Itoa(i)+".txt"), makeBinaryData(100+i), 0644); err != nil {
+			t.Fatal(err)
+		}
+		backup.BackupNonInteractive([]string{srcDir})
+		backup.BackupDB()
+		snapshot, err := os.ReadFile(dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, snapshot)
+		timestamps = append(timestamps, backup.GetLastSessionTimestamp())
+	}
+	db.SetupDatabase()
+
+	fullName := "db-v2backup-" + strconv.FormatInt(timestamps[0], 10)
+	names := []string{
+		fullName,
+		fullName + "-incremental-" + strconv.FormatInt(timestamps[1], 10),
+		fullName + "-incremental-" + strconv.FormatInt(timestamps[2], 10),
+	}
+	if len(mockStor.ListPrefix("db-v2backup-")) != len(names) {
+		t.Fatalf("expected %d database backups in storage, got %d", len(names), len(mockStor.ListPrefix("db-v2backup-")))
+	}
+	restoreDir := filepath.Join(tmpDir, "restoredb")
+	if err := os.MkdirAll(restoreDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		_, size := mockStor.Metadata(name)
+		if size == 0 {
+			t.Fatalf("%s not found in storage", name)
+		}
+		reader := mockStor.DownloadSection(name, 0, size)
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(restoreDir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// restoring the full backup restores just that, even with incrementals next to it
+	download.RestoreDBNonInteractive(filepath.Join(restoreDir, names[0]), false, mnemonic)
+	restored, err := os.ReadFile(filepath.Join(restoreDir, names[0]) + ".decrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, snapshots[0]) {
+		t.Errorf("database mismatch restoring just the full backup")
+	}
+	if _, err := os.Stat(filepath.Join(restoreDir, names[2]) + ".decrypted"); !os.IsNotExist(err) {
+		t.Errorf("incrementals shouldn't have been applied without asking")
+	}
+
+	// unless asked to replay every incremental next to it
+	download.RestoreDBNonInteractive(filepath.Join(restoreDir, names[0]), true, mnemonic)
+	restored, err = os.ReadFile(filepath.Join(restoreDir, names[2]) + ".decrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, snapshots[2]) {
+		t.Errorf("database mismatch after replaying the whole chain")
+	}
+
+	// restoring an incremental replays the chain only up to that point
+	download.RestoreDBNonInteractive(filepath.Join(restoreDir, names[1]), false, mnemonic)
+	restored, err = os.ReadFile(filepath.Join(restoreDir, names[1]) + ".decrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, snapshots[1]) {
+		t.Errorf("database mismatch after replaying part of the chain")
+	}
+
+	// or straight from storage, newest by default, or as of a timestamp
+	for i, timestamp := range []int64{0, timestamps[1], timestamps[0]} {
+		outDir := filepath.Join(tmpDir, "fromstorage"+strconv.Itoa(i))
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		download.RestoreDBFromStorageNonInteractive(mockStor, timestamp, outDir, mnemonic)
+		expected := 2 - i
+		restored, err = os.ReadFile(filepath.Join(outDir, names[expected]) + ".decrypted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(restored, snapshots[expected]) {
+			t.Errorf("database mismatch restoring from storage as of %d", timestamp)
+		}
+	}
+
+	// a gap in the chain must be detected, not silently skipped
+	if err := os.Remove(filepath.Join(restoreDir, names[1])); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic when an incremental is missing from the chain")
+			}
+		}()
+		download.RestoreDBNonInteractive(filepath.Join(restoreDir, names[2]), false, mnemonic)
+	}()
+}
+
+func TestRotateDBKey(t *testing.T) {
+	env := setupTestEnv(t, "rotate-db-key")
+	defer env.cleanup()
+
+	env.writeFile("shared.bin", makeBinaryData(500))
+	env.backup()
+	password := share.PasswordUrlShareNonInteractive([]string{filepath.Join(env.srcDir, "shared.bin")}, "", 0, env.mockStor)
+	backup.BackupDB()
+	db.SetupDatabase()
+	if len(env.mockStor.ListPrefix("db-v2backup-")) != 1 {
+		t.Fatal("expected one database backup before rotation")
+	}
+
+	oldKey, newKey := backup.RotateDBKeyNonInteractive()
+	if bytes.Equal(oldKey, newKey) || !bytes.Equal(backup.DBKeyNonInteractive(), newKey) {
+		t.Fatal("key was not rotated")
+	}
+	share.RekeyShares(oldKey)
+	timestamp := backup.ReserveSessionTimestamp()
+	backup.BackupDB()
+	db.SetupDatabase()
+	dbbackups.DeleteBefore(env.mockStor, timestamp, newKey)
+
+	// only the fresh backup is left, and it's under the new key
+	remaining := dbbackups.List(env.mockStor)
+	if len(remaining) != 1 || remaining[0].Timestamp != timestamp || remaining[0].Incremental() {
+		t.Fatalf("expected only the fresh full backup to remain, got %+v", remaining)
+	}
+	if dbbackups.Verify(env.mockStor, remaining[0], oldKey) || !dbbackups.Verify(env.mockStor, remaining[0], newKey) {
+		t.Error("fresh database backup is not encrypted with the new key")
+	}
+	mnemonic, err := bip39.NewMnemonic(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	download.RestoreDBFromStorageNonInteractive(env.mockStor, 0, env.tmpDir, mnemonic)
+
+	// the share JSON was re-uploaded under the new master key
+	shareFiles := env.mockStor.ListPrefix("share/" + share.DeriveShareFilename(password))
+	if len(shareFiles) != 1 {
+		t.Fatalf("expected the share JSON under the new master key, got %d", len(shareFiles))
+	}
+	reader := env.mockStor.DownloadSection(shareFiles[0].Path, 0, shareFiles[0].Size)
+	encrypted, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := share.DecryptShareJSON(encrypted, password); err != nil {
+		t.Errorf("share JSON does not decrypt under the new master key: %v", err)
+	}
+	paranoia.DBParanoia()
+}
+
+func TestDBKeyFromRecovery(t *testing.T) {
+	key := crypto.RandBytes(16)
+	answers := func(inputs ...string) func(string) string {
+		return func(prompt string) string {
+			if len(inputs) == 0 {
+				t.Fatalf("asked for more input than expected: %s", prompt)
+			}
+			next := inputs[0]
+			inputs = inputs[1:]
+			return next + "\n"
+		}
+	}
+
+	mnemonic, err := bip39.NewMnemonic(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(download.DBKeyFromRecovery("", answers(mnemonic)), key) {
+		t.Error("plain mnemonic")
+	}
+
+	wrapped := crypto.WrapKeyWithPassphrase(key, "correct horse battery staple")
+	if !bytes.Equal(download.DBKeyFromRecovery("", answers(wrapped, "correct horse battery staple")), key) {
+		t.Error("passphrase protected key")
+	}
+
+	shares := crypto.SplitKeyMnemonics(key, 3, 5)
+	if !bytes.Equal(download.DBKeyFromRecovery("", answers(shares[4], shares[1], shares[2])), key) {
+		t.Error("key shares")
+	}
+}
+
+func TestWriteOnlyBackup(t *testing.T) {
+	env := setupTestEnv(t, "write-only")
+	defer env.cleanup()
+	defer config.SetKeyPair("", "")
+
+	before := makeBinaryData(300)
+	env.writeFile("before.bin", before)
+	env.backup()
+
+	privateKeyFile := filepath.Join(env.tmpDir, "gb.key")
+	backup.GenerateKeyPair(privateKeyFile)
+	data, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := crypto.ParsePrivateKey(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a backup host only has the public key
+	config.SetKeyPair(hex.EncodeToString(priv.PublicKey().Bytes()), "")
+
+	after := makeBinaryData(400)
+	after[0] = 1
+	env.writeFile("after.bin", after)
+	env.writeFile("after-copy.bin", after) // still dedups without being able to read anything
+	env.backup()
+
+	countKeys := func() (int, int) {
+		var plain, sealed int
+		if err := db.DB.QueryRow("SELECT COUNT(encryption_key), COUNT(sealed_key) FROM blob_entries").Scan(&plain, &sealed); err != nil {
+			t.Fatal(err)
+		}
+		return plain, sealed
+	}
+	if plain, sealed := countKeys(); plain != 1 || sealed != 1 {
+		t.Fatalf("expected 1 plaintext and 1 sealed key, got %d and %d", plain, sealed)
+	}
+
+	afterHash := sha256.Sum256(after)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("reading a sealed entry without the private key should fail")
+			}
+		}()
+		download.CatEz(afterHash[:], env.mockStor)
+	}()
+
+	backup.SealExistingKeys()
+	if plain, sealed := countKeys(); plain != 0 || sealed != 2 {
+		t.Fatalf("expected every key to be sealed, got %d plaintext and %d sealed", plain, sealed)
+	}
+	paranoia.DBParanoia()
+
+	// restore host has the private key
+	config.SetKeyPair("", privateKeyFile)
+	env.removeFile("before.bin")
+	env.removeFile("after.bin")
+	env.removeFile("after-copy.bin")
+	env.restore()
+	env.verifyRestored("before.bin", sha256.Sum256(before))
+	env.verifyRestored("after.bin", afterHash)
+	env.verifyRestored("after-copy.bin", afterHash)
+	paranoia.BlobParanoia("")
+}
+
+func TestAuthenticatedBlobEncryption(t *testing.T) {
+	env := setupTestEnv(t, "blob-encryption")
+	defer env.cleanup()
+	defer config.SetBlobEncryption(crypto.BlobEncryptionCTR)
+
+	old := makeBinaryData(700)
+	old[0] = 2
+	env.writeFile("old.zip", old)
+	env.backup()
+
+	config.SetBlobEncryption(crypto.BlobEncryptionChunkedGCM)
+	big := crypto.RandBytes(3*crypto.ChunkedGCMChunkSize + 5) // .zip so it isn't compressed, and it gets a blob of its own
+	env.writeFile("big.zip", big)
+	env.writeFile("small.txt", []byte("small and compressible small and compressible small and compressible"))
+	env.writeFile("empty.txt", []byte{})
+	env.backup()
+
+	encryptionOf := func(content []byte) string {
+		hash := sha256.Sum256(content)
+		var encryption string
+		if err := db.DB.QueryRow("SELECT encryption_alg FROM blob_entries WHERE hash = ?", hash[:]).Scan(&encryption); err != nil {
+			t.Fatal(err)
+		}
+		return encryption
+	}
+	if encryptionOf(old) != crypto.BlobEncryptionCTR || encryptionOf(big) != crypto.BlobEncryptionChunkedGCM || encryptionOf([]byte{}) != crypto.BlobEncryptionChunkedGCM {
+		t.Fatal("wrong encryption_alg")
+	}
+
+	for _, name := range []string{"old.zip", "big.zip", "small.txt", "empty.txt"} {
+		env.removeFile(name)
+	}
+	env.restore()
+	env.verifyRestored("old.zip", sha256.Sum256(old))
+	env.verifyRestored("big.zip", sha256.Sum256(big))
+	env.verifyRestored("empty.txt", sha256.Sum256([]byte{}))
+	paranoia.BlobParanoia("")
+
+	// anything not yet aes-gcm-chunked gets repacked
+	repack.Repack("", repack.UpgradeEncryption)
+	db.SetupDatabase()
+	if encryptionOf(old) != crypto.BlobEncryptionChunkedGCM {
+		t.Error("upgrade-encryption should have repacked the AES-CTR entry")
+	}
+	oldHash := sha256.Sum256(old)
+	if restored, err := io.ReadAll(download.CatEz(oldHash[:], env.mockStor)); err != nil || !bytes.Equal(restored, old) {
+		t.Errorf("repacked entry doesn't read back: %v", err)
+	}
+
+	// flip a byte in the second chunk: caught by the MAC, before anything reaches the hash check
+	bigHash := sha256.Sum256(big)
+	var blobID []byte
+	var offset int64
+	if err := db.DB.QueryRow("SELECT blob_id, offset FROM blob_entries WHERE hash = ?", bigHash[:]).Scan(&blobID, &offset); err != nil {
+		t.Fatal(err)
+	}
+	env.mockStor.CorruptByte(blobID, int(offset)+crypto.ChunkedGCMChunkSize+100)
+	if _, err := io.ReadAll(download.CatEz(bigHash[:], env.mockStor)); err != crypto.ErrBlobEntryTampered {
+		t.Errorf("expected the tampering to be detected, got %v", err)
+	}
+}
+
+func TestCompressionRules(t *testing.T) {
+	env := setupTestEnv(t, "compression-rules")
+	defer env.cleanup()
+	config.SetCompressionRules([]config.CompressionRule{
+		{Extension: "txt", Algorithm: "xz"},
+		{Extension: "log", Algorithm: "brotli"},
+		{Extension: "csv", Algorithm: "lz4"},
+	})
+	defer config.SetCompressionRules(nil)
+
+	files := map[string]string{
+		"a.txt":  "xz",
+		"b.log":  "brotli",
+		"c.csv":  "lz4",
+		"d.json": "zstd",
+	}
+	contents := make(map[string][]byte)
+	for name := range files {
+		contents[name] = bytes.Repeat([]byte(name+" is quite compressible "), 300)
+		env.writeFile(name, contents[name])
+	}
+	env.backup()
+
+	for name, expected := range files {
+		hash := sha256.Sum256(contents[name])
+		var compressionAlg string
+		if err := db.DB.QueryRow("SELECT compression_alg FROM blob_entries WHERE hash = ?", hash[:]).Scan(&compressionAlg); err != nil {
+			t.Fatal(err)
+		}
+		if compressionAlg != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, compressionAlg)
+		}
+		env.removeFile(name)
+	}
+	env.restore()
+	for name := range files {
+		env.verifyRestored(name, sha256.Sum256(contents[name]))
+	}
+	paranoia.BlobParanoia("")
+}
+
+func TestZstdDictionary(t *testing.T) {
+	env := setupTestEnv(t, "zstd-dict")
+	defer env.cleanup()
+
+	record := func(i int) []byte {
+		var buf bytes.Buffer
+		for j := 0; j < 20; j++ {
+			fmt.Fprintf(&buf, `{"id": %d, "name": "record number %d", "tags": ["alpha", "beta", "gamma"], "enabled": %t, "owner": {"team": "storage", "oncall": false}}`+"\n", i*100+j, j, j%2 == 0)
+		}
+		return buf.Bytes()
+	}
+	for i := 0; i < 200; i++ {
+		env.writeFile(fmt.Sprintf("old/%d.json", i), record(i))
+	}
+	env.backup()
+
+	backup.DBKeyNonInteractive() // so that train-dict doesn't ask to confirm the mnemonic
+	backup.TrainZstdDict("json", 1000)
+	if len(env.mockStor.ListPrefix("zstd-dict-")) != 1 {
+		t.Error("the dictionary should have been uploaded to storage")
+	}
+
+	fresh := record(1000)
+	env.writeFile("new.json", fresh)
+	other := bytes.Repeat([]byte("not json "), 200)
+	env.writeFile("other.txt", other)
+	env.backup()
+
+	compressionOf := func(content []byte) string {
+		hash := sha256.Sum256(content)
+		var compressionAlg string
+		if err := db.DB.QueryRow("SELECT compression_alg FROM blob_entries WHERE hash = ?", hash[:]).Scan(&compressionAlg); err != nil {
+			t.Fatal(err)
+		}
+		return compressionAlg
+	}
+	if compressionOf(fresh) != "zstd-dict-1" {
+		t.Errorf("expected the new json file to use the dictionary, got %s", compressionOf(fresh))
+	}
+	if compressionOf(other) != "zstd" {
+		t.Errorf("the dictionary is only for json files, got %s", compressionOf(other))
+	}
+
+	env.removeFile("new.json")
+	env.restore()
+	env.verifyRestored("new.json", sha256.Sum256(fresh))
+	paranoia.BlobParanoia("")
+}
+
+func TestRecompress(t *testing.T) {
+	env := setupTestEnv(t, "recompress")
+	defer env.cleanup()
+
+	files := map[string][]byte{
+		"a/large.txt":  bytes.Repeat([]byte("large and compressible "), 500),
+		"a/small.txt":  bytes.Repeat([]byte("small "), 300),
+		"b/other.txt":  bytes.Repeat([]byte("other "), 300),
+		"a/random.bin": crypto.RandBytes(2000),
+	}
+	for name, content := range files {
+		env.writeFile(name, content)
+	}
+	env.backup()
+
+	compressionOf := func(content []byte) string {
+		hash := sha256.Sum256(content)
+		var compressionAlg string
+		if err := db.DB.QueryRow("SELECT compression_alg FROM blob_entries WHERE hash = ?", hash[:]).Scan(&compressionAlg); err != nil {
+			t.Fatal(err)
+		}
+		return compressionAlg
+	}
+	var oldPaths []string
+	rows, err := db.DB.Query("SELECT path FROM blob_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var path string
+		rows.Scan(&path)
+		oldPaths = append(oldPaths, path)
+	}
+	rows.Close()
+
+	// sampling would say the random file isn't worth compressing, but xz was asked for explicitly
+	config.SetCompressionSampling(true)
+	repack.Recompress("", "zstd", "xz", filepath.Join(env.srcDir, "a")+"/")
+	config.SetCompressionSampling(false)
+	db.SetupDatabase()
+
+	if compressionOf(files["a/large.txt"]) != "xz" || compressionOf(files["a/small.txt"]) != "xz" || compressionOf(files["a/random.bin"]) != "xz" {
+		t.Error("files under the prefix should have been recompressed with xz")
+	}
+	if compressionOf(files["b/other.txt"]) != "zstd" {
+		t.Error("files outside the prefix should have been left alone")
+	}
+	remaining := make(map[string]bool)
+	for _, blob := range env.mockStor.ListBlobs() {
+		remaining[blob.Path] = true
+	}
+	for _, path := range oldPaths {
+		var stillUsed bool
+		if err := db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM blob_storage WHERE path = ?)", path).Scan(&stillUsed); err != nil {
+			t.Fatal(err)
+		}
+		if remaining[path] != stillUsed {
+			t.Errorf("old blob %s should have been deleted from storage exactly when it's no longer used", path)
+		}
+	}
+	paranoia.DBParanoia()
+
+	for name := range files {
+		env.removeFile(name)
+	}
+	env.restore()
+	for name, content := range files {
+		env.verifyRestored(name, sha256.Sum256(content))
+	}
+}
+
+func TestCompressionSamplingRecorded(t *testing.T) {
+	env := setupTestEnv(t, "sampling-recorded")
+	defer env.cleanup()
+
+	files := map[string][]byte{
+		"random.bin": crypto.RandBytes(5000),
+		"text.mp4":   bytes.Repeat([]byte("not really a video "), 500),
+		"text.txt":   bytes.Repeat([]byte("just some text "), 500),
+	}
+	for name, content := range files {
+		env.writeFile(name, content)
+	}
+	config.SetCompressionSampling(true)
+	env.backup()
+	config.SetCompressionSampling(false)
+
+	for name, expected := range map[string]string{"random.bin": compression.SampledSkipped, "text.mp4": compression.SampledCompressed, "text.txt": ""} {
+		hash := sha256.Sum256(files[name])
+		var sampled string
+		if err := db.DB.QueryRow("SELECT sampled FROM blob_entries WHERE hash = ?", hash[:]).Scan(&sampled); err != nil {
+			t.Fatal(err)
+		}
+		if sampled != expected {
+			t.Errorf("%s: expected sampled %q, got %q", name, expected, sampled)
+		}
+	}
+	// sampling is off now, but what it did then is still what's reported
+	out := string(captureStdout(t, stats.ShowStats))
+	if !strings.Contains(out, "Sampling overruled the extension list for 2 files: 1 compressed despite no_compression_exts, 1 (") {
+		t.Errorf("stats should report what sampling did, got:\n%s", out)
+	}
+}
+
 func TestRepackSharedFile(t *testing.T) {
 	env := setupTestEnv(t, "repack-share")
 	defer env.cleanup()
@@ -556,3 +1118,830 @@ func TestRepackSharedFile(t *testing.T) {
 	env.restore()
 	env.verifyRestored("shared.bin", sha256.Sum256(content))
 }
+
+func TestRestoreArchive(t *testing.T) {
+	env := setupTestEnv(t, "restore-archive")
+	defer env.cleanup()
+
+	testFiles := map[string][]byte{
+		"a.txt":            []byte("hello world"),
+		"sub/b.bin":        makeBinaryData(10000),
+		"sub/deeper/c.txt": bytes.Repeat([]byte("compressible "), 500),
+		"sub/dup.txt":      []byte("hello world"),
+	}
+	for name, content := range testFiles {
+		env.writeFile(name, content)
+	}
+	if err := os.Chmod(filepath.Join(env.srcDir, "sub/b.bin"), 0751); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1600000000, 0)
+	if err := os.Chtimes(filepath.Join(env.srcDir, "a.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	env.backup()
+	timestamp := backup.GetLastSessionTimestamp()
+
+	check := func(name string, content []byte, mode os.FileMode, modTime time.Time) {
+		expected, ok := testFiles[name]
+		if !ok {
+			t.Errorf("unexpected %s in archive", name)
+			return
+		}
+		if !bytes.Equal(content, expected) {
+			t.Errorf("wrong contents for %s", name)
+		}
+		if name == "sub/b.bin" && mode.Perm() != 0751 {
+			t.Errorf("expected 0751 for %s, got %v", name, mode.Perm())
+		}
+		if name == "a.txt" && !modTime.Equal(mtime) {
+			t.Errorf("expected mtime %v for %s, got %v", mtime, name, modTime)
+		}
+	}
+
+	tarPath := filepath.Join(env.tmpDir, "out.tar")
+	download.RestoreArchive(env.srcDir, "tar", tarPath, timestamp, download.RestoreFilter{}, env.mockStor)
+	f, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	count := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(header.Name, content, header.FileInfo().Mode(), header.ModTime)
+		count++
+	}
+	if count != len(testFiles) {
+		t.Errorf("expected %d files in the tar, got %d", len(testFiles), count)
+	}
+
+	zipPath := filepath.Join(env.tmpDir, "out.zip")
+	download.RestoreArchive(env.srcDir, "zip", zipPath, timestamp, download.RestoreFilter{}, env.mockStor)
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if len(zr.File) != len(testFiles) {
+		t.Errorf("expected %d files in the zip, got %d", len(testFiles), len(zr.File))
+	}
+	for _, file := range zr.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(file.Name, content, file.Mode(), file.Modified)
+	}
+
+	// a single file is just that one file
+	singlePath := filepath.Join(env.tmpDir, "single.tar")
+	download.RestoreArchive(filepath.Join(env.srcDir, "sub/deeper/c.txt"), "tar", singlePath, timestamp, download.RestoreFilter{}, env.mockStor)
+	f2, err := os.Open(singlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	header, err := tar.NewReader(f2).Next()
+	if err != nil || header.Name != "c.txt" {
+		t.Errorf("expected c.txt, got %v %v", header, err)
+	}
+}
+
+func TestRestoreFallsBackToAnotherStorage(t *testing.T) {
+	env := setupTestEnv(t, "restore-fallback")
+	defer env.cleanup()
+	backupStor := storage_base.NewMockStorage(crypto.RandBytes(32))
+	storage.RegisterMockStorage(backupStor, "backup-storage")
+
+	testFiles := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		testFiles[fmt.Sprintf("file%d.zip", i)] = makeBinaryData(200 + i) // small enough that several share a blob
+	}
+	for name, content := range testFiles {
+		env.writeFile(name, content)
+	}
+	env.backup()
+
+	removeAll := func() {
+		for name := range testFiles {
+			env.removeFile(name)
+			if err := os.RemoveAll(filepath.Join(env.restoreDir, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	verifyAll := func() {
+		for name, content := range testFiles {
+			env.verifyRestored(name, sha256.Sum256(content))
+		}
+	}
+
+	// one entry in the middle of the blob is corrupted, so just that one comes from the other storage
+	corrupted := sha256.Sum256(testFiles["file5.zip"])
+	var blobID []byte
+	var offset int64
+	if err := db.DB.QueryRow("SELECT blob_id, offset FROM blob_entries WHERE hash = ?", corrupted[:]).Scan(&blobID, &offset); err != nil {
+		t.Fatal(err)
+	}
+	env.mockStor.CorruptByte(blobID, int(offset)+10)
+	removeAll()
+	env.restore()
+	verifyAll()
+
+	// and the whole blob missing from the preferred storage is fine too
+	var path string
+	if err := db.DB.QueryRow("SELECT path FROM blob_storage WHERE blob_id = ? AND storage_id = ?", blobID, env.mockStor.GetID()).Scan(&path); err != nil {
+		t.Fatal(err)
+	}
+	env.mockStor.DeleteBlob(path)
+	for name := range testFiles {
+		if err := os.Remove(filepath.Join(env.restoreDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env.restore()
+	verifyAll()
+
+	// but if it's gone everywhere, the restore fails, though only after everything else is restored
+	var inBlob int
+	if err := db.DB.QueryRow("SELECT COUNT(*) FROM blob_entries WHERE blob_id = ?", blobID).Scan(&inBlob); err != nil {
+		t.Fatal(err)
+	}
+	if inBlob < 2 {
+		t.Fatal("expected the corrupted entry to share its blob with others")
+	}
+	backupStor.DeleteBlob(path)
+	for name := range testFiles {
+		if err := os.Remove(filepath.Join(env.restoreDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected restore to fail when the blob is in no storage")
+			}
+		}()
+		env.restore()
+	}()
+	if entries, err := os.ReadDir(env.restoreDir); err != nil || len(entries) != len(testFiles)-inBlob {
+		t.Errorf("expected %d restored files, got %d", len(testFiles)-inBlob, len(entries))
+	}
+}
+
+func TestResumeRestore(t *testing.T) {
+	env := setupTestEnv(t, "resume-restore")
+	defer env.cleanup()
+
+	testFiles := make(map[string][]byte)
+	for i := 0; i < 6; i++ {
+		testFiles[fmt.Sprintf("dir%d/file.zip", i)] = makeBinaryData(2000 + i) // big enough that each is in its own blob
+	}
+	for name, content := range testFiles {
+		env.writeFile(name, content)
+	}
+	env.backup()
+	timestamp := backup.GetLastSessionTimestamp()
+	for name := range testFiles {
+		env.removeFile(name)
+	}
+
+	blobOf := func(name string) []byte {
+		hash := sha256.Sum256(testFiles[name])
+		var blobID []byte
+		if err := db.DB.QueryRow("SELECT blob_id FROM blob_entries WHERE hash = ?", hash[:]).Scan(&blobID); err != nil {
+			t.Fatal(err)
+		}
+		return blobID
+	}
+	interrupted := "dir3/file.zip"
+	env.mockStor.CorruptByte(blobOf(interrupted), 0)
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected restore to fail")
+			}
+		}()
+		download.RestoreNonInteractive(env.srcDir, env.restoreDir, timestamp, env.mockStor)
+	}()
+	states, _ := filepath.Glob(config.Config().DatabaseLocation + "-restorestate-*")
+	if len(states) != 1 {
+		t.Fatalf("expected a restore state file, got %v", states)
+	}
+
+	// resuming only needs the one that didn't finish, so the rest can be gone from storage entirely
+	env.mockStor.CorruptByte(blobOf(interrupted), 0)
+	for name := range testFiles {
+		if name != interrupted {
+			var path string
+			if err := db.DB.QueryRow("SELECT path FROM blob_storage WHERE blob_id = ?", blobOf(name)).Scan(&path); err != nil {
+				t.Fatal(err)
+			}
+			env.mockStor.DeleteBlob(path)
+		}
+	}
+	download.RestoreWithOptionsNonInteractive(env.srcDir, env.restoreDir, 0, download.RestoreOptions{Resume: true}, env.mockStor)
+	for name, content := range testFiles {
+		env.verifyRestored(name, sha256.Sum256(content))
+	}
+	states, _ = filepath.Glob(config.Config().DatabaseLocation + "-restorestate-*")
+	if len(states) != 0 {
+		t.Errorf("the restore state should be deleted once it's done, got %v", states)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected resuming a finished restore to fail")
+			}
+		}()
+		download.RestoreWithOptionsNonInteractive(env.srcDir, env.restoreDir, 0, download.RestoreOptions{Resume: true}, env.mockStor)
+	}()
+}
+
+func TestRestoreFilters(t *testing.T) {
+	env := setupTestEnv(t, "restore-filters")
+	defer env.cleanup()
+
+	testFiles := map[string][]byte{
+		"a.txt":                 []byte("hello world"),
+		"big.bin":               makeBinaryData(10000),
+		"sub/b.txt":             []byte("bbb"),
+		"sub/deeper/c.jpg":      []byte("not really a jpg"),
+		"node_modules/x.js":     []byte("x"),
+		"sub/node_modules/y.js": []byte("y"),
+	}
+	for name, content := range testFiles {
+		env.writeFile(name, content)
+	}
+	mtime := time.Unix(1600000000, 0)
+	if err := os.Chtimes(filepath.Join(env.srcDir, "a.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	env.backup()
+	timestamp := backup.GetLastSessionTimestamp()
+
+	cases := []struct {
+		filter   download.RestoreFilter
+		expected []string
+	}{
+		{download.RestoreFilter{Include: []string{"*.txt"}}, []string{"a.txt", "sub/b.txt"}},
+		{download.RestoreFilter{Exclude: []string{"node_modules"}}, []string{"a.txt", "big.bin", "sub/b.txt", "sub/deeper/c.jpg"}},
+		{download.RestoreFilter{Include: []string{"sub/*"}}, []string{"sub/b.txt", "sub/deeper/c.jpg", "sub/node_modules/y.js"}},
+		{download.RestoreFilter{Include: []string{"*.js"}, Exclude: []string{"sub"}}, []string{"node_modules/x.js"}},
+		{download.RestoreFilter{IncludeRegex: []string{`\.jpg$`}}, []string{"sub/deeper/c.jpg"}},
+		{download.RestoreFilter{ExcludeRegex: []string{`/sub/`}}, []string{"a.txt", "big.bin", "node_modules/x.js"}},
+		{download.RestoreFilter{LargerThan: 5000}, []string{"big.bin"}},
+		{download.RestoreFilter{NewerThan: mtime.Unix(), Include: []string{"*.txt"}}, []string{"sub/b.txt"}},
+	}
+	for i, c := range cases {
+		dest := filepath.Join(env.tmpDir, fmt.Sprint("filtered", i))
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			t.Fatal(err)
+		}
+		download.RestoreWithOptionsNonInteractive(env.srcDir, dest, timestamp, download.RestoreOptions{Filter: c.filter}, env.mockStor)
+		var restored []string
+		err := filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				rel, _ := filepath.Rel(dest, path)
+				restored = append(restored, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(restored)
+		if !reflect.DeepEqual(restored, c.expected) {
+			t.Errorf("filter %+v restored %v, expected %v", c.filter, restored, c.expected)
+		}
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected a filter that matches nothing to fail")
+			}
+		}()
+		download.RestoreWithOptionsNonInteractive(env.srcDir, env.restoreDir, timestamp, download.RestoreOptions{Filter: download.RestoreFilter{Include: []string{"*.psd"}}}, env.mockStor)
+	}()
+}
+
+func TestRestoreDeletedSince(t *testing.T) {
+	env := setupTestEnv(t, "restore-deleted")
+	defer env.cleanup()
+
+	original := map[string][]byte{
+		"kept.txt":             []byte("kept"),
+		"edited.txt":           []byte("edited, before"),
+		"deleted-long-ago.txt": []byte("deleted long ago"),
+		"deleted.txt":          []byte("deleted"),
+		"sub/x.txt":            []byte("x"),
+		"sub/y.txt":            []byte("y"),
+		"edited-then-deleted":  []byte("edited then deleted, before"),
+		"back-again.txt":       []byte("back again, before"),
+	}
+	for name, content := range original {
+		env.writeFile(name, content)
+	}
+	env.backup()
+	env.removeFile("deleted-long-ago.txt")
+	env.backup()
+	since := backup.GetLastSessionTimestamp()
+	time.Sleep(1100 * time.Millisecond) // so that everything after this ends strictly after since
+
+	env.writeFile("edited.txt", []byte("edited, after"))
+	env.writeFile("edited-then-deleted", []byte("edited then deleted, after"))
+	env.backup()
+	env.removeFile("edited-then-deleted")
+	env.removeFile("deleted.txt")
+	env.removeFile("back-again.txt")
+	if err := os.RemoveAll(filepath.Join(env.srcDir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	env.backup()
+	// put back after the last backup, so the database still thinks it's gone
+	env.writeFile("back-again.txt", []byte("back again, after"))
+
+	download.RestoreWithOptionsNonInteractive(env.srcDir, "", 0, download.RestoreOptions{DeletedSince: since}, env.mockStor)
+
+	expected := map[string][]byte{
+		"kept.txt":            []byte("kept"),
+		"edited.txt":          []byte("edited, after"),
+		"deleted.txt":         []byte("deleted"),
+		"sub/x.txt":           []byte("x"),
+		"sub/y.txt":           []byte("y"),
+		"edited-then-deleted": []byte("edited then deleted, after"),
+		"back-again.txt":      []byte("back again, after"),
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(filepath.Join(env.srcDir, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(data, content) {
+			t.Errorf("%s: expected %q, got %q", name, content, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(env.srcDir, "deleted-long-ago.txt")); !os.IsNotExist(err) {
+		t.Error("a file deleted before --deleted-since should not be restored")
+	}
+}
+
+func TestRestoreDryRun(t *testing.T) {
+	env := setupTestEnv(t, "restore-dry-run")
+	defer env.cleanup()
+
+	testFiles := map[string][]byte{
+		"same.txt":      []byte("already in place"),
+		"different.txt": []byte("will be overwritten"),
+		"sub/gone.bin":  makeBinaryData(5000),
+		"sub/copy.txt":  []byte("already in place"),
+	}
+	for name, content := range testFiles {
+		env.writeFile(name, content)
+	}
+	env.backup()
+	env.removeFile("sub/gone.bin")
+	env.removeFile("sub/copy.txt")
+	env.writeFile("different.txt", []byte("something else"))
+
+	data := captureStdout(t, func() {
+		download.RestoreWithOptionsNonInteractive(env.srcDir, "", backup.GetLastSessionTimestamp(), download.RestoreOptions{DryRun: true, JSON: true}, env.mockStor)
+	})
+	var plan struct {
+		Restorations []struct {
+			Hash         string
+			Destinations []struct {
+				Path      string
+				Overwrite bool
+			}
+			LocalSource   string `json:"local_source"`
+			StorageSource *struct {
+				Storage string
+			} `json:"storage_source"`
+		}
+		Skipped []struct {
+			Path string
+		}
+		Downloads              []struct{ Hashes []string }
+		WriteCount             int              `json:"write_count"`
+		OverwriteCount         int              `json:"overwrite_count"`
+		SkippedCount           int              `json:"skipped_count"`
+		DownloadBytesByStorage map[string]int64 `json:"download_bytes_by_storage"`
+	}
+	if err := json.Unmarshal(data, &plan); err != nil {
+		t.Fatalf("%v: %s", err, data)
+	}
+	if plan.WriteCount != 2 || plan.OverwriteCount != 1 || plan.SkippedCount != 1 || plan.Skipped[0].Path != filepath.Join(env.srcDir, "same.txt") {
+		t.Errorf("expected 2 writes, 1 overwrite and same.txt skipped, got %s", data)
+	}
+	if len(plan.Restorations) != 3 || len(plan.Downloads) != 2 || plan.DownloadBytesByStorage["test-storage"] == 0 {
+		t.Fatalf("unexpected plan %s", data)
+	}
+	for _, r := range plan.Restorations {
+		if len(r.Destinations) != 1 {
+			t.Fatalf("unexpected plan %s", data)
+		}
+		switch filepath.Base(r.Destinations[0].Path) {
+		case "different.txt":
+			if !r.Destinations[0].Overwrite || r.StorageSource == nil {
+				t.Errorf("different.txt should be overwritten from storage, got %s", data)
+			}
+		case "gone.bin":
+			if r.Destinations[0].Overwrite || r.StorageSource == nil {
+				t.Errorf("gone.bin should be downloaded, got %s", data)
+			}
+		case "copy.txt":
+			if r.Destinations[0].Overwrite || r.LocalSource != filepath.Join(env.srcDir, "same.txt") {
+				t.Errorf("copy.txt should be copied from same.txt, got %s", data)
+			}
+		default:
+			t.Errorf("unexpected restoration %s", data)
+		}
+	}
+
+	// and nothing actually happened
+	if _, err := os.Stat(filepath.Join(env.srcDir, "sub/gone.bin")); !os.IsNotExist(err) {
+		t.Error("a dry run shouldn't restore anything")
+	}
+	if content, _ := os.ReadFile(filepath.Join(env.srcDir, "different.txt")); string(content) != "something else" {
+		t.Error("a dry run shouldn't overwrite anything")
+	}
+	states, _ := filepath.Glob(config.Config().DatabaseLocation + "-restorestate-*")
+	if len(states) != 0 {
+		t.Errorf("a dry run shouldn't leave a restore state, got %v", states)
+	}
+}
+
+func captureStdout(t *testing.T, f func()) []byte {
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	func() {
+		defer func() { os.Stdout = stdout }()
+		f()
+	}()
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDiff(t *testing.T) {
+	env := setupTestEnv(t, "diff")
+	defer env.cleanup()
+
+	env.writeFile("a.txt", []byte("line1\nline2\nline3\n"))
+	env.writeFile("perm.sh", []byte("echo hi\n"))
+	env.writeFile("gone.txt", []byte("gone"))
+	env.writeFile("b.bin", makeBinaryData(1000))
+	env.writeFile("same.txt", []byte("same"))
+	env.backup()
+	t1 := backup.GetLastSessionTimestamp()
+
+	env.writeFile("a.txt", []byte("line1\nline two\nline3\n"))
+	env.writeFile("perm.sh", []byte("echo bye\n"))
+	env.writeFile("b.bin", makeBinaryData(2000))
+	env.removeFile("gone.txt")
+	env.writeFile("new.txt", []byte("new"))
+	env.backup()
+	t2 := backup.GetLastSessionTimestamp()
+
+	// the same contents as at t1, but executable
+	env.writeFile("perm.sh", []byte("echo hi\n"))
+	if err := os.Chmod(filepath.Join(env.srcDir, "perm.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env.backup()
+	t3 := backup.GetLastSessionTimestamp()
+
+	summarize := func(entries []history.DiffEntry) string {
+		var ret []string
+		for _, e := range entries {
+			rel, _ := filepath.Rel(env.srcDir, e.Path)
+			ret = append(ret, fmt.Sprint(e.Change, " ", rel, " ", e.SizeDelta))
+		}
+		return strings.Join(ret, ", ")
+	}
+	if got := summarize(history.DiffEntries(env.srcDir, t1, t2)); got != "modified a.txt 3, modified b.bin 1000, removed gone.txt -4, added new.txt 3, modified perm.sh 1" {
+		t.Errorf("t1 to t2: %s", got)
+	}
+	if got := summarize(history.DiffEntries(env.srcDir, t1, t3)); got != "modified a.txt 3, modified b.bin 1000, removed gone.txt -4, added new.txt 3, permissions perm.sh 0" {
+		t.Errorf("t1 to t3: %s", got)
+	}
+	if got := summarize(history.DiffEntries(filepath.Join(env.srcDir, "a.txt"), t1, t3)); got != "modified a.txt 3" {
+		t.Errorf("a single file: %s", got)
+	}
+
+	var entries []history.DiffEntry
+	data := captureStdout(t, func() {
+		history.Diff(env.srcDir, t1, t3, true, true, env.mockStor)
+	})
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("%v: %s", err, data)
+	}
+	for _, e := range entries {
+		switch filepath.Base(e.Path) {
+		case "a.txt":
+			if !strings.Contains(e.ContentDiff, "@@ -1,3 +1,3 @@\n line1\n-line2\n+line two\n line3\n") {
+				t.Errorf("wrong content diff %q", e.ContentDiff)
+			}
+		case "perm.sh":
+			if e.PermissionsBefore != "-rw-r--r--" || e.PermissionsAfter != "-rwxr-xr-x" {
+				t.Errorf("wrong permissions %s -> %s", e.PermissionsBefore, e.PermissionsAfter)
+			}
+		default:
+			if e.ContentDiff != "" {
+				t.Errorf("%s shouldn't have a content diff, got %q", e.Path, e.ContentDiff)
+			}
+		}
+	}
+}
+
+func TestMoves(t *testing.T) {
+	env := setupTestEnv(t, "moves")
+	defer env.cleanup()
+
+	env.writeFile("a/x.txt", []byte("moved twice"))
+	env.writeFile("a/copied.txt", []byte("copied"))
+	env.writeFile("empty.txt", []byte{})
+	env.writeFile("edited.txt", []byte("edited"))
+	// something unrelated was at c/z.txt before, so it has two runs of revisions
+	env.writeFile("c/z.txt", []byte("here first"))
+	env.backup()
+	env.removeFile("c/z.txt")
+
+	move := func(from string, to string) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(env.srcDir, to)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(env.srcDir, from), filepath.Join(env.srcDir, to)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	move("a/x.txt", "b/y.txt")
+	move("empty.txt", "empty2.txt")
+	env.writeFile("b/copied.txt", []byte("copied"))
+	// the old contents went somewhere else, but since edited.txt is still there, that's a copy
+	env.writeFile("edited.txt", []byte("edited, after"))
+	env.writeFile("b/edited.txt", []byte("edited"))
+	env.backup()
+	t2 := backup.GetLastSessionTimestamp()
+
+	move("b/y.txt", "c/z.txt")
+	env.backup()
+	t3 := backup.GetLastSessionTimestamp()
+
+	summarize := func(moves []history.Move) string {
+		var ret []string
+		for _, m := range moves {
+			from, _ := filepath.Rel(env.srcDir, m.From)
+			to, _ := filepath.Rel(env.srcDir, m.To)
+			ret = append(ret, fmt.Sprint(from, " -> ", to, " at ", m.At-t2))
+		}
+		return strings.Join(ret, ", ")
+	}
+	if got := summarize(history.DetectMoves(env.srcDir+"/", 0)); got != fmt.Sprint("a/x.txt -> b/y.txt at 0, b/y.txt -> c/z.txt at ", t3-t2) {
+		t.Errorf("all moves: %s", got)
+	}
+	if got := summarize(history.DetectMoves(env.srcDir+"/", t3)); got != fmt.Sprint("b/y.txt -> c/z.txt at ", t3-t2) {
+		t.Errorf("moves since t3: %s", got)
+	}
+	if got := summarize(history.DetectMoves(env.srcDir+"/a/", 0)); got != "a/x.txt -> b/y.txt at 0" {
+		t.Errorf("moves from a: %s", got)
+	}
+
+	from, ok := history.MovedFrom(filepath.Join(env.srcDir, "c/z.txt"), t3)
+	if !ok || from != filepath.Join(env.srcDir, "b/y.txt") {
+		t.Errorf("expected c/z.txt to be moved from b/y.txt, got %s", from)
+	}
+	if _, ok := history.MovedFrom(filepath.Join(env.srcDir, "b/copied.txt"), t2); ok {
+		t.Error("a copy isn't a move")
+	}
+	var segments []string
+	for _, seg := range history.FollowMoves(filepath.Join(env.srcDir, "c/z.txt")) {
+		rel, _ := filepath.Rel(env.srcDir, seg.Path)
+		until := "now"
+		if seg.Until != math.MaxInt64 {
+			until = fmt.Sprint(seg.Until - t2)
+		}
+		segments = append(segments, fmt.Sprint(rel, " ", seg.Since-t2, " to ", until))
+	}
+	if got, expected := strings.Join(segments, ", "), fmt.Sprint("c/z.txt ", t3-t2, " to now, b/y.txt 0 to ", t3-t2, ", a/x.txt ", -t2, " to 0"); got != expected {
+		t.Errorf("follow: expected %s, got %s", expected, got)
+	}
+	history.FileHistory(filepath.Join(env.srcDir, "c/z.txt"), true)
+}
+
+func TestWhereis(t *testing.T) {
+	env := setupTestEnv(t, "whereis")
+	defer env.cleanup()
+
+	content := []byte("this was emailed to me")
+	env.writeFile("a.txt", content)
+	env.writeFile("sub/b.txt", content)
+	env.backup()
+	t1 := backup.GetLastSessionTimestamp()
+	env.removeFile("a.txt")
+	env.backup()
+
+	hash := sha256.Sum256(content)
+	revisions, blobs := history.FindContent(hash[:])
+	if len(revisions) != 2 || revisions[0].Path != filepath.Join(env.srcDir, "a.txt") || revisions[0].Start != t1 || revisions[0].End == nil || revisions[1].Path != filepath.Join(env.srcDir, "sub/b.txt") || revisions[1].End != nil {
+		t.Errorf("unexpected revisions %+v", revisions)
+	}
+	if len(blobs) != 1 || blobs[0].Storage != "test-storage" {
+		t.Errorf("unexpected blobs %+v", blobs)
+	}
+	other := sha256.Sum256([]byte("never backed up"))
+	if revisions, blobs := history.FindContent(other[:]); len(revisions) != 0 || len(blobs) != 0 {
+		t.Errorf("expected nothing, got %+v %+v", revisions, blobs)
+	}
+
+	// by file and by hash shouldn't panic either way
+	stray := filepath.Join(env.tmpDir, "attachment.txt")
+	if err := os.WriteFile(stray, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	history.Whereis(stray)
+	history.Whereis(hex.EncodeToString(other[:]))
+	if err := os.WriteFile(stray, []byte("different size"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	history.Whereis(stray)
+}
+
+func TestSearch(t *testing.T) {
+	env := setupTestEnv(t, "search")
+	defer env.cleanup()
+
+	env.writeFile("photos/a.JPG", makeBinaryData(3000))
+	env.writeFile("photos/b.png", makeBinaryData(2000))
+	env.writeFile("notes/todo.txt", []byte("todo"))
+	env.writeFile("notes/old.txt", []byte("old"))
+	env.backup()
+	t1 := backup.GetLastSessionTimestamp()
+	env.removeFile("notes/old.txt")
+	env.writeFile("notes/todo.txt", []byte("todo, done"))
+	env.backup()
+
+	search := func(opts history.SearchOptions) string {
+		var ret []string
+		for _, r := range history.SearchResults(opts) {
+			rel, _ := filepath.Rel(env.srcDir, r.Path)
+			ret = append(ret, rel)
+		}
+		return strings.Join(ret, " ")
+	}
+	cases := []struct {
+		opts     history.SearchOptions
+		expected string
+	}{
+		{history.SearchOptions{Query: "notes"}, "notes/old.txt notes/todo.txt notes/todo.txt"},
+		{history.SearchOptions{Regex: `/[ab]\.`}, "photos/a.JPG photos/b.png"},
+		{history.SearchOptions{MinSize: 2500}, "photos/a.JPG"},
+		{history.SearchOptions{MinSize: 1000, MaxSize: 2500}, "photos/b.png"},
+		{history.SearchOptions{Query: "notes", ExistedAt: t1}, "notes/old.txt notes/todo.txt"},
+		{history.SearchOptions{Deleted: true}, "notes/old.txt"},
+		{history.SearchOptions{Extensions: []string{"jpg", ".png"}}, "photos/a.JPG photos/b.png"},
+		{history.SearchOptions{SortBy: "size", Extensions: []string{"txt"}}, "notes/todo.txt notes/todo.txt notes/old.txt"},
+	}
+	for _, c := range cases {
+		if got := search(c.opts); got != c.expected {
+			t.Errorf("search %+v got %s, expected %s", c.opts, got, c.expected)
+		}
+	}
+	hash := sha256.Sum256([]byte("todo"))
+	if got := search(history.SearchOptions{HashPrefix: hex.EncodeToString(hash[:])[:5]}); got != "notes/todo.txt" {
+		t.Errorf("hash prefix search got %s", got)
+	}
+}
+
+func TestContentIndex(t *testing.T) {
+	env := setupTestEnv(t, "content-index")
+	defer env.cleanup()
+	config.SetContentIndex(true)
+	defer config.SetContentIndex(false)
+
+	env.writeFile("notes.md", []byte("the quick brown fox jumps over the lazy dog"))
+	env.writeFile("copy/notes.txt", []byte("the quick brown fox jumps over the lazy dog"))
+	env.writeFile("script", []byte("#!/bin/sh\necho hello world\n"))
+	env.writeFile("data.bin", append([]byte("hello quick brown "), makeBinaryData(1000)...))
+	env.backup()
+	env.writeFile("notes.md", []byte("the slow green turtle"))
+	env.backup()
+
+	grep := func(query string) string {
+		var ret []string
+		for _, r := range history.GrepResults(query) {
+			rel, _ := filepath.Rel(env.srcDir, r.Path)
+			if r.End != nil {
+				rel += "(old)"
+			}
+			ret = append(ret, rel)
+		}
+		return strings.Join(ret, " ")
+	}
+	cases := map[string]string{
+		`"quick brown"`:    "copy/notes.txt notes.md(old)",
+		"turtle":           "notes.md",
+		"hello":            "script",
+		"jump*":            "copy/notes.txt notes.md(old)",
+		"lazy AND turtle":  "",
+		"green OR hello":   "notes.md script",
+		"nothingmatchesme": "",
+	}
+	for query, expected := range cases {
+		if got := grep(query); got != expected {
+			t.Errorf("grep %s got %q, expected %q", query, got, expected)
+		}
+	}
+
+	onDisk, err := os.ReadFile(contentindex.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(onDisk, []byte("turtle")) || bytes.Contains(onDisk, []byte("SQLite format")) {
+		t.Error("the content index should be encrypted on disk")
+	}
+	backup.RotateDBKeyNonInteractive()
+	contentindex.Unload()
+	if got := grep("turtle"); got != "notes.md" {
+		t.Errorf("after rotating the database key, grep turtle got %q", got)
+	}
+}
+
+func TestContentIndexBackfill(t *testing.T) {
+	env := setupTestEnv(t, "content-index-backfill")
+	defer env.cleanup()
+
+	env.writeFile("old.txt", []byte("ancient scrolls of wisdom"))
+	env.writeFile("seed.txt", []byte("sprouting seedlings everywhere"))
+	env.writeFile("gone.txt", []byte("vanished without a trace"))
+	env.writeFile("photo.jpg", makeBinaryData(1000))
+	env.backup()
+	env.removeFile("gone.txt")
+
+	config.SetContentIndex(true)
+	defer config.SetContentIndex(false)
+	// already backed up, so this is a dedup hit, and never uploaded
+	env.writeFile("dup.txt", []byte("sprouting seedlings everywhere"))
+	env.backup()
+
+	grep := func(query string) string {
+		var ret []string
+		for _, r := range history.GrepResults(query) {
+			rel, _ := filepath.Rel(env.srcDir, r.Path)
+			if r.End != nil {
+				rel += "(old)"
+			}
+			ret = append(ret, rel)
+		}
+		return strings.Join(ret, " ")
+	}
+	if got := grep("seedlings"); got != "dup.txt seed.txt" {
+		t.Errorf("dedup hit wasn't indexed, grep seedlings got %q", got)
+	}
+	if got := grep("ancient OR vanished"); got != "" {
+		t.Errorf("nothing from before content_index was on should be indexed yet, got %q", got)
+	}
+
+	if looked := contentindex.Reindex(env.mockStor); looked != 3 {
+		t.Errorf("reindex looked at %d files, expected old.txt, gone.txt, and photo.jpg", looked)
+	}
+	if got := grep("ancient OR vanished"); got != "gone.txt(old) old.txt" {
+		t.Errorf("after reindex, got %q", got)
+	}
+	if looked := contentindex.Reindex(env.mockStor); looked != 0 {
+		t.Errorf("reindexing again looked at %d files, but there was nothing new", looked)
+	}
+	contentindex.Unload()
+	if got := grep("scrolls"); got != "old.txt" {
+		t.Errorf("reindex wasn't saved, grep scrolls got %q", got)
+	}
+}
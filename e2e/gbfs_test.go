@@ -0,0 +1,125 @@
+//go:build linux || freebsd
+// +build linux freebsd
+
+package e2e
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	fuseFs "bazil.org/fuse/fs"
+	"github.com/leijurv/gb/backup"
+	"github.com/leijurv/gb/gbfs"
+)
+
+// gb mount --snapshots, by calling what FUSE would, without mounting anything
+func TestMountSnapshots(t *testing.T) {
+	env := setupTestEnv(t, "mount-snapshots")
+	defer env.cleanup()
+
+	env.writeFile("a.txt", []byte("a, first"))
+	env.writeFile("sub/b.txt", []byte("b"))
+	env.backup()
+	t1 := backup.GetLastSessionTimestamp()
+	env.writeFile("a.txt", []byte("a, second"))
+	env.removeFile("sub/b.txt")
+	env.writeFile("sub/c.txt", []byte("c"))
+	env.backup()
+	t2 := backup.GetLastSessionTimestamp()
+	// sub stops being a directory, and becomes a file
+	env.removeFile("sub/c.txt")
+	env.removeFile("sub")
+	env.writeFile("sub", []byte("sub is a file now"))
+	env.backup()
+	t3 := backup.GetLastSessionTimestamp()
+
+	ctx := context.Background()
+	name := func(timestamp int64) string {
+		return time.Unix(timestamp, 0).Format(time.RFC3339)
+	}
+	list := func(node fuseFs.Node) string {
+		entries, err := node.(fuseFs.HandleReadDirAller).ReadDirAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		return strings.Join(names, " ")
+	}
+	lookup := func(node fuseFs.Node, path ...string) fuseFs.Node {
+		for _, name := range path {
+			var err error
+			node, err = node.(fuseFs.NodeStringLookuper).Lookup(ctx, name)
+			if err != nil {
+				t.Fatalf("lookup %s: %v", name, err)
+			}
+		}
+		return node
+	}
+	missing := func(node fuseFs.Node, name string) {
+		if _, err := node.(fuseFs.NodeStringLookuper).Lookup(ctx, name); err != syscall.ENOENT {
+			t.Errorf("%s shouldn't exist, got %v", name, err)
+		}
+	}
+	read := func(node fuseFs.Node) string {
+		handle, err := node.(fuseFs.NodeOpener).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &fuse.ReadResponse{}
+		if err := handle.(fuseFs.HandleReader).Read(ctx, &fuse.ReadRequest{Size: 1 << 20}, resp); err != nil {
+			t.Fatal(err)
+		}
+		return string(resp.Data)
+	}
+
+	root := gbfs.NewSnapshotsDir(env.srcDir, env.mockStor)
+	if got, expected := list(root), strings.Join([]string{".", "..", "by-path", name(t1), name(t2), name(t3)}, " "); got != expected {
+		t.Errorf("root: expected %q, got %q", expected, got)
+	}
+	if got := list(lookup(root, name(t1))); got != ". .. a.txt sub" {
+		t.Errorf("snapshot at t1: %q", got)
+	}
+	if got := list(lookup(root, name(t2), "sub")); got != ". .. c.txt" {
+		t.Errorf("sub at t2: %q", got)
+	}
+	if got := read(lookup(root, name(t1), "a.txt")); got != "a, first" {
+		t.Errorf("a.txt at t1: %q", got)
+	}
+	if got := read(lookup(root, name(t3), "sub")); got != "sub is a file now" {
+		t.Errorf("sub at t3: %q", got)
+	}
+	// only the exact name a timestamp is listed under, and only for a backup that changed something
+	_, offset := time.Unix(t1, 0).Zone()
+	missing(root, time.Unix(t1, 0).In(time.FixedZone("", offset+3600)).Format(time.RFC3339))
+	missing(root, name(t1-1))
+	missing(root, "yesterday")
+
+	byPath := lookup(root, "by-path")
+	if got := list(byPath); got != ". .. a.txt sub" {
+		t.Errorf("by-path: %q", got)
+	}
+	if got := list(lookup(byPath, "sub")); got != ". .. @versions b.txt c.txt" {
+		t.Errorf("by-path/sub, which has been both a file and a directory: %q", got)
+	}
+	if got := list(lookup(byPath, "sub", "b.txt")); got != ". .. @versions" {
+		t.Errorf("by-path/sub/b.txt: %q", got)
+	}
+	missing(lookup(byPath, "sub", "b.txt"), "d.txt")
+	missing(byPath, "nothing.txt")
+
+	versions := lookup(byPath, "a.txt", "@versions")
+	if got := list(versions); got != strings.Join([]string{".", "..", name(t1), name(t2)}, " ") {
+		t.Errorf("a.txt versions: %q", got)
+	}
+	if got := read(lookup(versions, name(t2))); got != "a, second" {
+		t.Errorf("a.txt version at t2: %q", got)
+	}
+	missing(versions, name(t3))
+}
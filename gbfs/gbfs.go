@@ -47,13 +47,12 @@ type Dir struct {
 	path      string // full path including trailing slash
 	timestamp int64  // for querying historical data
 	inode     uint64 // generated
+	view      string // what this is under in the mount, so that the same path at different times gets different inodes
 	storage   storage_base.Storage
 }
 
 type GBFS struct {
-	root      Dir
-	timestamp int64
-	storage   storage_base.Storage
+	root fuseFs.Node
 }
 
 type FileHandle interface{}
@@ -68,6 +67,7 @@ type UncompressedFileHandle struct {
 	storagePath string
 	blobOffset  int64
 	length      int64
+	encryption  string
 	key         *[]byte
 	storage     storage_base.Storage
 }
@@ -77,7 +77,7 @@ func timeMillis(millis int64) time.Time {
 }
 
 func (d *Dir) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = pathToInode(d.path)
+	attr.Inode = d.inode
 	attr.Uid = 1000
 	attr.Gid = 100
 	attr.Mode = os.ModeDir | 0o555
@@ -86,7 +86,7 @@ func (d *Dir) Attr(ctx context.Context, attr *fuse.Attr) error {
 }
 
 func (f *File) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = pathToInode(f.path)
+	attr.Inode = f.inode
 	attr.Uid = 1000
 	attr.Gid = 100
 	mtime := timeMillis(int64(f.modifiedTime))
@@ -101,7 +101,7 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	out := make([]fuse.Dirent, 0, len(entries)+2)
 
 	out = append(out, fuse.Dirent{
-		Inode: pathToInode(d.path),
+		Inode: d.inode,
 		Name:  ".",
 		Type:  fuse.DT_Dir,
 	})
@@ -117,7 +117,7 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		}
 	}
 	out = append(out, fuse.Dirent{
-		Inode: pathToInode(parentPath),
+		Inode: pathToInode(d.view + parentPath),
 		Name:  "..",
 		Type:  fuse.DT_Dir,
 	})
@@ -127,7 +127,7 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 			// Extract just the directory name from the full path
 			name := strings.TrimSuffix(entry.Path[len(d.path):], "/")
 			out = append(out, fuse.Dirent{
-				Inode: pathToInode(entry.Path),
+				Inode: pathToInode(d.view + entry.Path),
 				Name:  name,
 				Type:  fuse.DT_Dir,
 			})
@@ -135,7 +135,7 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 			// Extract just the filename from the full path
 			name := entry.Path[strings.LastIndex(entry.Path, "/")+1:]
 			out = append(out, fuse.Dirent{
-				Inode: pathToInode(entry.Path),
+				Inode: pathToInode(d.view + entry.Path),
 				Name:  name,
 				Type:  fuse.DT_File,
 			})
@@ -154,6 +154,7 @@ func newUncompressedHandle(hash []byte, tx *sql.Tx, stor storage_base.Storage) U
 		storagePath: info.StoragePath,
 		blobOffset:  info.Offset,
 		length:      info.Length,
+		encryption:  info.Encryption,
 		key:         &info.Key,
 		storage:     stor,
 	}
@@ -203,10 +204,18 @@ func (fh *CompressedFileHandle) Read(ctx context.Context, req *fuse.ReadRequest,
 }
 
 func (fh *UncompressedFileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	buf := make([]byte, req.Size)
-	offset := fh.blobOffset + req.Offset
-	reader := cache.DownloadSection(fh.storage, fh.storagePath, offset, int64(req.Size))
-	decrypted := crypto.DecryptBlobEntry(reader, offset, *fh.key)
+	size := crypto.BlobEntryPlaintextLength(fh.encryption, fh.length) - req.Offset
+	if size > int64(req.Size) {
+		size = int64(req.Size)
+	}
+	if size <= 0 {
+		resp.Data = nil
+		return nil
+	}
+	buf := make([]byte, size)
+	fetchStart, fetchLength := crypto.BlobEntryRange(fh.encryption, fh.length, req.Offset, size)
+	reader := cache.DownloadSection(fh.storage, fh.storagePath, fh.blobOffset+fetchStart, fetchLength)
+	decrypted := crypto.DecryptBlobEntryRange(reader, fh.encryption, *fh.key, fh.blobOffset, fh.length, req.Offset, size)
 	defer reader.Close()
 	n, err := io.ReadFull(decrypted, buf)
 	// same as above
@@ -224,7 +233,8 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fuseFs.Node, error) {
 		return &Dir{
 			path:      subdirPath,
 			timestamp: d.timestamp,
-			inode:     pathToInode(subdirPath),
+			inode:     pathToInode(d.view + subdirPath),
+			view:      d.view,
 			storage:   d.storage,
 		}, nil
 	}
@@ -232,6 +242,7 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fuseFs.Node, error) {
 	// Then check if it's a file
 	filePath := d.path + name
 	if file := lookupFile(filePath, d.timestamp, d.storage); file != nil {
+		file.inode = pathToInode(d.view + filePath)
 		return file, nil
 	}
 
@@ -243,13 +254,15 @@ func Mount(mountpoint string, path string, timestamp int64, stor storage_base.St
 		path += "/"
 	}
 
-	root := Dir{
+	serve(mountpoint, &Dir{
 		path:      path,
 		timestamp: timestamp,
 		inode:     pathToInode(path),
 		storage:   stor,
-	}
+	})
+}
 
+func serve(mountpoint string, root fuseFs.Node) {
 	conn, err := fuse.Mount(mountpoint,
 		fuse.ReadOnly(),
 		fuse.DefaultPermissions(),
@@ -267,7 +280,7 @@ func Mount(mountpoint string, path string, timestamp int64, stor storage_base.St
 	// Start serving in a goroutine
 	serveDone := make(chan error, 1)
 	go func() {
-		serveDone <- fuseFs.Serve(conn, GBFS{root, timestamp, stor})
+		serveDone <- fuseFs.Serve(conn, GBFS{root})
 	}()
 
 	// Wait for either a signal or serve to complete
@@ -300,7 +313,7 @@ cleanup:
 }
 
 func (gb GBFS) Root() (fuseFs.Node, error) {
-	return &gb.root, nil
+	return gb.root, nil
 }
 
 // Generate a consistent inode from a path by hashing it
@@ -323,11 +336,15 @@ func directoryExists(path string, timestamp int64) bool {
 }
 
 func lookupFile(path string, timestamp int64, stor storage_base.Storage) *File {
+	return queryFile("(? >= files.start AND (files.end > ? OR files.end IS NULL)) AND files.path = ?", stor, timestamp, timestamp, path)
+}
+
+func queryFile(condition string, stor storage_base.Storage, args ...any) *File {
 	row := db.DB.QueryRow(`SELECT files.path, files.hash, files.fs_modified, files.permissions, sizes.size, COALESCE(blob_entries.compression_alg, '')
 		FROM files
 		INNER JOIN sizes ON sizes.hash = files.hash
 		INNER JOIN blob_entries ON blob_entries.hash = files.hash
-		WHERE (? >= files.start AND (files.end > ? OR files.end IS NULL)) AND files.path = ?`, timestamp, timestamp, path)
+		WHERE `+condition, args...)
 
 	var file File
 	var hash []byte
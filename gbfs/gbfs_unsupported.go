@@ -8,3 +8,7 @@ import "github.com/leijurv/gb/storage_base"
 func Mount(_ string, _ string, _ int64, _ storage_base.Storage) {
 	panic("gb mount is not supported on darwin")
 }
+
+func MountSnapshots(_ string, _ string, _ storage_base.Storage) {
+	panic("gb mount is not supported on darwin")
+}
@@ -0,0 +1,272 @@
+//go:build linux || freebsd
+// +build linux freebsd
+
+package gbfs
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fuseFs "bazil.org/fuse/fs"
+	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/storage_base"
+)
+
+// the layout of gb mount --snapshots:
+// /<timestamp>/... is path as of every backup that changed something in it
+// /by-path/<file>/@versions/<timestamp> is every revision of every file that's ever been in path
+// none of it is stored anywhere, it's all worked out from files.start and files.end as it's looked at
+
+const byPath = "by-path"
+const versions = "@versions"
+
+type SnapshotsDir struct {
+	path    string // full path including trailing slash
+	storage storage_base.Storage
+}
+
+// every file in one of these has been a file, every directory has been a directory, or both (at different times)
+type ByPathDir struct {
+	path    string // full path including trailing slash
+	inode   uint64 // generated
+	storage storage_base.Storage
+}
+
+type VersionsDir struct {
+	path    string // of the file
+	inode   uint64 // generated
+	storage storage_base.Storage
+}
+
+func MountSnapshots(mountpoint string, path string, stor storage_base.Storage) {
+	serve(mountpoint, NewSnapshotsDir(path, stor))
+}
+
+// what MountSnapshots mounts
+func NewSnapshotsDir(path string, stor storage_base.Storage) *SnapshotsDir {
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return &SnapshotsDir{path, stor}
+}
+
+func formatTimestamp(timestamp int64) string {
+	return time.Unix(timestamp, 0).Format(time.RFC3339)
+}
+
+// only accepts exactly what formatTimestamp would've made, so that each one has one name
+func parseTimestamp(name string) (int64, bool) {
+	t, err := time.Parse(time.RFC3339, name)
+	if err != nil || formatTimestamp(t.Unix()) != name {
+		return 0, false
+	}
+	return t.Unix(), true
+}
+
+func dirAttr(inode uint64, attr *fuse.Attr) {
+	attr.Inode = inode
+	attr.Uid = 1000
+	attr.Gid = 100
+	attr.Mode = os.ModeDir | 0o555
+	attr.Nlink = 2
+}
+
+func dotEntries(inode uint64) []fuse.Dirent {
+	return []fuse.Dirent{
+		{Inode: inode, Name: ".", Type: fuse.DT_Dir},
+		{Inode: inode, Name: "..", Type: fuse.DT_Dir},
+	}
+}
+
+// every backup that something in prefix started or stopped existing in
+func sessionTimestamps(prefix string) []int64 {
+	rows, err := db.DB.Query("SELECT start FROM files WHERE path "+db.StartsWithPattern(1)+" UNION SELECT end FROM files WHERE end IS NOT NULL AND path "+db.StartsWithPattern(1)+" ORDER BY 1", prefix)
+	db.Must(err)
+	defer rows.Close()
+	ret := make([]int64, 0)
+	for rows.Next() {
+		var timestamp int64
+		db.Must(rows.Scan(&timestamp))
+		ret = append(ret, timestamp)
+	}
+	db.Must(rows.Err())
+	return ret
+}
+
+func isSessionTimestamp(prefix string, timestamp int64) bool {
+	var exists int
+	err := db.DB.QueryRow("SELECT 1 FROM files WHERE (start = ?1 OR end = ?1) AND path "+db.StartsWithPattern(2)+" LIMIT 1", timestamp, prefix).Scan(&exists)
+	return err == nil
+}
+
+func (d *SnapshotsDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	dirAttr(pathToInode(d.path), attr)
+	return nil
+}
+
+func (d *SnapshotsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	out := dotEntries(pathToInode(d.path))
+	out = append(out, fuse.Dirent{
+		Inode: pathToInode(byPath + d.path),
+		Name:  byPath,
+		Type:  fuse.DT_Dir,
+	})
+	for _, timestamp := range sessionTimestamps(d.path) {
+		name := formatTimestamp(timestamp)
+		out = append(out, fuse.Dirent{
+			Inode: pathToInode(name + d.path),
+			Name:  name,
+			Type:  fuse.DT_Dir,
+		})
+	}
+	return out, nil
+}
+
+func (d *SnapshotsDir) Lookup(ctx context.Context, name string) (fuseFs.Node, error) {
+	if name == byPath {
+		return &ByPathDir{
+			path:    d.path,
+			inode:   pathToInode(byPath + d.path),
+			storage: d.storage,
+		}, nil
+	}
+	timestamp, ok := parseTimestamp(name)
+	if !ok || !isSessionTimestamp(d.path, timestamp) {
+		return nil, syscall.ENOENT
+	}
+	return &Dir{
+		path:      d.path,
+		timestamp: timestamp,
+		inode:     pathToInode(name + d.path),
+		view:      name,
+		storage:   d.storage,
+	}, nil
+}
+
+// the name of everything that's ever been directly in dir, files and directories alike
+func namesEverIn(dir string) []string {
+	ret := make([]string, 0)
+	seen := make(map[string]struct{})
+	cursor := dir
+	for {
+		// same idea as utils.ListDirectoryAtTime, but over every revision
+		rows, err := db.DB.Query("SELECT path FROM files WHERE path > ? AND path < (? || x'ff') ORDER BY path ASC LIMIT 100", cursor, dir)
+		db.Must(err)
+		any := false
+		for rows.Next() {
+			var path string
+			db.Must(rows.Scan(&path))
+			name := path[len(dir):]
+			if strings.Contains(name, "/") {
+				name = strings.Split(name, "/")[0]
+				cursor = dir + name + "/" + string([]byte{0xff})
+			} else {
+				cursor = path
+			}
+			if _, ok := seen[name]; !ok {
+				ret = append(ret, name)
+				seen[name] = struct{}{}
+			}
+			any = true
+		}
+		db.Must(rows.Err())
+		db.Must(rows.Close())
+		if !any {
+			break
+		}
+	}
+	return ret
+}
+
+func fileEverExisted(path string) bool {
+	var exists int
+	err := db.DB.QueryRow("SELECT 1 FROM files WHERE path = ? LIMIT 1", path).Scan(&exists)
+	return err == nil
+}
+
+func (d *ByPathDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	dirAttr(d.inode, attr)
+	return nil
+}
+
+func (d *ByPathDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	out := dotEntries(d.inode)
+	if fileEverExisted(strings.TrimSuffix(d.path, "/")) {
+		out = append(out, fuse.Dirent{
+			Inode: pathToInode(versions + strings.TrimSuffix(d.path, "/")),
+			Name:  versions,
+			Type:  fuse.DT_Dir,
+		})
+	}
+	for _, name := range namesEverIn(d.path) {
+		out = append(out, fuse.Dirent{
+			Inode: pathToInode(byPath + d.path + name + "/"),
+			Name:  name,
+			Type:  fuse.DT_Dir,
+		})
+	}
+	return out, nil
+}
+
+func (d *ByPathDir) Lookup(ctx context.Context, name string) (fuseFs.Node, error) {
+	if name == versions && fileEverExisted(strings.TrimSuffix(d.path, "/")) {
+		return &VersionsDir{
+			path:    strings.TrimSuffix(d.path, "/"),
+			inode:   pathToInode(versions + strings.TrimSuffix(d.path, "/")),
+			storage: d.storage,
+		}, nil
+	}
+	var exists int
+	err := db.DB.QueryRow("SELECT 1 FROM files WHERE path = ?1 OR path "+db.StartsWithPattern(2)+" LIMIT 1", d.path+name, d.path+name+"/").Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil, syscall.ENOENT
+	}
+	db.Must(err)
+	return &ByPathDir{
+		path:    d.path + name + "/",
+		inode:   pathToInode(byPath + d.path + name + "/"),
+		storage: d.storage,
+	}, nil
+}
+
+func (d *VersionsDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	dirAttr(d.inode, attr)
+	return nil
+}
+
+func (d *VersionsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	out := dotEntries(d.inode)
+	rows, err := db.DB.Query("SELECT start FROM files WHERE path = ? ORDER BY start", d.path)
+	db.Must(err)
+	defer rows.Close()
+	for rows.Next() {
+		var start int64
+		db.Must(rows.Scan(&start))
+		name := formatTimestamp(start)
+		out = append(out, fuse.Dirent{
+			Inode: pathToInode(versions + d.path + "/" + name),
+			Name:  name,
+			Type:  fuse.DT_File,
+		})
+	}
+	db.Must(rows.Err())
+	return out, nil
+}
+
+func (d *VersionsDir) Lookup(ctx context.Context, name string) (fuseFs.Node, error) {
+	start, ok := parseTimestamp(name)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	file := queryFile("files.path = ? AND files.start = ?", d.storage, d.path, start)
+	if file == nil {
+		return nil, syscall.ENOENT
+	}
+	file.inode = pathToInode(versions + d.path + "/" + name)
+	return file, nil
+}
@@ -118,7 +118,7 @@ func (gds *gDriveStorage) ListBlobs() []storage_base.UploadedBlob {
 			panic(err)
 		}
 		for _, i := range r.Files {
-			if strings.HasPrefix(i.Name, "db-backup-") || strings.HasPrefix(i.Name, "db-v2backup-") {
+			if strings.HasPrefix(i.Name, "db-backup-") || strings.HasPrefix(i.Name, "db-v2backup-") || strings.HasPrefix(i.Name, "zstd-dict-") {
 				continue // this is not a blob
 			}
 			blobID, err := hex.DecodeString(i.Name)
@@ -264,6 +264,20 @@ type identifierInDB struct {
 }
 
 func CreateNewGDriveStorage() (identifier, rootPath string) {
+	id := Authenticate()
+	srv := driveServiceFromIdentifier(id)
+	dir := createDir(srv, "gb", "root")
+
+	log.Println("I have created a folder called \"gb\" in the root of this Google Drive account")
+	log.Println("Since I will remember it by its ID, not by its name, you can rename it or move it wherever you want, without breaking anything!")
+	log.Println("This means that, UNLIKE in rclone, you CAN'T \"transplant\" the files into a new folder and call that one gb. (well, you can, but you'd have to modify the storage table in the database lol)")
+	log.Println("The ID is", dir.Id)
+	log.Println("Furthermore, the name of each file also doesn't matter at all. You can furthermore furthermore move the files anywhere (even out of the gb folder), BUT that will cause the \"paranoia storage\" command to fail, since it just lists files in your gb folder. If you don't plan to use that command, everything else (like retrieval) will work fine.")
+	return id, dir.Id
+}
+
+// go through the oauth flow with credentials.json, and return the identifier that would be stored in the database
+func Authenticate() string {
 	b, err := ioutil.ReadFile("credentials.json")
 	if err != nil {
 		panic("You need to get your Drive API credentials file and put them in credentials.json, sorry. Enable the Drive API at https://developers.google.com/drive/api/v3/quickstart/go")
@@ -278,15 +292,7 @@ func CreateNewGDriveStorage() (identifier, rootPath string) {
 		panic(err) // literally 0 reason why json marshaling could fail
 	}
 	log.Println("Authentication complete. Identifier blob is ", string(id))
-	srv := driveServiceFromIdentifier(string(id))
-	dir := createDir(srv, "gb", "root")
-
-	log.Println("I have created a folder called \"gb\" in the root of this Google Drive account")
-	log.Println("Since I will remember it by its ID, not by its name, you can rename it or move it wherever you want, without breaking anything!")
-	log.Println("This means that, UNLIKE in rclone, you CAN'T \"transplant\" the files into a new folder and call that one gb. (well, you can, but you'd have to modify the storage table in the database lol)")
-	log.Println("The ID is", dir.Id)
-	log.Println("Furthermore, the name of each file also doesn't matter at all. You can furthermore furthermore move the files anywhere (even out of the gb folder), BUT that will cause the \"paranoia storage\" command to fail, since it just lists files in your gb folder. If you don't plan to use that command, everything else (like retrieval) will work fine.")
-	return string(id), dir.Id
+	return string(id)
 }
 
 func driveServiceFromIdentifier(identifier string) *drive.Service {
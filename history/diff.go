@@ -0,0 +1,188 @@
+package history
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/download"
+	"github.com/leijurv/gb/storage_base"
+	"github.com/leijurv/gb/utils"
+)
+
+// one revision of a file as of some timestamp, as far as diffing is concerned
+type diffRevision struct {
+	hash        []byte
+	fsModified  int64
+	permissions os.FileMode
+	size        int64
+}
+
+type DiffEntry struct {
+	Path              string `json:"path"`
+	Change            string `json:"change"` // added, removed, modified, or permissions (when only that changed)
+	SizeBefore        int64  `json:"size_before"`
+	SizeAfter         int64  `json:"size_after"`
+	SizeDelta         int64  `json:"size_delta"`
+	HashBefore        string `json:"hash_before,omitempty"`
+	HashAfter         string `json:"hash_after,omitempty"`
+	PermissionsBefore string `json:"permissions_before,omitempty"`
+	PermissionsAfter  string `json:"permissions_after,omitempty"`
+	ContentDiff       string `json:"content_diff,omitempty"`
+}
+
+// everything at path (a file, or everything in a directory) as of timestamp, using the same query as restore
+func revisionsAt(path string, timestamp int64) map[string]diffRevision {
+	ret := make(map[string]diffRevision)
+	scan := func(query string, arg string) {
+		rows, err := db.DB.Query(query, timestamp, arg)
+		db.Must(err)
+		defer rows.Close()
+		for rows.Next() {
+			var rev diffRevision
+			var origPath string
+			var start int64
+			db.Must(rows.Scan(&rev.hash, &origPath, &rev.fsModified, &rev.permissions, &start, &rev.size))
+			ret[origPath] = rev
+		}
+		db.Must(rows.Err())
+	}
+	scan(download.QueryBase(1)+" = ?", path)
+	scan(download.QueryBase(1)+db.StartsWithPattern(2), strings.TrimSuffix(path, "/")+"/")
+	return ret
+}
+
+// what changed at path between timestamps a and b, sorted by path
+func DiffEntries(path string, a int64, b int64) []DiffEntry {
+	before := revisionsAt(path, a)
+	after := revisionsAt(path, b)
+	entries := make([]DiffEntry, 0)
+	for p, rev := range before {
+		if _, ok := after[p]; !ok {
+			entries = append(entries, DiffEntry{
+				Path:              p,
+				Change:            "removed",
+				SizeBefore:        rev.size,
+				SizeDelta:         -rev.size,
+				HashBefore:        hex.EncodeToString(rev.hash),
+				PermissionsBefore: rev.permissions.String(),
+			})
+		}
+	}
+	for p, rev := range after {
+		prev, ok := before[p]
+		if !ok {
+			entries = append(entries, DiffEntry{
+				Path:             p,
+				Change:           "added",
+				SizeAfter:        rev.size,
+				SizeDelta:        rev.size,
+				HashAfter:        hex.EncodeToString(rev.hash),
+				PermissionsAfter: rev.permissions.String(),
+			})
+			continue
+		}
+		entry := DiffEntry{
+			Path:       p,
+			SizeBefore: prev.size,
+			SizeAfter:  rev.size,
+			SizeDelta:  rev.size - prev.size,
+		}
+		if string(prev.hash) != string(rev.hash) {
+			entry.Change = "modified"
+			entry.HashBefore = hex.EncodeToString(prev.hash)
+			entry.HashAfter = hex.EncodeToString(rev.hash)
+		} else if prev.permissions != rev.permissions {
+			entry.Change = "permissions"
+		} else {
+			continue // just touched, or nothing at all
+		}
+		if prev.permissions != rev.permissions {
+			entry.PermissionsBefore = prev.permissions.String()
+			entry.PermissionsAfter = rev.permissions.String()
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// fill in ContentDiff for every modified text file, fetching both versions from stor
+func addContentDiffs(entries []DiffEntry, a int64, b int64, stor storage_base.Storage) {
+	tx, err := db.DB.Begin()
+	db.Must(err)
+	defer tx.Rollback()
+	fetch := func(hexHash string) []byte {
+		hash, err := hex.DecodeString(hexHash)
+		if err != nil {
+			panic(err)
+		}
+		data, err := io.ReadAll(download.Cat(hash, tx, stor))
+		if err != nil {
+			panic(err)
+		}
+		return data
+	}
+	for i := range entries {
+		e := &entries[i]
+		if e.Change != "modified" || e.SizeBefore > maxTextDiffSize || e.SizeAfter > maxTextDiffSize {
+			continue
+		}
+		before := fetch(e.HashBefore)
+		after := fetch(e.HashAfter)
+		if !looksLikeText(before) || !looksLikeText(after) {
+			continue
+		}
+		e.ContentDiff = unifiedDiff(e.Path+"@"+fmt.Sprint(a), e.Path+"@"+fmt.Sprint(b), before, after)
+	}
+}
+
+// stor is only needed for contentDiff
+func Diff(path string, a int64, b int64, asJSON bool, contentDiff bool, stor storage_base.Storage) {
+	var err error
+	path, err = filepath.Abs(path)
+	if err != nil {
+		panic(err)
+	}
+	log.Println("Diffing", path, "from", time.Unix(a, 0).Format(time.RFC3339), "to", time.Unix(b, 0).Format(time.RFC3339))
+	entries := DiffEntries(path, a, b)
+	if contentDiff {
+		addContentDiffs(entries, a, b, stor)
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(entries); err != nil {
+			panic(err)
+		}
+		return
+	}
+	counts := make(map[string]int)
+	var delta int64
+	for _, e := range entries {
+		counts[e.Change]++
+		delta += e.SizeDelta
+		line := fmt.Sprintf("%-11s %s (%+d bytes", e.Change, e.Path, e.SizeDelta)
+		if e.Change == "modified" {
+			line += fmt.Sprintf(", %d -> %d", e.SizeBefore, e.SizeAfter)
+		}
+		if e.PermissionsBefore != "" && e.PermissionsAfter != "" {
+			line += ", " + e.PermissionsBefore + " -> " + e.PermissionsAfter
+		}
+		fmt.Println(line + ")")
+		if e.ContentDiff != "" {
+			fmt.Print(e.ContentDiff)
+		}
+	}
+	log.Println(counts["added"], "added,", counts["removed"], "removed,", counts["modified"], "modified,", counts["permissions"], "with only permissions changed, for a total change of", utils.FormatCommas(delta), "bytes")
+}
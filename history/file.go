@@ -1,9 +1,11 @@
 package history
 
 import (
+	"database/sql"
 	"encoding/hex"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,7 +14,7 @@ import (
 	"github.com/leijurv/gb/db"
 )
 
-func FileHistory(path string) {
+func FileHistory(path string, follow bool) {
 	var err error
 	path, err = filepath.Abs(path)
 	if err != nil {
@@ -23,11 +25,56 @@ func FileHistory(path string) {
 	if strings.HasSuffix(path, "/") {
 		log.Println("It is unlikely for a file to end in \"/\"...")
 	}
-	rows, err := db.DB.Query(`SELECT files.start, files.end, files.permissions, files.fs_modified, sizes.size, files.hash FROM files INNER JOIN sizes ON sizes.hash = files.hash WHERE files.path = ? ORDER BY files.start`, path)
-	db.Must(err)
-	defer rows.Close()
 	log.Println()
 	log.Println("Revision start - Revision end: permissions, filesystem modified, size, hash")
+	if !follow {
+		printRevisions(path, 0, math.MaxInt64)
+		log.Println("Done")
+		return
+	}
+	// print oldest first
+	segments := FollowMoves(path)
+	for i := len(segments) - 1; i >= 0; i-- {
+		if i < len(segments)-1 {
+			log.Println("Moved from", segments[i+1].Path, "to", segments[i].Path, "at", time.Unix(segments[i].Since, 0).Format(time.RFC3339))
+		}
+		printRevisions(segments[i].Path, segments[i].Since, segments[i].Until)
+	}
+	log.Println("Done")
+}
+
+// a path, and the span of time in which its revisions are part of a history that FollowMoves followed
+type Segment struct {
+	Path  string
+	Since int64 // the first revision of the run that was moved here, or 0 for every revision if it wasn't moved from anywhere
+	Until int64 // only the revisions before it was moved away, in case something else was at this path later
+}
+
+// path, then where it was moved from, then where that was moved from, and so on
+func FollowMoves(path string) []Segment {
+	segments := []Segment{{path, 0, math.MaxInt64}}
+	for {
+		curr := &segments[len(segments)-1]
+		// the newest run of back to back revisions, since a move only begins one. anything before a gap was something else that was here, and wasn't moved
+		var start sql.NullInt64
+		err := db.DB.QueryRow(`SELECT MAX(start) FROM files curr WHERE path = ? AND start < ? AND NOT EXISTS (SELECT 1 FROM files prev WHERE prev.path = curr.path AND prev.end = curr.start)`, curr.Path, curr.Until).Scan(&start)
+		db.Must(err)
+		if !start.Valid {
+			return segments
+		}
+		from, ok := MovedFrom(curr.Path, start.Int64)
+		if !ok {
+			return segments
+		}
+		curr.Since = start.Int64
+		segments = append(segments, Segment{from, 0, start.Int64})
+	}
+}
+
+func printRevisions(path string, since int64, until int64) {
+	rows, err := db.DB.Query(`SELECT files.start, files.end, files.permissions, files.fs_modified, sizes.size, files.hash FROM files INNER JOIN sizes ON sizes.hash = files.hash WHERE files.path = ? AND files.start >= ? AND files.start < ? ORDER BY files.start`, path, since, until)
+	db.Must(err)
+	defer rows.Close()
 	for rows.Next() {
 		var start int64
 		var end *int64
@@ -55,5 +102,4 @@ func FileHistory(path string) {
 		log.Println(line)
 	}
 	db.Must(rows.Err())
-	log.Println("Done")
 }
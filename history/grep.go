@@ -0,0 +1,48 @@
+package history
+
+import (
+	"encoding/hex"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/leijurv/gb/contentindex"
+	"github.com/leijurv/gb/db"
+)
+
+// every revision of every path whose contents match query in the content index. nothing is downloaded
+func GrepResults(query string) []SearchResult {
+	hashes := contentindex.Matches(query)
+	log.Println(len(hashes), "different contents match")
+	stmt, err := db.DB.Prepare(`SELECT files.path, files.start, files.end, files.permissions, files.fs_modified, sizes.size FROM files INNER JOIN sizes ON sizes.hash = files.hash WHERE files.hash = ?`)
+	db.Must(err)
+	defer stmt.Close()
+	results := make([]SearchResult, 0)
+	for _, hash := range hashes {
+		func() {
+			rows, err := stmt.Query(hash)
+			db.Must(err)
+			defer rows.Close()
+			for rows.Next() {
+				r := SearchResult{Hash: hex.EncodeToString(hash)}
+				var perms os.FileMode
+				db.Must(rows.Scan(&r.Path, &r.Start, &r.End, &perms, &r.FsModified, &r.Size))
+				r.Permissions = perms.String()
+				results = append(results, r)
+			}
+			db.Must(rows.Err())
+		}()
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Path != results[j].Path {
+			return results[i].Path < results[j].Path
+		}
+		return results[i].Start < results[j].Start
+	})
+	return results
+}
+
+func Grep(query string, asJSON bool) {
+	log.Println("Searching the content index for", query)
+	printSearchResults(GrepResults(query), asJSON)
+}
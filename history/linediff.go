@@ -0,0 +1,117 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// files bigger than this aren't content diffed, it's meant for source code and notes and such
+const maxTextDiffSize = 1024 * 1024
+
+// the lcs table is len(a) by len(b), so this is what keeps it from using gigabytes
+const maxTextDiffCells = 16 * 1024 * 1024
+
+const diffContextLines = 3
+
+func looksLikeText(data []byte) bool {
+	return len(data) <= maxTextDiffSize && utf8.Valid(data) && bytes.IndexByte(data, 0) == -1
+}
+
+func splitLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// a unified diff of two text files, like diff -u
+func unifiedDiff(nameA string, nameB string, a []byte, b []byte) string {
+	linesA := splitLines(a)
+	linesB := splitLines(b)
+	if (len(linesA)+1)*(len(linesB)+1) > maxTextDiffCells {
+		return fmt.Sprintf("(%d and %d lines is too many to diff)\n", len(linesA), len(linesB))
+	}
+	// lcs[i][j] is the length of the longest common subsequence of linesA[i:] and linesB[j:]
+	lcs := make([][]int32, len(linesA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(linesB)+1)
+	}
+	for i := len(linesA) - 1; i >= 0; i-- {
+		for j := len(linesB) - 1; j >= 0; j-- {
+			if linesA[i] == linesB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	// ' ' for a line in both, '-' for only in a, '+' for only in b
+	type op struct {
+		kind byte
+		line string
+		i, j int // position in a and b before this line
+	}
+	ops := make([]op, 0)
+	i, j := 0, 0
+	for i < len(linesA) || j < len(linesB) {
+		switch {
+		case i < len(linesA) && j < len(linesB) && linesA[i] == linesB[j]:
+			ops = append(ops, op{' ', linesA[i], i, j})
+			i++
+			j++
+		case i < len(linesA) && (j == len(linesB) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, op{'-', linesA[i], i, j})
+			i++
+		default:
+			ops = append(ops, op{'+', linesB[j], i, j})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString("--- " + nameA + "\n")
+	out.WriteString("+++ " + nameB + "\n")
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		// a hunk runs from a change until there's more than twice the context of unchanged lines in a row
+		hunkStart := max(start-diffContextLines, 0)
+		end := start
+		for unchanged := 0; end < len(ops) && unchanged <= 2*diffContextLines; end++ {
+			if ops[end].kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		// back off to just the trailing context
+		for end > start && ops[end-1].kind == ' ' {
+			end--
+		}
+		end = min(end+diffContextLines, len(ops))
+		countA, countB := 0, 0
+		for _, o := range ops[hunkStart:end] {
+			if o.kind != '+' {
+				countA++
+			}
+			if o.kind != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", ops[hunkStart].i+1, countA, ops[hunkStart].j+1, countB)
+		for _, o := range ops[hunkStart:end] {
+			out.WriteByte(o.kind)
+			out.WriteString(o.line)
+			if !strings.HasSuffix(o.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = end
+	}
+	return out.String()
+}
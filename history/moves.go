@@ -0,0 +1,74 @@
+package history
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leijurv/gb/db"
+)
+
+// a path that stopped existing in the same backup that another path started existing with the same contents
+// if old had been edited rather than deleted, or new had existed already, it'd be a copy, not a move
+// empty files are left out, since there are so many of them that they'd be matched up with each other all the time
+const moveCondition = `old.hash = new.hash AND old.end = new.start AND old.path != new.path
+	AND NOT EXISTS (SELECT 1 FROM files f WHERE f.path = old.path AND f.start = old.end)
+	AND NOT EXISTS (SELECT 1 FROM files f WHERE f.path = new.path AND f.end = new.start)
+	AND (SELECT size FROM sizes WHERE sizes.hash = new.hash) > 0`
+
+type Move struct {
+	From string
+	To   string
+	At   int64 // the backup that noticed
+	Hash []byte
+	Size int64
+}
+
+// where the revision of path that started at start was moved from, if it was
+func MovedFrom(path string, start int64) (string, bool) {
+	var from string
+	err := db.DB.QueryRow(`SELECT old.path FROM files new INNER JOIN files old ON `+moveCondition+` WHERE new.path = ? AND new.start = ? ORDER BY old.path LIMIT 1`, path, start).Scan(&from)
+	if err == sql.ErrNoRows {
+		return "", false
+	}
+	db.Must(err)
+	return from, true
+}
+
+// every move from or to somewhere in prefix, in a backup at or after since
+func DetectMoves(prefix string, since int64) []Move {
+	rows, err := db.DB.Query(`SELECT old.path, new.path, new.start, new.hash, sizes.size FROM files new INNER JOIN files old ON `+moveCondition+` INNER JOIN sizes ON sizes.hash = new.hash WHERE new.start >= ? AND (new.path `+db.StartsWithPattern(2)+` OR old.path `+db.StartsWithPattern(2)+`) ORDER BY new.start, new.path`, since, prefix)
+	db.Must(err)
+	defer rows.Close()
+	moves := make([]Move, 0)
+	for rows.Next() {
+		var m Move
+		db.Must(rows.Scan(&m.From, &m.To, &m.At, &m.Hash, &m.Size))
+		moves = append(moves, m)
+	}
+	db.Must(rows.Err())
+	return moves
+}
+
+func Moves(prefix string, since int64) {
+	var err error
+	prefix, err = filepath.Abs(prefix)
+	if err != nil {
+		panic(err)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	log.Println("Looking for files moved from or to", prefix, "since", time.Unix(since, 0).Format(time.RFC3339))
+	moves := DetectMoves(prefix, since)
+	log.Println()
+	log.Println("Timestamp: old path -> new path, size, hash")
+	for _, m := range moves {
+		log.Println(time.Unix(m.At, 0).Format(time.RFC3339) + ": " + m.From + " -> " + m.To + ", " + fmt.Sprint(m.Size) + ", " + hex.EncodeToString(m.Hash))
+	}
+	log.Println(len(moves), "moves")
+}
@@ -2,60 +2,160 @@ package history
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/leijurv/gb/db"
 )
 
-func Search(input string) {
-	query := `SELECT files.path, files.start, files.end, files.permissions, files.fs_modified, sizes.size, files.hash FROM files INNER JOIN sizes ON sizes.hash = files.hash WHERE `
-	var arg any
-	if hash, err := hex.DecodeString(input); err == nil && len(hash) == 32 {
-		query += "files.hash = ?"
-		arg = hash
-		log.Println("Query by hash:", input)
-	} else {
-		query += "files.path LIKE ?"
-		arg = "%" + input + "%"
-		log.Println("Query is:", arg)
-	}
-	rows, err := db.DB.Query(query, arg)
+// every field narrows the search down further, the zero value finds every revision of everything
+type SearchOptions struct {
+	Query      string   // a substring of the path, or a whole hash in hex
+	Regex      string   // against the whole path
+	MinSize    int64    // in bytes, inclusive
+	MaxSize    int64    // in bytes, inclusive, or 0 for no limit
+	ExistedAt  int64    // only the revisions that were current as of this timestamp
+	Deleted    bool     // only paths that don't exist anymore
+	Extensions []string // case insensitive, with or without the dot
+	HashPrefix string   // in hex
+	SortBy     string   // path (the default), size (largest first), or date (most recently modified first)
+	JSON       bool
+}
+
+type SearchResult struct {
+	Path        string `json:"path"`
+	Start       int64  `json:"start"`
+	End         *int64 `json:"end"` // null for current
+	Permissions string `json:"permissions"`
+	FsModified  int64  `json:"fs_modified"`
+	Size        int64  `json:"size"`
+	Hash        string `json:"hash"`
+}
+
+func SearchResults(opts SearchOptions) []SearchResult {
+	query := `SELECT files.path, files.start, files.end, files.permissions, files.fs_modified, sizes.size, files.hash FROM files INNER JOIN sizes ON sizes.hash = files.hash`
+	conditions := make([]string, 0)
+	args := make([]any, 0)
+	if hash, err := hex.DecodeString(opts.Query); err == nil && len(hash) == 32 {
+		conditions = append(conditions, "files.hash = ?")
+		args = append(args, hash)
+		log.Println("Query by hash:", opts.Query)
+	} else if opts.Query != "" {
+		conditions = append(conditions, "files.path LIKE ?")
+		args = append(args, "%"+opts.Query+"%")
+		log.Println("Query is:", "%"+opts.Query+"%")
+	}
+	if opts.MinSize != 0 {
+		conditions = append(conditions, "sizes.size >= ?")
+		args = append(args, opts.MinSize)
+	}
+	if opts.MaxSize != 0 {
+		conditions = append(conditions, "sizes.size <= ?")
+		args = append(args, opts.MaxSize)
+	}
+	if opts.ExistedAt != 0 {
+		// the same as download.QueryBase
+		conditions = append(conditions, "files.start <= ? AND (files.end > ? OR files.end IS NULL)")
+		args = append(args, opts.ExistedAt, opts.ExistedAt)
+	}
+	if opts.Deleted {
+		conditions = append(conditions, "NOT EXISTS (SELECT 1 FROM files curr WHERE curr.path = files.path AND curr.end IS NULL)")
+	}
+	if len(opts.Extensions) > 0 {
+		byExt := make([]string, 0, len(opts.Extensions))
+		for _, ext := range opts.Extensions {
+			byExt = append(byExt, "files.path LIKE ? COLLATE NOCASE")
+			args = append(args, "%."+strings.TrimPrefix(ext, "."))
+		}
+		conditions = append(conditions, "("+strings.Join(byExt, " OR ")+")")
+	}
+	if opts.HashPrefix != "" {
+		if _, err := hex.DecodeString(opts.HashPrefix + strings.Repeat("0", len(opts.HashPrefix)%2)); err != nil {
+			panic("hash prefix must be hex")
+		}
+		conditions = append(conditions, "HEX(files.hash) LIKE ?")
+		args = append(args, strings.ToUpper(opts.HashPrefix)+"%")
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	switch opts.SortBy {
+	case "", "path":
+		query += " ORDER BY files.path, files.start"
+	case "size":
+		query += " ORDER BY sizes.size DESC, files.path, files.start"
+	case "date":
+		query += " ORDER BY files.fs_modified DESC, files.path, files.start"
+	default:
+		panic("can only sort by path, size, or date")
+	}
+	var re *regexp.Regexp
+	if opts.Regex != "" {
+		// sqlite doesn't come with REGEXP, so this one is done here
+		re = regexp.MustCompile(opts.Regex)
+	}
+
+	rows, err := db.DB.Query(query, args...)
 	db.Must(err)
 	defer rows.Close()
-	log.Println()
-	log.Println("Path: revision start - revision end: permissions, filesystem modified, size, hash")
+	results := make([]SearchResult, 0)
 	for rows.Next() {
-		var path string
-		var start int64
-		var end *int64
+		var r SearchResult
 		var perms os.FileMode
-		var fsModified int64
-		var size int64
 		var hash []byte
-		db.Must(rows.Scan(&path, &start, &end, &perms, &fsModified, &size, &hash))
+		db.Must(rows.Scan(&r.Path, &r.Start, &r.End, &perms, &r.FsModified, &r.Size, &hash))
+		if re != nil && !re.MatchString(r.Path) {
+			continue
+		}
+		r.Permissions = perms.String()
+		r.Hash = hex.EncodeToString(hash)
+		results = append(results, r)
+	}
+	db.Must(rows.Err())
+	return results
+}
+
+func Search(opts SearchOptions) {
+	printSearchResults(SearchResults(opts), opts.JSON)
+}
+
+func printSearchResults(results []SearchResult, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(results); err != nil {
+			panic(err)
+		}
+		return
+	}
+	log.Println()
+	log.Println("Path: revision start - revision end: permissions, filesystem modified, size, hash")
+	for _, r := range results {
 		line := ""
-		line += path
+		line += r.Path
 		line += ": "
-		line += time.Unix(start, 0).Format(time.RFC3339)
+		line += time.Unix(r.Start, 0).Format(time.RFC3339)
 		line += " - "
-		if end == nil {
+		if r.End == nil {
 			line += "current"
 		} else {
-			line += time.Unix(*end, 0).Format(time.RFC3339)
+			line += time.Unix(*r.End, 0).Format(time.RFC3339)
 		}
 		line += ": "
-		line += fmt.Sprint(perms)
+		line += r.Permissions
 		line += ", "
-		line += time.Unix(fsModified, 0).Format(time.RFC3339)
+		line += time.Unix(r.FsModified, 0).Format(time.RFC3339)
 		line += ", "
-		line += fmt.Sprint(size)
+		line += fmt.Sprint(r.Size)
 		line += ", "
-		line += hex.EncodeToString(hash)
+		line += r.Hash
 		log.Println(line)
 	}
-	db.Must(rows.Err())
+	log.Println(len(results), "results")
 	log.Println("Done")
 }
@@ -0,0 +1,125 @@
+package history
+
+import (
+	"encoding/hex"
+	"log"
+	"os"
+	"time"
+
+	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/utils"
+)
+
+// a path that held some contents, from start until end (nil for still there)
+type ContentRevision struct {
+	Path  string
+	Start int64
+	End   *int64
+}
+
+// a blob in a storage that has some contents in it
+type ContentBlob struct {
+	Storage string // label
+	BlobID  []byte
+	Path    string // in the storage
+}
+
+// everywhere hash has ever been backed up from, and everywhere it's stored
+func FindContent(hash []byte) ([]ContentRevision, []ContentBlob) {
+	rows, err := db.DB.Query(`SELECT path, start, end FROM files WHERE hash = ? ORDER BY path, start`, hash)
+	db.Must(err)
+	defer rows.Close()
+	revisions := make([]ContentRevision, 0)
+	for rows.Next() {
+		var rev ContentRevision
+		db.Must(rows.Scan(&rev.Path, &rev.Start, &rev.End))
+		revisions = append(revisions, rev)
+	}
+	db.Must(rows.Err())
+
+	rows, err = db.DB.Query(`SELECT storage.readable_label, blob_storage.blob_id, blob_storage.path FROM blob_entries INNER JOIN blob_storage ON blob_storage.blob_id = blob_entries.blob_id INNER JOIN storage ON storage.storage_id = blob_storage.storage_id WHERE blob_entries.hash = ? ORDER BY storage.readable_label`, hash)
+	db.Must(err)
+	defer rows.Close()
+	blobs := make([]ContentBlob, 0)
+	for rows.Next() {
+		var blob ContentBlob
+		db.Must(rows.Scan(&blob.Storage, &blob.BlobID, &blob.Path))
+		blobs = append(blobs, blob)
+	}
+	db.Must(rows.Err())
+	return revisions, blobs
+}
+
+// arg is either a file on disk, or a sha256 in hex
+func Whereis(arg string) {
+	hash, err := hex.DecodeString(arg)
+	if _, statErr := os.Stat(arg); statErr == nil || err != nil || len(hash) != 32 {
+		hash = hashLocalFile(arg)
+		if hash == nil {
+			return
+		}
+	} else {
+		log.Println("Looking up hash", arg)
+	}
+	var size int64
+	if err := db.DB.QueryRow("SELECT size FROM sizes WHERE hash = ?", hash).Scan(&size); err != nil {
+		log.Println("gb has never seen these contents, so they are NOT backed up")
+		return
+	}
+	revisions, blobs := FindContent(hash)
+	log.Println()
+	log.Println("Size", utils.FormatCommas(size), "bytes, hash", hex.EncodeToString(hash))
+	log.Println()
+	log.Println("Paths that have held these contents: revision start - revision end")
+	for _, rev := range revisions {
+		end := "current"
+		if rev.End != nil {
+			end = time.Unix(*rev.End, 0).Format(time.RFC3339)
+		}
+		log.Println(rev.Path + ": " + time.Unix(rev.Start, 0).Format(time.RFC3339) + " - " + end)
+	}
+	if len(revisions) == 0 {
+		log.Println("None (it's stored, but no backed up path has ever had it)")
+	}
+	log.Println()
+	log.Println("Stored in: storage, blob id, path in storage")
+	for _, blob := range blobs {
+		log.Println(blob.Storage + ", " + hex.EncodeToString(blob.BlobID) + ", " + blob.Path)
+	}
+	if len(blobs) == 0 {
+		log.Println("Nowhere! These contents are NOT backed up")
+	} else {
+		log.Println("These contents are backed up in", len(blobs), "places")
+	}
+}
+
+// nil if it definitely isn't backed up, which can be told from the size without reading it
+func hashLocalFile(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		panic(err)
+	}
+	if !utils.NormalFile(stat) {
+		panic(path + " is not a normal file")
+	}
+	var count int64
+	db.Must(db.DB.QueryRow("SELECT COUNT(*) FROM sizes WHERE size = ?", stat.Size()).Scan(&count))
+	if count == 0 {
+		log.Println("gb has never seen anything of size", utils.FormatCommas(stat.Size()), "bytes, so", path, "is NOT backed up")
+		return nil
+	}
+	log.Println("Hashing", path, "since gb has seen", count, "different contents of size", utils.FormatCommas(stat.Size()), "bytes")
+	hs := utils.NewSHA256HasherSizer()
+	utils.Copy(&hs, f)
+	hash, size := hs.HashAndSize()
+	if size != stat.Size() {
+		panic(path + " changed while it was being hashed")
+	}
+	log.Println("Hash is", hex.EncodeToString(hash))
+	return hash
+}
@@ -5,12 +5,16 @@ import (
 	"errors"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/araddon/dateparse"
 	"github.com/leijurv/gb/backup"
+	"github.com/leijurv/gb/compression"
 	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/contentindex"
 	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/dbbackups"
 	"github.com/leijurv/gb/download"
 	"github.com/leijurv/gb/dupes"
 	"github.com/leijurv/gb/gbfs"
@@ -22,6 +26,7 @@ import (
 	"github.com/leijurv/gb/share"
 	"github.com/leijurv/gb/stats"
 	"github.com/leijurv/gb/storage"
+	"github.com/leijurv/gb/storage_base"
 	"github.com/leijurv/gb/utils"
 	"github.com/urfave/cli"
 )
@@ -245,16 +250,143 @@ func main() {
 		{
 			Name:  "history",
 			Usage: "give revision history of a specific file (not a directory)",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "follow",
+					Usage: "also show the history from before the file was moved or renamed here",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				history.FileHistory(c.Args().First(), c.Bool("follow"))
+				return nil
+			},
+		},
+		{
+			Name:  "moves",
+			Usage: "list files that were moved or renamed from or to somewhere in a directory",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "only moves after this date",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				since, err := parseTimestamp(c.String("since"))
+				if err != nil {
+					return err
+				}
+				history.Moves(c.Args().First(), since)
+				return nil
+			},
+		},
+		{
+			Name:      "whereis",
+			Usage:     "find out if a file's contents are backed up, under any path at any time",
+			ArgsUsage: "<local-file-or-sha256>",
 			Action: func(c *cli.Context) error {
-				history.FileHistory(c.Args().First())
+				if c.NArg() != 1 {
+					return errors.New("give a file, or a sha256 in hex")
+				}
+				history.Whereis(c.Args().First())
 				return nil
 			},
 		},
 		{
 			Name:  "search",
-			Usage: "search for any path containing the given argument",
+			Usage: "search for any path containing the given argument (or with that hash), narrowed down by any of the options",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "regex",
+					Usage: "only paths matching this regex",
+				},
+				cli.Int64Flag{
+					Name:  "min-size",
+					Usage: "only files at least this many bytes",
+				},
+				cli.Int64Flag{
+					Name:  "max-size",
+					Usage: "only files at most this many bytes",
+				},
+				cli.StringFlag{
+					Name:  "existed-at",
+					Usage: "only the revisions that existed at this date",
+				},
+				cli.BoolFlag{
+					Name:  "deleted",
+					Usage: "only files that don't currently exist",
+				},
+				cli.StringSliceFlag{
+					Name:  "ext",
+					Usage: "only files with this extension (can be given more than once)",
+				},
+				cli.StringFlag{
+					Name:  "hash-prefix",
+					Usage: "only files whose hash starts with this (hex)",
+				},
+				cli.StringFlag{
+					Name:  "sort",
+					Usage: "path, size (largest first), or date (most recently modified first)",
+					Value: "path",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print as json to stdout",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				existedAt, err := parseTimestamp(c.String("existed-at"))
+				if err != nil {
+					return err
+				}
+				history.Search(history.SearchOptions{
+					Query:      c.Args().First(),
+					Regex:      c.String("regex"),
+					MinSize:    c.Int64("min-size"),
+					MaxSize:    c.Int64("max-size"),
+					ExistedAt:  existedAt,
+					Deleted:    c.Bool("deleted"),
+					Extensions: c.StringSlice("ext"),
+					HashPrefix: c.String("hash-prefix"),
+					SortBy:     c.String("sort"),
+					JSON:       c.Bool("json"),
+				})
+				return nil
+			},
+		},
+		{
+			Name:      "grep",
+			Usage:     "find files by their contents, using the index that's built during backup when content_index is on in the config (and by reindex)",
+			ArgsUsage: "<query>, e.g. word, \"a phrase\" (with the quotes), prefix*, or this AND that",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print as json to stdout",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				history.Search(c.Args().First())
+				if c.NArg() != 1 {
+					return errors.New("give one query (in quotes if it's more than one word)")
+				}
+				history.Grep(c.Args().First(), c.Bool("json"))
+				return nil
+			},
+		},
+		{
+			Name:  "reindex",
+			Usage: "add everything that's backed up but not in the content index yet (such as what was backed up before content_index was turned on) to it. reads from your filesystem where the file there is unchanged, and downloads the rest",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "label",
+					Usage: "storage label",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				stor, ok := storage.StorageSelect(c.String("label"))
+				if !ok {
+					return nil
+				}
+				backup.DBKey()
+				contentindex.Reindex(stor)
 				return nil
 			},
 		},
@@ -266,10 +398,80 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:      "diff",
+			Usage:     "list what was added, removed, modified and had its permissions changed in a file or directory between two times",
+			ArgsUsage: "<path> <timestamp-a> [timestamp-b, defaults to now]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print as json to stdout",
+				},
+				cli.BoolFlag{
+					Name:  "content",
+					Usage: "also show a diff of the contents of modified text files (downloaded from storage)",
+				},
+				cli.StringFlag{
+					Name:  "label",
+					Usage: "storage label, for --content",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() < 2 || c.NArg() > 3 {
+					return errors.New("usage: gb diff <path> <timestamp-a> [timestamp-b]")
+				}
+				a, err := parseTimestamp(c.Args().Get(1))
+				if err != nil {
+					return err
+				}
+				b, err := parseTimestamp(c.Args().Get(2))
+				if err != nil {
+					return err
+				}
+				if b == 0 {
+					b = time.Now().Unix()
+				}
+				var stor storage_base.Storage
+				if c.Bool("content") {
+					var ok bool
+					stor, ok = storage.StorageSelect(c.String("label"))
+					if !ok {
+						return nil
+					}
+				}
+				history.Diff(c.Args().First(), a, b, c.Bool("json"), c.Bool("content"), stor)
+				return nil
+			},
+		},
 		{
 			Name:  "mnemonic",
 			Usage: "print out database encryption key mnemonic",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "passphrase",
+					Usage: "instead, print out the key encrypted with a passphrase",
+				},
+				cli.IntFlag{
+					Name:  "shares",
+					Usage: "instead, split the key into this many mnemonics (shamir secret sharing)",
+				},
+				cli.IntFlag{
+					Name:  "threshold",
+					Usage: "how many of the --shares are needed to recover the key",
+				},
+			},
 			Action: func(c *cli.Context) error {
+				if c.Bool("passphrase") {
+					backup.PassphraseWrappedKey(backup.DBKey())
+					return nil
+				}
+				if c.Int("shares") != 0 || c.Int("threshold") != 0 {
+					if c.Int("threshold") < 2 || c.Int("threshold") > c.Int("shares") || c.Int("shares") > 255 {
+						return errors.New("need 2 <= threshold <= shares <= 255")
+					}
+					backup.SplitMnemonic(backup.DBKey(), c.Int("threshold"), c.Int("shares"))
+					return nil
+				}
 				backup.Mnemonic(backup.DBKey())
 				return nil
 			},
@@ -307,6 +509,54 @@ func main() {
 					Name:  "label",
 					Usage: "storage label",
 				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "continue an interrupted restore of the same path to the same destination",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "instead of restoring to disk, write a tar or zip of it to --output",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "where to write the archive for --format, - for stdout",
+				},
+				cli.StringSliceFlag{
+					Name:  "include",
+					Usage: "only restore files matching this glob, e.g. \"*.jpg\" or \"photos/2019\" (can be given more than once)",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "don't restore files matching this glob, e.g. \"node_modules\" (can be given more than once)",
+				},
+				cli.StringSliceFlag{
+					Name:  "include-regex",
+					Usage: "only restore files whose full path matches this regex (can be given more than once)",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude-regex",
+					Usage: "don't restore files whose full path matches this regex (can be given more than once)",
+				},
+				cli.StringFlag{
+					Name:  "newer-than",
+					Usage: "only restore files last modified after this date",
+				},
+				cli.Int64Flag{
+					Name:  "larger-than",
+					Usage: "only restore files larger than this many bytes",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print what would be written, overwritten, skipped and downloaded, without changing anything",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the --dry-run plan as json to stdout",
+				},
+				cli.StringFlag{
+					Name:  "deleted-since",
+					Usage: "only restore files that were deleted after this date (and haven't been brought back), as they were right before",
+				},
 			},
 			Action: func(c *cli.Context) error {
 				stor, ok := storage.StorageSelect(c.String("label"))
@@ -317,8 +567,55 @@ func main() {
 				if err != nil {
 					return err
 				}
+				newerThan, err := parseTimestamp(c.String("newer-than"))
+				if err != nil {
+					return err
+				}
+				filter := download.RestoreFilter{
+					Include:      c.StringSlice("include"),
+					Exclude:      c.StringSlice("exclude"),
+					IncludeRegex: c.StringSlice("include-regex"),
+					ExcludeRegex: c.StringSlice("exclude-regex"),
+					NewerThan:    newerThan,
+					LargerThan:   c.Int64("larger-than"),
+				}
+				deletedSince, err := parseTimestamp(c.String("deleted-since"))
+				if err != nil {
+					return err
+				}
+				if deletedSince != 0 && timestamp != 0 {
+					return errors.New("--deleted-since restores each file as it was right before it was deleted, so it can't also have a timestamp")
+				}
+				if c.Bool("json") && !c.Bool("dry-run") {
+					return errors.New("--json is only for --dry-run")
+				}
+				if c.String("format") != "" {
+					if c.Bool("dry-run") {
+						return errors.New("--dry-run isn't supported for archives")
+					}
+					if deletedSince != 0 {
+						return errors.New("--deleted-since can't be written to an archive")
+					}
+					if c.String("output") == "" {
+						return errors.New("--format needs an --output (which can be - for stdout)")
+					}
+					if c.NArg() > 1 {
+						return errors.New("the archive goes to --output, not a destination path")
+					}
+					if c.Bool("resume") {
+						return errors.New("an archive can't be resumed")
+					}
+					download.RestoreArchive(c.Args().Get(0), c.String("format"), c.String("output"), timestamp, filter, stor)
+					return nil
+				}
 				// restore prints out the timestamp for confirmation, no need to do it twice
-				download.Restore(c.Args().Get(0), c.Args().Get(1), timestamp, stor)
+				download.Restore(c.Args().Get(0), c.Args().Get(1), timestamp, download.RestoreOptions{
+					Resume:       c.Bool("resume"),
+					Filter:       filter,
+					DeletedSince: deletedSince,
+					DryRun:       c.Bool("dry-run"),
+					JSON:         c.Bool("json"),
+				}, stor)
 				return nil
 			},
 		},
@@ -333,6 +630,16 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "redeflate-decompress",
+			Usage: "decompress redeflate from stdin to stdout, for the bash command that gb paranoia blob prints",
+			Action: func(c *cli.Context) error {
+				d := (&compression.RedeflateCompression{}).Decompress(os.Stdin)
+				defer d.Close()
+				utils.Copy(os.Stdout, d)
+				return nil
+			},
+		},
 		{
 			Name:  "proxy",
 			Usage: "proxy",
@@ -367,9 +674,253 @@ func main() {
 		},
 		{
 			Name:  "restoredb",
-			Usage: "restore an encrypted and compressed database backup",
+			Usage: "restore an encrypted and compressed database backup, either from a local file, or the newest one straight from storage (give --s3-bucket etc, --gdrive-folder, or --label)",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "label",
+					Usage: "storage label, if the local database still knows about your storage",
+				},
+				cli.StringFlag{
+					Name:  "s3-bucket",
+					Usage: "s3 bucket",
+				},
+				cli.StringFlag{
+					Name:  "s3-path",
+					Usage: "path in the bucket that gb writes to",
+				},
+				cli.StringFlag{
+					Name:  "s3-region",
+					Usage: "AWS region of your bucket, e.g. us-east-1",
+				},
+				cli.StringFlag{
+					Name:  "s3-keyid",
+					Usage: "AWS key id (the shorter one)",
+				},
+				cli.StringFlag{
+					Name:  "s3-secretkey",
+					Usage: "AWS secret key (the longer one)",
+				},
+				cli.StringFlag{
+					Name:  "s3-endpoint",
+					Usage: "Override the s3 endpoint to another, for example you could put: backblazeb2.com",
+				},
+				cli.StringFlag{
+					Name:  "gdrive-folder",
+					Usage: "ID of the gb folder in Google Drive (you'll need credentials.json, same as when adding the storage)",
+				},
+				cli.StringFlag{
+					Name:  "at",
+					Usage: "restore the newest database backup as of this time, instead of the newest one overall",
+				},
+				cli.StringFlag{
+					Name:  "output-dir",
+					Value: ".",
+					Usage: "where to download the database backup to (the decrypted database is written next to it)",
+				},
+				cli.BoolFlag{
+					Name:  "list",
+					Usage: "just list the database backups in storage",
+				},
+				cli.BoolFlag{
+					Name:  "incrementals",
+					Usage: "when restoring a local full database backup, also apply every incremental backup next to it (giving an incremental always applies the ones up to it)",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				download.RestoreDB(c.Args().First())
+				if c.Args().First() != "" {
+					download.RestoreDB(c.Args().First(), c.Bool("incrementals"))
+					return nil
+				}
+				var stor storage_base.Storage
+				if c.String("s3-bucket") != "" {
+					for _, thing := range []string{"s3-region", "s3-keyid", "s3-secretkey"} {
+						if c.String(thing) == "" {
+							return errors.New("give me a " + thing)
+						}
+					}
+					stor = storage.S3StorageWithoutDatabase(c.String("s3-bucket"), c.String("s3-path"), c.String("s3-region"), c.String("s3-keyid"), c.String("s3-secretkey"), c.String("s3-endpoint"))
+				} else if c.String("gdrive-folder") != "" {
+					stor = storage.GDriveStorageWithoutDatabase(c.String("gdrive-folder"))
+				} else {
+					var ok bool
+					stor, ok = storage.StorageSelect(c.String("label"))
+					if !ok {
+						return errors.New("give me a path to a database backup, or where to find them (--s3-bucket etc, --gdrive-folder, or --label)")
+					}
+				}
+				if c.Bool("list") {
+					dbbackups.PrintList(stor)
+					return nil
+				}
+				timestamp, err := parseTimestamp(c.String("at"))
+				if err != nil {
+					return err
+				}
+				download.RestoreDBFromStorage(stor, timestamp, c.String("output-dir"))
+				return nil
+			},
+		},
+		{
+			Name:  "db-backups",
+			Usage: "the encrypted database backups that are uploaded to storage after every backup",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list database backups in each storage, with size and timestamp",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "label",
+							Usage: "storage label (default: every storage)",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						for _, stor := range dbBackupStorages(c.String("label")) {
+							dbbackups.PrintList(stor)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "prune",
+					Usage: "delete old database backups. the newest one that passes verification is never deleted",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "label",
+							Usage: "storage label (default: every storage)",
+						},
+						cli.IntFlag{
+							Name:  "keep",
+							Usage: "keep the newest N database backups",
+						},
+						cli.IntFlag{
+							Name:  "keep-daily",
+							Usage: "keep the newest database backup of each of the newest N days that have one",
+						},
+						cli.IntFlag{
+							Name:  "keep-weekly",
+							Usage: "keep the newest database backup of each of the newest N weeks that have one",
+						},
+						cli.IntFlag{
+							Name:  "keep-monthly",
+							Usage: "keep the newest database backup of each of the newest N months that have one",
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "only print what would be deleted",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						policy := dbbackups.RetentionPolicy{
+							Keep:    c.Int("keep"),
+							Daily:   c.Int("keep-daily"),
+							Weekly:  c.Int("keep-weekly"),
+							Monthly: c.Int("keep-monthly"),
+						}
+						if policy.Empty() {
+							return errors.New("give me at least one of --keep, --keep-daily, --keep-weekly, --keep-monthly")
+						}
+						key := backup.DBKey()
+						for _, stor := range dbBackupStorages(c.String("label")) {
+							dbbackups.Prune(stor, key, policy, c.Bool("dry-run"))
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "rotate-db-key",
+			Usage: "generate a new database encryption key (and mnemonic), and upload a fresh database backup encrypted with it",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "delete-old-backups",
+					Usage: "once the fresh database backup is verified, delete every database backup from before the rotation (they're readable with the old key)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if len(storage.GetAll()) == 0 {
+					return errors.New("make a storage first")
+				}
+				oldKey, newKey := backup.RotateDBKey()
+				share.RekeyShares(oldKey)
+				storages := storage.GetAll()
+				timestamp := backup.ReserveSessionTimestamp()
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							log.Println("The database key was rotated, but the fresh database backup under the new key FAILED, so there is no backup that the new key can decrypt yet. Run `gb backup` to make one")
+							panic(r)
+						}
+					}()
+					backup.BackupDB()
+				}()
+				if c.Bool("delete-old-backups") {
+					for _, stor := range storages {
+						dbbackups.DeleteBefore(stor, timestamp, newKey)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "generate-keypair",
+			Usage:     "generate an X25519 keypair for write-only backups: with just the public key, a machine can back up, but can't decrypt anything",
+			ArgsUsage: "/path/to/write/private/key",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return errors.New("give me a path to write the private key to")
+				}
+				path, err := filepath.Abs(c.Args().First())
+				if err != nil {
+					return err
+				}
+				backup.GenerateKeyPair(path)
+				return nil
+			},
+		},
+		{
+			Name:  "seal-keys",
+			Usage: "seal every plaintext blob entry key in the database to the configured public_key",
+			Action: func(c *cli.Context) error {
+				backup.SealExistingKeys()
+				return nil
+			},
+		},
+		{
+			Name:  "train-dict",
+			Usage: "train a zstd dictionary on a sample of the small files that are backed up, to compress small files from now on much better",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "extension",
+					Usage: "only train on (and use the dictionary for) files with this extension, e.g. json",
+				},
+				cli.IntFlag{
+					Name:  "samples",
+					Value: 10000,
+					Usage: "how many files to sample",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				backup.TrainZstdDict(c.String("extension"), c.Int("samples"))
+				return nil
+			},
+		},
+		{
+			Name:      "compression-bench",
+			Usage:     "try every compression algorithm (and some zstd levels) on a sample of your files, grouped by extension, and suggest no_compression_exts and compression_rules",
+			ArgsUsage: "<path>",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "samples",
+					Usage: "max number of files to try per extension",
+					Value: 20,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return errors.New("give me a path to benchmark on")
+				}
+				compression.Bench(c.Args().First(), c.Int("samples"))
 				return nil
 			},
 		},
@@ -417,7 +968,7 @@ func main() {
 		},
 		{
 			Name:  "upgrade-encryption",
-			Usage: "find blobs that contain multiple files and use old style encryption, and repack them with unique encryption keys for each entry",
+			Usage: "find blobs that contain multiple files and use old style encryption, and repack them with unique encryption keys for each entry. also repacks anything not yet in the configured blob_encryption",
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "label",
@@ -429,6 +980,35 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "recompress",
+			Usage: "repack every entry compressed with one algorithm to use another, e.g. after changing compression_rules. old blobs are deleted from storage once the new ones are verified",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "label",
+					Usage: "storage label",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "compression_alg of the entries to recompress (--from= for uncompressed)",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "compression to use instead (--to= for uncompressed)",
+				},
+				cli.StringFlag{
+					Name:  "path-prefix",
+					Usage: "only recompress files under this path",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if !c.IsSet("from") || !c.IsSet("to") {
+					return errors.New("give me --from and --to")
+				}
+				repack.Recompress(c.String("label"), c.String("from"), c.String("to"), c.String("path-prefix"))
+				return nil
+			},
+		},
 		{
 			Name:  "mount",
 			Usage: "mount a readonly FUSE filesystem",
@@ -446,12 +1026,23 @@ func main() {
 					Name:  "label",
 					Usage: "storage label",
 				},
+				cli.BoolFlag{
+					Name:  "snapshots",
+					Usage: "instead of one point in time, have a directory for every backup (named by its timestamp), and every revision of every file in by-path/<file>/@versions/",
+				},
 			},
 			Action: func(c *cli.Context) error {
+				if c.Bool("snapshots") && c.String("at") != "" {
+					return errors.New("--snapshots shows every timestamp, so it can't be used with --at")
+				}
 				stor, ok := storage.StorageSelect(c.String("label"))
 				if !ok {
 					return nil
 				}
+				if c.Bool("snapshots") {
+					gbfs.MountSnapshots(c.Args().First(), c.String("path"), stor)
+					return nil
+				}
 				timestamp, err := parseTimestamp(c.String("at"))
 				if err != nil {
 					return err
@@ -568,3 +1159,14 @@ func parseTimestamp(timestamp string) (int64, error) {
 	}
 	return 0, nil
 }
+
+func dbBackupStorages(label string) []storage_base.Storage {
+	if label == "" {
+		return storage.GetAll()
+	}
+	stor, ok := storage.StorageSelect(label)
+	if !ok {
+		panic("no storage with that label")
+	}
+	return []storage_base.Storage{stor}
+}
@@ -10,9 +10,9 @@ import (
 	"strings"
 
 	"github.com/leijurv/gb/compression"
-	"github.com/leijurv/gb/config"
 	"github.com/leijurv/gb/crypto"
 	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/download"
 	"github.com/leijurv/gb/storage"
 	"github.com/leijurv/gb/storage_base"
 	"github.com/leijurv/gb/utils"
@@ -67,6 +67,15 @@ func BlobReaderParanoia(outerReader io.Reader, blobID []byte, storage storage_ba
 }
 
 func BlobReaderParanoiaWithCallback(outerReader io.Reader, blobID []byte, storage storage_base.Storage, callback func(hash []byte, data []byte)) int64 {
+	return blobReaderParanoia(outerReader, blobID, storage, callback, nil)
+}
+
+// calls verified with the hash of each entry once it's been checked, without holding onto the entry's data like BlobReaderParanoiaWithCallback does
+func BlobReaderParanoiaVerified(outerReader io.Reader, blobID []byte, storage storage_base.Storage, verified func(hash []byte)) int64 {
+	return blobReaderParanoia(outerReader, blobID, storage, nil, verified)
+}
+
+func blobReaderParanoia(outerReader io.Reader, blobID []byte, storage storage_base.Storage, callback func(hash []byte, data []byte), verified func(hash []byte)) int64 {
 	log.Println("Running paranoia on", hex.EncodeToString(blobID), "in storage", storage)
 	if len(blobID) != 32 {
 		panic("sanity check")
@@ -79,23 +88,26 @@ func BlobReaderParanoiaWithCallback(outerReader io.Reader, blobID []byte, storag
 	hasherPostEnc := utils.NewSHA256HasherSizer()
 	encReader := io.TeeReader(outerReader, &hasherPostEnc)
 
-	rows, err := db.DB.Query(`SELECT hash, encryption_key, final_size, offset, compression_alg, size FROM blob_entries INNER JOIN sizes USING (hash) WHERE blob_id = ? ORDER BY offset, final_size`, blobID) // the ", final_size" serves to ensure that the empty entry comes before the nonempty entry at the same offset
+	rows, err := db.DB.Query(`SELECT hash, encryption_key, sealed_key, final_size, offset, compression_alg, encryption_alg, size FROM blob_entries INNER JOIN sizes USING (hash) WHERE blob_id = ? ORDER BY offset, final_size`, blobID) // the ", final_size" serves to ensure that the empty entry comes before the nonempty entry at the same offset
 	db.Must(err)
 	defer rows.Close()
 	for rows.Next() {
 		var hash []byte
 		var key []byte
+		var sealedKey []byte
 		var entrySize int64
 		var offset int64
 		var compressionAlg string
+		var encryption string
 		var expectedSize int64
-		db.Must(rows.Scan(&hash, &key, &entrySize, &offset, &compressionAlg, &expectedSize))
+		db.Must(rows.Scan(&hash, &key, &sealedKey, &entrySize, &offset, &compressionAlg, &encryption, &expectedSize))
+		key = download.EntryKey(key, sealedKey)
 		if hasherPostEnc.Size() != offset {
 			panic("got misaligned somehow. gap between entries??")
 		}
 		log.Println("Expected hash for this entry is " + hex.EncodeToString(hash) + ", decompressing...")
 		verify := utils.NewSHA256HasherSizer()
-		decompressedReader := utils.ReadCloserToReader(compression.ByAlgName(compressionAlg).Decompress(io.LimitReader(crypto.DecryptBlobEntry(encReader, offset, key), entrySize)))
+		decompressedReader := utils.ReadCloserToReader(compression.ByAlgName(compressionAlg).Decompress(crypto.DecryptFullBlobEntry(io.LimitReader(encReader, entrySize), encryption, key, offset, entrySize)))
 		var data []byte
 		if callback != nil {
 			// Buffer the decompressed data so we can pass it to the callback
@@ -120,11 +132,11 @@ func BlobReaderParanoiaWithCallback(outerReader io.Reader, blobID []byte, storag
 		}
 		log.Println("Hash is equal!")
 		if callback != nil {
-			if realSize >= config.Config().MinBlobSize {
-				panic("entry size is >= MinBlobSize, this should not be repacked")
-			}
 			callback(realHash, data)
 		}
+		if verified != nil {
+			verified(realHash)
+		}
 	}
 	db.Must(rows.Err())
 	remain, err := ioutil.ReadAll(crypto.DecryptBlobEntry(encReader, hasherPostEnc.Size(), paddingKey))
@@ -18,6 +18,9 @@ type Querier interface {
 	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
+// blob_entries.final_size is after encryption, and aes-gcm-chunked adds a 16 byte tag per 64KiB chunk (and always has at least one chunk)
+const decryptedSize = "(CASE blob_entries.encryption_alg WHEN 'aes-gcm-chunked' THEN blob_entries.final_size - 16 * ((blob_entries.final_size + 65551) / 65552) ELSE blob_entries.final_size END)"
+
 var queriesThatShouldHaveNoRows = []string{
 	// god i wish these could be database constraints :(
 	"SELECT files.hash FROM files LEFT OUTER JOIN blob_entries ON files.hash = blob_entries.hash WHERE blob_entries.hash IS NULL",                                                                    // have a file, but it isn't backed up
@@ -102,11 +105,11 @@ var queriesThatShouldHaveNoRows = []string{
 	// prior to the gb epoch (first commit)
 	"SELECT hash FROM files WHERE start < 1572924988",
 
-	// uncompressed entries should have final_size = sizes.size
-	"SELECT blob_entries.hash FROM blob_entries INNER JOIN sizes ON blob_entries.hash = sizes.hash WHERE blob_entries.compression_alg = '' AND blob_entries.final_size != sizes.size",
+	// uncompressed entries should have final_size = sizes.size (once decrypted)
+	"SELECT blob_entries.hash FROM blob_entries INNER JOIN sizes ON blob_entries.hash = sizes.hash WHERE blob_entries.compression_alg = '' AND " + decryptedSize + " != sizes.size",
 
 	// lepton should never make a file larger
-	"SELECT blob_entries.hash FROM blob_entries INNER JOIN sizes ON blob_entries.hash = sizes.hash WHERE blob_entries.compression_alg = 'lepton' AND blob_entries.final_size > sizes.size",
+	"SELECT blob_entries.hash FROM blob_entries INNER JOIN sizes ON blob_entries.hash = sizes.hash WHERE blob_entries.compression_alg = 'lepton' AND " + decryptedSize + " > sizes.size",
 
 	// currently understood storages
 	`
@@ -122,8 +125,12 @@ var queriesThatShouldHaveNoRows = []string{
 	SELECT blob_id FROM blob_entries WHERE compression_alg NOT IN (
 		'',
 		'zstd',
-		'lepton'
-	)
+		'lepton',
+		'xz',
+		'brotli',
+		'lz4',
+		'redeflate'
+	) AND compression_alg NOT IN (SELECT 'zstd-dict-' || dict_id FROM zstd_dictionaries)
 	`,
 
 	// lepton is only used on jpgs
@@ -150,7 +157,8 @@ var queriesThatShouldHaveNoRows = []string{
 	`,
 
 	// encryption keys should not be reused across different blobs
-	"SELECT encryption_key FROM blob_entries GROUP BY encryption_key HAVING COUNT(DISTINCT blob_id) > 1",
+	"SELECT encryption_key FROM blob_entries WHERE encryption_key IS NOT NULL GROUP BY encryption_key HAVING COUNT(DISTINCT blob_id) > 1",
+	"SELECT sealed_key FROM blob_entries WHERE sealed_key IS NOT NULL GROUP BY sealed_key HAVING COUNT(DISTINCT blob_id) > 1",
 
 	// permissions should be 0-511 (9 bits)
 	"SELECT hash FROM files WHERE permissions < 0 OR permissions > 511",
@@ -202,7 +210,7 @@ var queriesThatShouldHaveNoRows = []string{
 	WITH distinct_keys AS (
 		SELECT
 			blob_id,
-			COUNT(DISTINCT encryption_key) AS cnt
+			COUNT(DISTINCT COALESCE(encryption_key, sealed_key)) AS cnt
 		FROM
 			blob_entries
 		GROUP BY
@@ -228,7 +236,19 @@ var queriesThatShouldHaveNoRows = []string{
 	`,
 
 	// older blobs with 1 encryption key should not be shared
-	"SELECT blob_id FROM blob_entries WHERE blob_id IN (SELECT blob_id FROM share_entries) GROUP BY blob_id HAVING COUNT(DISTINCT encryption_key) = 1 AND COUNT(*) > 1",
+	"SELECT blob_id FROM blob_entries WHERE blob_id IN (SELECT blob_id FROM share_entries) GROUP BY blob_id HAVING COUNT(DISTINCT COALESCE(encryption_key, sealed_key)) = 1 AND COUNT(*) > 1",
+
+	// entries are encrypted with something we know how to decrypt
+	"SELECT hash FROM blob_entries WHERE encryption_alg NOT IN ('', 'aes-gcm-chunked')",
+
+	// aes-gcm-chunked has at least one chunk, and so at least one tag
+	"SELECT hash FROM blob_entries WHERE encryption_alg = 'aes-gcm-chunked' AND final_size < 16",
+
+	// webshare can only decrypt AES-CTR
+	"SELECT hash FROM share_entries INNER JOIN blob_entries USING (hash, blob_id) WHERE encryption_alg != ''",
+
+	// or decompress anything other than zstd and lepton
+	"SELECT hash FROM share_entries INNER JOIN blob_entries USING (hash, blob_id) WHERE compression_alg NOT IN ('', 'zstd', 'lepton')",
 
 	// ensure ordinals are contiguous
 	"SELECT password FROM share_entries GROUP BY password HAVING MIN(ordinal) != 0 OR MAX(ordinal) != COUNT(*) - 1",
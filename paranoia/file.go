@@ -115,7 +115,9 @@ func paranoia(path string, info os.FileInfo, level int) {
 				blob_entries.offset,
 				blob_entries.final_size,
 				blob_entries.compression_alg,
+				blob_entries.encryption_alg,
 				blob_entries.encryption_key,
+				blob_entries.sealed_key,
 				blobs.size,
 				blob_storage.path,
 				blob_storage.checksum,
@@ -123,7 +125,7 @@ func paranoia(path string, info os.FileInfo, level int) {
 				storage.type,
 				storage.identifier,
 				storage.root_path,
-				(SELECT COUNT(*) FROM blob_entries sibling WHERE sibling.blob_id = blob_entries.blob_id AND sibling.encryption_key = blob_entries.encryption_key) AS shared_key_count
+				(SELECT COUNT(*) FROM blob_entries sibling WHERE sibling.blob_id = blob_entries.blob_id AND COALESCE(sibling.encryption_key, sibling.sealed_key) = COALESCE(blob_entries.encryption_key, blob_entries.sealed_key)) AS shared_key_count
 			FROM files
 				INNER JOIN blob_entries ON blob_entries.hash = files.hash
 				INNER JOIN blobs ON blobs.blob_id = blob_entries.blob_id
@@ -140,7 +142,9 @@ func paranoia(path string, info os.FileInfo, level int) {
 		var offset int64
 		var length int64
 		var compressionAlg string
+		var encryption string
 		var key []byte
+		var sealedKey []byte
 		var finalSize int64
 		var pathInStorage string
 		var checksum string
@@ -150,7 +154,8 @@ func paranoia(path string, info os.FileInfo, level int) {
 		var rootPath string
 		var sharedKeyCount int
 
-		db.Must(rows.Scan(&hash, &blobID, &offset, &length, &compressionAlg, &key, &finalSize, &pathInStorage, &checksum, &storageID, &kind, &identifier, &rootPath, &sharedKeyCount))
+		db.Must(rows.Scan(&hash, &blobID, &offset, &length, &compressionAlg, &encryption, &key, &sealedKey, &finalSize, &pathInStorage, &checksum, &storageID, &kind, &identifier, &rootPath, &sharedKeyCount))
+		key = download.EntryKey(key, sealedKey)
 		log.Println("This file can be found in blob ID", hex.EncodeToString(blobID), "which is located in storage", kind, "at the path", pathInStorage, "decrypting with key", hex.EncodeToString(key), "seeking", offset, "bytes in and reading", length, "bytes from there, and decompressing using", compressionAlg)
 
 		// Create the storage object to try generating a presigned URL
@@ -196,8 +201,15 @@ func paranoia(path string, info os.FileInfo, level int) {
 			cmd += "{ dd bs=" + strconv.FormatInt(remainingSeek, 10) + " skip=1 count=0 status=none; cat; } | "
 		}
 		cmd += "head -c " + strconv.FormatInt(length, 10) + compression.ByAlgName(compressionAlg).DecompressionTrollBashCommandIncludingThePipe() + " | shasum -a 256"
-		log.Println(cmd)
-		log.Println("And ensure it outputs the hash of the file, which is", hex.EncodeToString(hash))
+		if encryption == crypto.BlobEncryptionCTR {
+			if compression.IsZstdDictAlgName(compressionAlg) {
+				log.Println("(It was compressed with a trained zstd dictionary, so first write that to the current directory with `" + compression.ZstdDictExportCommand(compressionAlg) + "`)")
+			}
+			log.Println(cmd)
+			log.Println("And ensure it outputs the hash of the file, which is", hex.EncodeToString(hash))
+		} else {
+			log.Println("This entry is encrypted with", encryption, "which (unlike AES-CTR) can't be decrypted with a one line openssl command, so there is no command to verify it by hand, sorry. `gb cat "+hex.EncodeToString(hash)+" | shasum -a 256` checks the same thing")
+		}
 
 		if sharedKeyCount > 1 {
 			log.Printf("WARNING: If you share this bash command, you will inadvertently reveal the contents of %d other file(s), since this was backed up with an older version of gb that shared encryption keys across distinct files in a single blob. To fix this, you can `gb repack` this blob to have distinct encryption keys per entry.", sharedKeyCount-1)
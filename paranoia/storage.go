@@ -51,6 +51,10 @@ func StorageParanoia(deleteUnknownFiles bool) bool {
 			if strings.HasPrefix(k.path, "share/") {
 				continue
 			}
+			// so are copies of the zstd dictionaries (which are in the database anyway)
+			if strings.HasPrefix(k.path, "zstd-dict-") {
+				continue
+			}
 			log.Println("UNKNOWN / UNEXPECTED FILE!!")
 			log.Println("Storage:", storage.GetByID(k.storageID[:]))
 			log.Println("Info:", v)
@@ -25,19 +25,21 @@ func ServeHashOverHTTP(hash []byte, w http.ResponseWriter, req *http.Request, st
 	var blobID []byte
 	var path string
 	var key []byte
+	var sealedKey []byte
 	var compressedSize int64
 	var offsetIntoBlob int64
 	var comp string
+	var encryption string
 	err = db.DB.QueryRow(
-		"SELECT blob_entries.blob_id, blob_entries.encryption_key, blob_storage.path, blob_entries.final_size, blob_entries.offset, blob_entries.compression_alg FROM blob_entries INNER JOIN blob_storage ON blob_storage.blob_id = blob_entries.blob_id INNER JOIN blobs ON blobs.blob_id = blob_storage.blob_id WHERE blob_entries.hash = ? AND blob_storage.storage_id = ?",
-		hash, storage.GetID()).Scan(&blobID, &key, &path, &compressedSize, &offsetIntoBlob, &comp)
+		"SELECT blob_entries.blob_id, blob_entries.encryption_key, blob_entries.sealed_key, blob_storage.path, blob_entries.final_size, blob_entries.offset, blob_entries.compression_alg, blob_entries.encryption_alg FROM blob_entries INNER JOIN blob_storage ON blob_storage.blob_id = blob_entries.blob_id INNER JOIN blobs ON blobs.blob_id = blob_storage.blob_id WHERE blob_entries.hash = ? AND blob_storage.storage_id = ?",
+		hash, storage.GetID()).Scan(&blobID, &key, &sealedKey, &path, &compressedSize, &offsetIntoBlob, &comp, &encryption)
 	db.Must(err)
+	key = download.EntryKey(key, sealedKey)
 	log.Println(req)
 	log.Println("Offset into blob", offsetIntoBlob)
-	claimedLength := compressedSize
+	claimedLength := crypto.BlobEntryPlaintextLength(encryption, compressedSize)
 	// ^ seems like a bit of a footgun, but since Range header isn't supported with compression, it doesn't cause any issues?
-	// for compressed files, it needs to be this way for storoage.DownloadSection and crypto.DecryptBlobEntry, but for Range queries it's user-defined
-	seekStart := offsetIntoBlob
+	// for compressed files, it needs to be this way for storoage.DownloadSection and crypto.DecryptBlobEntryRange, but for Range queries it's user-defined
 	var requestedStart int64
 	respondWithRange := false
 	if clientHasRange {
@@ -52,27 +54,29 @@ func ServeHashOverHTTP(hash []byte, w http.ResponseWriter, req *http.Request, st
 		lower := strings.Split(r, "-")[0]
 		upper := strings.Split(r, "-")[1]
 		requestedStart, err = strconv.ParseInt(lower, 10, 64)
-		seekStart += requestedStart
 		if err != nil {
 			panic(err)
 		}
 		if upper == "" {
 			claimedLength = realContentLength - requestedStart
-			req.Header.Set("Range", "bytes="+strconv.FormatInt(seekStart, 10)+"-")
 		} else {
 			upperP, err := strconv.ParseInt(upper, 10, 64)
 			if err != nil {
 				panic(err)
 			}
 			claimedLength = upperP - requestedStart + 1
-			req.Header.Set("Range", "bytes="+strconv.FormatInt(seekStart, 10)+"-"+strconv.FormatInt(seekStart+claimedLength-1, 10))
 		}
-		log.Println("Updated range to", req.Header["Range"][0])
-		respondWithRange = true
-	} else {
-		if offsetIntoBlob != 0 {
-			req.Header.Set("Range", "bytes="+strconv.FormatInt(seekStart, 10)+"-"+strconv.FormatInt(seekStart+claimedLength-1, 10))
+		if requestedStart+claimedLength > realContentLength {
+			claimedLength = realContentLength - requestedStart // don't read into the next entry
 		}
+		respondWithRange = true
+	}
+	// for aes-gcm-chunked, this is rounded out to whole chunks
+	fetchStart, fetchLength := crypto.BlobEntryRange(encryption, compressedSize, requestedStart, claimedLength)
+	seekStart := offsetIntoBlob + fetchStart
+	if clientHasRange || seekStart != 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(seekStart, 10)+"-"+strconv.FormatInt(seekStart+fetchLength-1, 10))
+		log.Println("Updated range to", req.Header["Range"][0])
 	}
 	fullRead := !clientHasRange || (requestedStart == 0 && claimedLength == realContentLength)
 
@@ -96,13 +100,13 @@ func ServeHashOverHTTP(hash []byte, w http.ResponseWriter, req *http.Request, st
 		}
 		data = resp.Body
 	} else {
-		data = cache.DownloadSection(storage, path, seekStart, claimedLength)
+		data = cache.DownloadSection(storage, path, seekStart, fetchLength)
 		//data = storage.DownloadSection(path, seekStart, claimedLength)
 
 	}
 	defer data.Close()
 
-	decrypted := crypto.DecryptBlobEntry(io.LimitReader(data, claimedLength), seekStart, key)
+	decrypted := crypto.DecryptBlobEntryRange(data, encryption, key, offsetIntoBlob, compressedSize, requestedStart, claimedLength)
 	reader := compression.ByAlgName(comp).Decompress(decrypted)
 	if fullRead {
 		reader = download.WrapWithHashVerification(reader, hash, realContentLength)
@@ -0,0 +1,123 @@
+package repack
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/leijurv/gb/compression"
+	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/paranoia"
+	"github.com/leijurv/gb/storage"
+	"github.com/leijurv/gb/utils"
+)
+
+// rewrite every entry compressed with from (optionally, only files under pathPrefix) to be compressed with to instead
+// once the new blobs are verified, the old ones are deleted from storage
+func Recompress(label string, from string, to string, pathPrefix string) {
+	toCompression := compression.ByAlgName(to)
+	if toCompression == nil {
+		panic("unknown compression algorithm \"" + to + "\"")
+	}
+	if from == to {
+		panic("--from and --to are the same")
+	}
+	stor, ok := storage.StorageSelect(label)
+	if !ok {
+		return
+	}
+	log.Println("Running paranoia db check...")
+	paranoia.DBParanoia()
+	log.Println("Paranoia checks passed")
+
+	query := "SELECT hash, blob_id, final_size FROM blob_entries WHERE compression_alg = ?"
+	args := []interface{}{from}
+	if pathPrefix != "" {
+		query += " AND hash IN (SELECT hash FROM files WHERE path " + db.StartsWithPattern(2) + ")"
+		args = append(args, pathPrefix)
+	}
+	rows, err := db.DB.Query(query, args...)
+	db.Must(err)
+	forced := make(map[[32]byte]compression.Compression)
+	blobIDs := make([][]byte, 0)
+	seenBlobIDs := make(map[[32]byte]bool)
+	var before int64
+	for rows.Next() {
+		var hash []byte
+		var blobID []byte
+		var finalSize int64
+		db.Must(rows.Scan(&hash, &blobID, &finalSize))
+		forced[utils.SliceToArr(hash)] = toCompression
+		before += finalSize
+		if !seenBlobIDs[utils.SliceToArr(blobID)] {
+			seenBlobIDs[utils.SliceToArr(blobID)] = true
+			blobIDs = append(blobIDs, blobID)
+		}
+	}
+	db.Must(rows.Err())
+	rows.Close()
+	if len(forced) == 0 {
+		log.Println("There are no entries compressed with \"" + from + "\" to recompress")
+		return
+	}
+	if !compression.WebshareCanDecompress(to) {
+		shared := 0
+		for hash := range forced {
+			if isShared(hash[:]) {
+				shared++
+			}
+		}
+		if shared > 0 {
+			panic(strconv.Itoa(shared) + " of these entries are shared, and the webshare page can't decompress \"" + to + "\", so they'd have to stay webshare compatible. Leave them out with --path-prefix, or remove the shares")
+		}
+	}
+	log.Println("Recompressing", len(forced), "entries in", len(blobIDs), "blobs from \""+from+"\" to \""+to+"\"")
+
+	// where the old blobs are, since the repack removes them from the database
+	type storedBlob struct {
+		storageID []byte
+		path      string
+	}
+	oldBlobs := make([]storedBlob, 0)
+	for _, blobID := range blobIDs {
+		rows, err := db.DB.Query("SELECT storage_id, path FROM blob_storage WHERE blob_id = ?", blobID)
+		db.Must(err)
+		for rows.Next() {
+			var b storedBlob
+			db.Must(rows.Scan(&b.storageID, &b.path))
+			oldBlobs = append(oldBlobs, b)
+		}
+		db.Must(rows.Err())
+		rows.Close()
+	}
+
+	// this panics unless every forced entry ended up compressed with to (checked before the database is changed),
+	// and every entry of every new blob decompressed to the right hash in every storage, so past this point the old blobs are no longer needed
+	newBlobs := repackBlobIDs(blobIDs, stor, true, forced)
+
+	var after int64
+	uncompressed := 0
+	for _, blob := range newBlobs {
+		for _, entry := range blob.entries {
+			if _, ok := forced[utils.SliceToArr(entry.hash)]; ok {
+				after += entry.postCompressionSize
+				if entry.compression != to {
+					uncompressed++
+				}
+			}
+		}
+	}
+	if uncompressed > 0 {
+		log.Println(uncompressed, "entries couldn't be compressed with \""+to+"\", so they're stored uncompressed instead")
+	}
+
+	log.Println("Deleting", len(oldBlobs), "old blobs from storage")
+	for _, b := range oldBlobs {
+		log.Println("Deleting", b.path, "from", storage.GetByID(b.storageID))
+		storage.GetByID(b.storageID).DeleteBlob(b.path)
+	}
+	if after <= before {
+		log.Println("Recompressed", len(forced), "entries from", utils.FormatCommas(before), "bytes to", utils.FormatCommas(after), "bytes, saving", utils.FormatCommas(before-after), "bytes")
+	} else {
+		log.Println("Recompressed", len(forced), "entries from", utils.FormatCommas(before), "bytes to", utils.FormatCommas(after), "bytes, which is", utils.FormatCommas(after-before), "bytes larger")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +17,7 @@ import (
 	"github.com/leijurv/gb/config"
 	"github.com/leijurv/gb/crypto"
 	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/download"
 	"github.com/leijurv/gb/paranoia"
 	"github.com/leijurv/gb/share"
 	"github.com/leijurv/gb/storage"
@@ -24,9 +26,20 @@ import (
 )
 
 // Entry represents a hash and its decompressed data
+// a large entry is streamed straight from storage when it's uploaded instead, so that it isn't held in memory
 type Entry struct {
 	Hash []byte
 	Data []byte
+
+	size   int64                // of a streamed entry
+	stream func() io.ReadCloser // nil unless this is streamed
+}
+
+func (e Entry) open() (io.ReadCloser, int64) {
+	if e.stream != nil {
+		return e.stream(), e.size
+	}
+	return io.NopCloser(bytes.NewReader(e.Data)), int64(len(e.Data))
 }
 
 // blobEntry tracks metadata for each entry in a new blob
@@ -37,6 +50,8 @@ type blobEntry struct {
 	postCompressionSize int64
 	preCompressionSize  int64
 	compression         string
+	sampled             string
+	encryption          string
 }
 
 // newBlobData holds all data for a new blob being created
@@ -114,9 +129,12 @@ func Repack(label string, mode RepackMode) {
 		db.Must(rows.Err())
 		rows.Close()
 	case UpgradeEncryption:
+		// also anything not yet in the configured blob_encryption (other than shared files, see entryEncryption)
 		rows, err := db.DB.Query(`
-			SELECT blob_id FROM blob_entries GROUP BY blob_id HAVING COUNT(DISTINCT encryption_key) = 1 AND COUNT(*) > 1
-		`)
+			SELECT blob_id FROM blob_entries GROUP BY blob_id HAVING COUNT(DISTINCT COALESCE(encryption_key, sealed_key)) = 1 AND COUNT(*) > 1
+			UNION
+			SELECT DISTINCT blob_id FROM blob_entries WHERE encryption_alg != ? AND hash NOT IN (SELECT hash FROM share_entries)
+		`, config.Config().BlobEncryption)
 		db.Must(err)
 		for rows.Next() {
 			var blobID []byte
@@ -127,15 +145,21 @@ func Repack(label string, mode RepackMode) {
 		rows.Close()
 	}
 
-	RepackBlobIDs(blobIDs, stor, false)
+	RepackBlobIDs(blobIDs, stor, mode == UpgradeEncryption) // a large file alone in its blob still needs to be repacked to change its encryption
 }
 
 // RepackBlobIDs repacks the specified blob IDs using the given storage for downloading.
 // If allowSingleEntryBlobs is true, blobs with only one entry will also be repacked (useful for testing).
 func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntryBlobs bool) {
+	repackBlobIDs(blobIDs, stor, allowSingleEntryBlobs, nil)
+}
+
+// forced is the compression to use for some hashes, instead of what SelectCompressionForPath would choose
+// returns the new blobs, which have all been verified
+func repackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntryBlobs bool, forced map[[32]byte]compression.Compression) []newBlobData {
 	if len(blobIDs) == 0 {
 		log.Println("No blob IDs provided")
-		return
+		return nil
 	}
 	seenBlobIDs := make(map[[32]byte]bool)
 	for _, blobID := range blobIDs {
@@ -151,14 +175,19 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 	blobsToProcess := make([][]byte, 0)
 	hashDedupe := make(map[[32]byte]struct{}) // tracks hashes we've "claimed" (either large skipped or will process)
 	blobsToDelete := make([][]byte, 0)        // large blobs that are duplicates and should just be deleted
+	blobsToStream := make([][]byte, 0)        // blobs of one large entry, that's streamed rather than downloaded into memory (only if allowSingleEntryBlobs)
+	streamed := make([]Entry, 0)
 	for _, blobID := range blobIDs {
-		rows, err := db.DB.Query(`SELECT hash FROM blob_entries WHERE blob_id = ?`, blobID)
+		rows, err := db.DB.Query(`SELECT hash, size FROM blob_entries INNER JOIN sizes USING (hash) WHERE blob_id = ?`, blobID)
 		db.Must(err)
 		var hashes [][]byte
+		var sizes []int64
 		for rows.Next() {
 			var hash []byte
-			db.Must(rows.Scan(&hash))
+			var size int64
+			db.Must(rows.Scan(&hash, &size))
 			hashes = append(hashes, hash)
+			sizes = append(sizes, size)
 		}
 		db.Must(rows.Err())
 		rows.Close()
@@ -193,14 +222,32 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 			}
 			continue
 		}
+		if len(hashes) == 1 && sizes[0] >= config.Config().MinBlobSize {
+			hashArr := utils.SliceToArr(hashes[0])
+			if _, exists := hashDedupe[hashArr]; exists {
+				log.Println("Blob", hex.EncodeToString(blobID), "is a duplicate large blob - will be deleted")
+				blobsToDelete = append(blobsToDelete, blobID)
+				continue
+			}
+			hashDedupe[hashArr] = struct{}{}
+			hash := hashes[0]
+			streamed = append(streamed, Entry{Hash: hash, size: sizes[0], stream: func() io.ReadCloser {
+				tx, err := db.DB.Begin()
+				db.Must(err)
+				defer tx.Rollback()
+				return download.CatReadCloser(hash, tx, stor) // this verifies the hash, and so does uploadEntries
+			}})
+			blobsToStream = append(blobsToStream, blobID)
+			continue
+		}
 		blobsToProcess = append(blobsToProcess, blobID)
 	}
 
-	if len(blobsToProcess) == 0 && len(blobsToDelete) == 0 {
+	if len(blobsToProcess) == 0 && len(blobsToStream) == 0 && len(blobsToDelete) == 0 {
 		log.Println("No blobs need repacking or deleting")
-		return
+		return nil
 	}
-	log.Println("Will repack", len(blobsToProcess), "blobs")
+	log.Println("Will repack", len(blobsToProcess)+len(blobsToStream), "blobs")
 	if len(blobsToDelete) > 0 {
 		log.Println("Will delete", len(blobsToDelete), "duplicate large blobs")
 	}
@@ -210,7 +257,7 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 	var beforeUncompressed int64
 	var beforeCompressed int64
 	var beforeFinalSize int64
-	for _, blobID := range append(blobsToProcess, blobsToDelete...) {
+	for _, blobID := range append(append(blobsToProcess, blobsToStream...), blobsToDelete...) {
 		var blobSize int64
 		db.Must(db.DB.QueryRow("SELECT size FROM blobs WHERE blob_id = ?", blobID).Scan(&blobSize))
 		beforeFinalSize += blobSize
@@ -246,6 +293,9 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 			// (blocking on channel send can cause Backblaze to close the connection)
 			var blobEntries []Entry
 			callback := func(hash []byte, data []byte) {
+				if !allowSingleEntryBlobs && int64(len(data)) >= config.Config().MinBlobSize {
+					panic("entry size is >= MinBlobSize, this should not be repacked")
+				}
 				// Make copies since the data might be reused
 				hashCopy := make([]byte, len(hash))
 				copy(hashCopy, hash)
@@ -287,7 +337,7 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 		hashDedupe[hashArr] = struct{}{}
 
 		if int64(len(entry.Data)) >= minBlobSize {
-			newBlobs = append(newBlobs, uploadEntries([]Entry{entry}, uploadService))
+			newBlobs = append(newBlobs, uploadEntries([]Entry{entry}, uploadService, forced))
 			continue
 		}
 
@@ -297,7 +347,7 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 		// Flush when we have enough data or too many entries
 		if accumulatedSize >= minBlobSize || len(accumulated) > 5000 {
 			log.Println("Flushing", len(accumulated), "entries,", utils.FormatCommas(accumulatedSize), "bytes")
-			newBlob := uploadEntries(accumulated, uploadService)
+			newBlob := uploadEntries(accumulated, uploadService, forced)
 			newBlobs = append(newBlobs, newBlob)
 			accumulated = nil
 			accumulatedSize = 0
@@ -307,12 +357,22 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 	// Flush remaining entries
 	if len(accumulated) > 0 {
 		log.Println("Flushing remaining", len(accumulated), "entries,", utils.FormatCommas(accumulatedSize), "bytes")
-		newBlob := uploadEntries(accumulated, uploadService)
+		newBlob := uploadEntries(accumulated, uploadService, forced)
 		newBlobs = append(newBlobs, newBlob)
 	}
 
+	for i, entry := range streamed {
+		log.Println("Streaming large entry", i+1, "of", len(streamed), ":", hex.EncodeToString(entry.Hash), "-", utils.FormatCommas(entry.size), "bytes")
+		newBlobs = append(newBlobs, uploadEntries([]Entry{entry}, uploadService, forced))
+	}
+
 	log.Println("Created", len(newBlobs), "new blobs")
 
+	if forced != nil {
+		// before the database is touched, so if this panics, the new blobs are just unknown files in storage
+		checkForced(newBlobs, forced)
+	}
+
 	// Step 9: Database Transaction
 	log.Println("Beginning database transaction...")
 	tx, err := db.DB.Begin()
@@ -339,8 +399,9 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 
 		// Insert blob_entries records
 		for _, entry := range blob.entries {
-			_, err = tx.Exec("INSERT INTO blob_entries (hash, blob_id, encryption_key, final_size, offset, compression_alg) VALUES (?, ?, ?, ?, ?, ?)",
-				entry.hash, blob.blobID, entry.key, entry.postCompressionSize, entry.offset, entry.compression)
+			plainKey, sealedKey := backup.EntryKeyColumns(entry.key)
+			_, err = tx.Exec("INSERT INTO blob_entries (hash, blob_id, encryption_key, sealed_key, final_size, offset, compression_alg, encryption_alg, sampled) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				entry.hash, blob.blobID, plainKey, sealedKey, entry.postCompressionSize, entry.offset, entry.compression, entry.encryption, entry.sampled)
 			db.Must(err)
 		}
 	}
@@ -371,8 +432,8 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 
 	// Delete old blob data (must delete in correct order due to foreign keys)
 	// This includes both repacked blobs and duplicate large blobs
-	allBlobsToDelete := append(blobsToProcess, blobsToDelete...)
-	log.Println("Deleting", len(allBlobsToDelete), "old blob records (", len(blobsToProcess), "repacked +", len(blobsToDelete), "duplicate large)...")
+	allBlobsToDelete := append(append(blobsToProcess, blobsToStream...), blobsToDelete...)
+	log.Println("Deleting", len(allBlobsToDelete), "old blob records (", len(blobsToProcess)+len(blobsToStream), "repacked +", len(blobsToDelete), "duplicate large)...")
 	for _, blobID := range allBlobsToDelete {
 		// Delete blob_entries first (foreign key to blobs)
 		_, err = tx.Exec("DELETE FROM blob_entries WHERE blob_id = ?", blobID)
@@ -406,23 +467,45 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 	log.Println("Repack complete!")
 	log.Println("Old blob files remain in storage - run `gb paranoia storage --delete-unknown-files` to clean them up.")
 
-	blobCh := make(chan newBlobData, len(newBlobs))
+	// every new blob is checked in every storage it was uploaded to, since that's everywhere the old ones might be deleted from
+	type uploadedBlob struct {
+		blobID []byte
+		stor   storage_base.Storage
+	}
+	blobCh := make(chan uploadedBlob)
 	var wg sync.WaitGroup
+	var verifiedLock sync.Mutex
+	verified := make(map[string]struct{}) // storage id + hash
 	for i := 0; i < 16; i++ {
 		wg.Add(1)
 		go func() {
 			for blob := range blobCh {
-				paranoia.BlobReaderParanoia(paranoia.DownloadEntireBlob(blob.blobID, stor), blob.blobID, stor)
+				paranoia.BlobReaderParanoiaVerified(paranoia.DownloadEntireBlob(blob.blobID, blob.stor), blob.blobID, blob.stor, func(hash []byte) {
+					verifiedLock.Lock()
+					defer verifiedLock.Unlock()
+					verified[string(blob.stor.GetID())+string(hash)] = struct{}{}
+				})
 			}
 			wg.Done()
 		}()
 	}
 
 	for _, blob := range newBlobs {
-		blobCh <- blob
+		for _, completed := range blob.completeds {
+			blobCh <- uploadedBlob{blob.blobID, storage.GetByID(completed.StorageID)}
+		}
 	}
 	close(blobCh)
 	wg.Wait()
+	for _, blob := range newBlobs {
+		for _, completed := range blob.completeds {
+			for _, entry := range blob.entries {
+				if _, ok := verified[string(completed.StorageID)+string(entry.hash)]; !ok {
+					panic("entry " + hex.EncodeToString(entry.hash) + " in new blob " + hex.EncodeToString(blob.blobID) + " was never verified in " + storage.GetByID(completed.StorageID).String())
+				}
+			}
+		}
+	}
 
 	// Backup the database itself
 	backup.BackupDB()
@@ -444,7 +527,7 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 	// Print summary
 	log.Println()
 	log.Printf("Before: %d blobs, %d entries, %s uncompressed, %s compressed, %s final size with padding",
-		len(blobsToProcess), beforeEntries,
+		len(blobsToProcess)+len(blobsToStream), beforeEntries,
 		utils.FormatCommas(beforeUncompressed),
 		utils.FormatCommas(beforeCompressed),
 		utils.FormatCommas(beforeFinalSize))
@@ -460,10 +543,63 @@ func RepackBlobIDs(blobIDs [][]byte, stor storage_base.Storage, allowSingleEntry
 	for _, blob := range newBlobs {
 		log.Println(strings.ToUpper(hex.EncodeToString(blob.blobID)))
 	}
+	return newBlobs
+}
+
+func isShared(hash []byte) bool {
+	var shared bool
+	db.Must(db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM share_entries WHERE hash = ?)", hash).Scan(&shared))
+	return shared
+}
+
+// webshare can only decrypt AES-CTR, so shared files stay that way
+func entryEncryption(hash []byte) string {
+	if isShared(hash) {
+		return crypto.BlobEncryptionCTR
+	}
+	return config.Config().BlobEncryption
+}
+
+// every forced entry has to have ended up in exactly one new blob, compressed the way it was supposed to be
+// (or uncompressed, if the forced compression is one that can fail, like lepton on a jpg it can't handle)
+func checkForced(newBlobs []newBlobData, forced map[[32]byte]compression.Compression) {
+	found := make(map[[32]byte]int)
+	for _, blob := range newBlobs {
+		for _, entry := range blob.entries {
+			c, ok := forced[utils.SliceToArr(entry.hash)]
+			if !ok {
+				continue
+			}
+			found[utils.SliceToArr(entry.hash)]++
+			if entry.compression != c.AlgName() && !(c.Fallible() && entry.compression == "") {
+				panic("entry " + hex.EncodeToString(entry.hash) + " was supposed to be compressed with \"" + c.AlgName() + "\" but it was compressed with \"" + entry.compression + "\" instead")
+			}
+		}
+	}
+	for hash := range forced {
+		if found[hash] != 1 {
+			panic("entry " + hex.EncodeToString(hash[:]) + " ended up in " + strconv.Itoa(found[hash]) + " new blobs instead of 1")
+		}
+	}
+}
+
+// same idea, webshare can only decompress some compressions
+func entryCompression(hash []byte, path string, size int64, forced map[[32]byte]compression.Compression) []compression.Compression {
+	options := compression.SelectCompressionForPath(path, size)
+	if c, ok := forced[utils.SliceToArr(hash)]; ok {
+		options = []compression.Compression{c, &compression.NoCompression{}}
+		if c.AlgName() == "" {
+			options = options[:1]
+		}
+	}
+	if isShared(hash) {
+		return compression.WebshareCompatible(options)
+	}
+	return options
 }
 
 // uploadEntries creates a new blob from the given entries and uploads it
-func uploadEntries(entries []Entry, uploadService backup.UploadService) newBlobData {
+func uploadEntries(entries []Entry, uploadService backup.UploadService, forced map[[32]byte]compression.Compression) newBlobData {
 	blobID := crypto.RandBytes(32)
 	rawServOut := uploadService.Begin(blobID)
 
@@ -488,16 +624,26 @@ func uploadEntries(entries []Entry, uploadService backup.UploadService) newBlobD
 		db.Must(err)
 
 		// Encrypt
-		encryptedOut, key := crypto.EncryptBlob(postEncOut, startOffset)
+		encryption := entryEncryption(entry.Hash)
+		encryptedOut, key := crypto.EncryptBlobEntry(postEncOut, startOffset, encryption)
 
 		// Compress with optimal algorithm based on file path
+		// a forced compression is exactly what was asked for, so sampling doesn't get a say
+		in, size := entry.open()
 		verify := utils.NewSHA256HasherSizer()
-		compAlg := compression.Compress(
-			compression.SelectCompressionForPath(path),
-			encryptedOut,
-			io.TeeReader(bytes.NewReader(entry.Data), &verify),
-			&verify,
-		)
+		compOptions := entryCompression(entry.Hash, path, size, forced)
+		var compAlg, sampled string
+		if _, ok := forced[utils.SliceToArr(entry.Hash)]; ok {
+			compAlg = compression.CompressWithoutSampling(compOptions, encryptedOut, io.TeeReader(in, &verify), &verify)
+		} else {
+			compAlg, sampled = compression.CompressSampled(compOptions, encryptedOut, io.TeeReader(in, &verify), &verify)
+		}
+		if err := in.Close(); err != nil {
+			panic(err)
+		}
+		if err := encryptedOut.Close(); err != nil {
+			panic(err)
+		}
 
 		realHash, realSize := verify.HashAndSize()
 		if !bytes.Equal(realHash, entry.Hash) {
@@ -514,6 +660,8 @@ func uploadEntries(entries []Entry, uploadService backup.UploadService) newBlobD
 			preCompressionSize:  realSize,
 			postCompressionSize: length,
 			compression:         compAlg,
+			sampled:             sampled,
+			encryption:          encryption,
 		})
 	}
 
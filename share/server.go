@@ -7,9 +7,12 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"log"
 
 	"github.com/leijurv/gb/backup"
 	"github.com/leijurv/gb/crypto"
+	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/storage"
 )
 
 var webShareMasterKey []byte
@@ -30,7 +33,11 @@ func WebShareMasterKey() []byte {
 // DeriveShareFilename derives the storage filename for a share from its password.
 // Returns hex-encoded HMAC, used as: share/{filename}
 func DeriveShareFilename(password string) string {
-	mac := hmac.New(sha256.New, WebShareMasterKey())
+	return deriveShareFilename(WebShareMasterKey(), password)
+}
+
+func deriveShareFilename(masterKey []byte, password string) string {
+	mac := hmac.New(sha256.New, masterKey)
 	mac.Write([]byte("filename:"))
 	mac.Write([]byte(password))
 	// Use first 16 bytes (32 hex chars) for reasonable filename length
@@ -89,3 +96,42 @@ func DecryptShareJSON(ciphertext []byte, password string) ([]byte, error) {
 	ciphertext = ciphertext[nonceSize:]
 	return gcm.Open(nil, nonce, ciphertext, nil)
 }
+
+// RekeyShares should be called after the database key is rotated. Since the master key is derived
+// from the database key, every share's filename and content key has changed, so this re-uploads
+// every share JSON under the new master key and deletes the ones under the old master key.
+// The share URLs stay the same, but the Cloudflare Worker needs the new SHARE_MASTER_KEY.
+func RekeyShares(oldDBKey []byte) {
+	oldMasterKey := crypto.ComputeMAC([]byte("webshare"), oldDBKey)
+	webShareMasterKey = nil
+	storage.GetAll() // populate the cache for GetByID
+
+	type shareInStorage struct {
+		password  string
+		storageID []byte
+	}
+	rows, err := db.DB.Query("SELECT password, storage_id FROM shares")
+	db.Must(err)
+	shares := make([]shareInStorage, 0)
+	for rows.Next() {
+		var s shareInStorage
+		db.Must(rows.Scan(&s.password, &s.storageID))
+		shares = append(shares, s)
+	}
+	db.Must(rows.Err())
+	rows.Close()
+
+	for _, s := range shares {
+		stor := storage.GetByID(s.storageID)
+		UploadShareJSON(s.password, stor)
+		for _, old := range stor.ListPrefix("share/" + deriveShareFilename(oldMasterKey, s.password)) {
+			if old.Name == "" { // exact match
+				stor.DeleteBlob(old.Path)
+			}
+		}
+	}
+	if len(shares) > 0 {
+		log.Println("Re-uploaded", len(shares), "share JSONs under the new master key")
+		log.Println("IMPORTANT: your share links will not work until you update the SHARE_MASTER_KEY secret of your Cloudflare Worker, see \"gb webshare-secrets\"")
+	}
+}
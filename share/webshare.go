@@ -17,8 +17,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/leijurv/gb/compression"
 	"github.com/leijurv/gb/config"
+	"github.com/leijurv/gb/crypto"
 	"github.com/leijurv/gb/db"
+	"github.com/leijurv/gb/download"
 	"github.com/leijurv/gb/storage"
 	"github.com/leijurv/gb/storage_base"
 	"github.com/leijurv/gb/utils"
@@ -118,16 +121,18 @@ func lookupBlobParams(hash []byte, blobID []byte, filename string, expiresAt *in
 	var offset, length, originalSize int64
 	var compressionAlg string
 	var key []byte
+	var sealedKey []byte
 	var pathInStorage string
 	err := db.DB.QueryRow(`
 		SELECT blob_entries.offset, blob_entries.final_size, blob_entries.compression_alg,
-		       blob_entries.encryption_key, blob_storage.path
+		       blob_entries.encryption_key, blob_entries.sealed_key, blob_storage.path
 		FROM blob_entries
 			INNER JOIN blob_storage ON blob_storage.blob_id = blob_entries.blob_id
 		WHERE blob_entries.hash = ? AND blob_entries.blob_id = ? AND blob_storage.storage_id = ?
 		LIMIT 1
-	`, hash, blobID, stor.GetID()).Scan(&offset, &length, &compressionAlg, &key, &pathInStorage)
+	`, hash, blobID, stor.GetID()).Scan(&offset, &length, &compressionAlg, &key, &sealedKey, &pathInStorage)
 	db.Must(err)
+	key = download.EntryKey(key, sealedKey)
 
 	db.Must(db.DB.QueryRow(`SELECT size FROM sizes WHERE hash = ?`, hash).Scan(&originalSize))
 
@@ -150,8 +155,8 @@ func lookupBlobParams(hash []byte, blobID []byte, filename string, expiresAt *in
 // sanityCheckEntry verifies the hash exists in exactly one blob_id in this storage,
 // checks that the encryption key is not shared with other entries (old blob compatibility
 // check), and populates e.blobID. Returns true if the entry has shared encryption keys
-// and needs repacking.
-func sanityCheckEntry(e *entry, stor storage_base.Storage) bool {
+// and needs repacking, and whether the webshare page can decrypt and decompress it.
+func sanityCheckEntry(e *entry, stor storage_base.Storage) (bool, bool) {
 	// Verify hash exists in exactly one blob in this storage
 	var distinctBlobCount int
 	err := db.DB.QueryRow(`
@@ -167,18 +172,22 @@ func sanityCheckEntry(e *entry, stor storage_base.Storage) bool {
 
 	// Get the blob_id and check for shared encryption keys
 	var sharedKeyCount int
+	var encryption string
+	var compressionAlg string
 	err = db.DB.QueryRow(`
 		SELECT
 			blob_entries.blob_id,
-			(SELECT COUNT(*) FROM blob_entries sibling WHERE sibling.blob_id = blob_entries.blob_id AND sibling.encryption_key = blob_entries.encryption_key) AS shared_key_count
+			blob_entries.encryption_alg,
+			blob_entries.compression_alg,
+			(SELECT COUNT(*) FROM blob_entries sibling WHERE sibling.blob_id = blob_entries.blob_id AND COALESCE(sibling.encryption_key, sibling.sealed_key) = COALESCE(blob_entries.encryption_key, blob_entries.sealed_key)) AS shared_key_count
 		FROM blob_entries
 			INNER JOIN blob_storage ON blob_storage.blob_id = blob_entries.blob_id
 		WHERE blob_entries.hash = ? AND blob_storage.storage_id = ?
 		LIMIT 1
-	`, e.hash, stor.GetID()).Scan(&e.blobID, &sharedKeyCount)
+	`, e.hash, stor.GetID()).Scan(&e.blobID, &encryption, &compressionAlg, &sharedKeyCount)
 	db.Must(err)
 
-	return sharedKeyCount > 1
+	return sharedKeyCount > 1, encryption == crypto.BlobEncryptionCTR && compression.WebshareCanDecompress(compressionAlg)
 }
 
 // webShareInternal is the core share implementation. Returns the password for password-mode shares.
@@ -258,9 +267,17 @@ func webShareInternal(inputs []string, overrideName string, label string, expiry
 
 	// Sanity check all entries and populate blobID
 	var blobsNeedingRepack []string
+	var blobsNotWebshareable []string
 	seenBlobs := make(map[string]bool)
 	for i := range resolvedInputs {
-		needsRepack := sanityCheckEntry(&resolvedInputs[i], stor)
+		needsRepack, webshareable := sanityCheckEntry(&resolvedInputs[i], stor)
+		if !webshareable {
+			blobIDHex := hex.EncodeToString(resolvedInputs[i].blobID)
+			if !seenBlobs[blobIDHex] {
+				seenBlobs[blobIDHex] = true
+				blobsNotWebshareable = append(blobsNotWebshareable, blobIDHex)
+			}
+		}
 		if needsRepack {
 			blobIDHex := hex.EncodeToString(resolvedInputs[i].blobID)
 			if !seenBlobs[blobIDHex] {
@@ -279,6 +296,15 @@ func webShareInternal(inputs []string, overrideName string, label string, expiry
 		log.Println("Then rerun this command to securely share these files.")
 		os.Exit(1)
 	}
+	if len(blobsNotWebshareable) > 0 {
+		log.Println("Some of these files are encrypted with " + crypto.BlobEncryptionChunkedGCM + " or compressed with xz, brotli, lz4 or redeflate, which the webshare page can't handle (it only does AES-CTR, and zstd or lepton).")
+		log.Println("To share them, temporarily set `blob_encryption` to \"\" and remove any `compression_rules` that apply to them (and turn off `redeflate` for pngs and zips) in your .gb.conf, and repack the affected blobs:")
+		log.Println()
+		log.Printf("printf '%s\\n' | gb repack", strings.Join(blobsNotWebshareable, "\\n"))
+		log.Println()
+		log.Println("Then rerun this command. Once they're shared, repacks will keep them webshare compatible regardless of the config.")
+		os.Exit(1)
+	}
 
 	var shareURL string
 	var password string
@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/leijurv/gb/compression"
 	"github.com/leijurv/gb/db"
 	"github.com/leijurv/gb/utils"
 )
@@ -245,6 +246,52 @@ func showCompressionStats() {
 				formatBytes(cs.OriginalSize), formatBytes(cs.CompressedSize), ratio)
 		}
 	}
+
+	showSamplingStats()
+}
+
+func showSamplingStats() {
+	rows, err := db.DB.Query(`
+		SELECT
+			be.sampled,
+			COUNT(*),
+			COALESCE(SUM(s.size), 0)
+		FROM blob_entries be
+		JOIN sizes s ON be.hash = s.hash
+		WHERE be.sampled != ''
+		GROUP BY be.sampled
+	`)
+	if err != nil {
+		log.Println("Error getting sampling stats:", err)
+		return
+	}
+	defer rows.Close()
+
+	var compressedAnyway, skipped, skippedSize int64
+	for rows.Next() {
+		var sampled string
+		var count, size int64
+		err = rows.Scan(&sampled, &count, &size)
+		if err != nil {
+			continue
+		}
+		switch sampled {
+		case compression.SampledCompressed:
+			compressedAnyway = count
+		case compression.SampledSkipped:
+			skipped = count
+			skippedSize = size
+		}
+	}
+	db.Must(rows.Err())
+
+	if compressedAnyway == 0 && skipped == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Printf("Sampling overruled the extension list for %s files: %s compressed despite no_compression_exts, %s (%s) left uncompressed\n",
+		utils.FormatCommas(compressedAnyway+skipped), utils.FormatCommas(compressedAnyway),
+		utils.FormatCommas(skipped), formatBytes(skippedSize))
 }
 
 func showTopLargestFiles() {
@@ -101,6 +101,21 @@ func NewS3Storage(label string, bucket string, root string, region string, keyid
 	} else {
 		log.Println("Will write to", root, "in bucket", bucket)
 	}
+	NewStorage("S3", s3Identifier(bucket, region, keyid, secretkey, endpoint), root, label)
+}
+
+// an S3 storage that isn't (and won't be) in the database, for when the database is what we're trying to get back
+func S3StorageWithoutDatabase(bucket string, root string, region string, keyid string, secretkey string, endpoint string) storage_base.Storage {
+	root = strings.TrimLeft(root, "/")
+	return s3.LoadS3StorageInfoFromDatabase(nil, s3Identifier(bucket, region, keyid, secretkey, endpoint), root)
+}
+
+// likewise, an existing GDrive folder (by ID), authenticating from scratch with credentials.json
+func GDriveStorageWithoutDatabase(folderID string) storage_base.Storage {
+	return gdrive.LoadGDriveStorageInfoFromDatabase(nil, gdrive.Authenticate(), folderID)
+}
+
+func s3Identifier(bucket string, region string, keyid string, secretkey string, endpoint string) string {
 	id, err := json.Marshal(s3.S3DatabaseIdentifier{
 		Bucket:    bucket,
 		KeyID:     keyid,
@@ -111,7 +126,7 @@ func NewS3Storage(label string, bucket string, root string, region string, keyid
 	if err != nil {
 		panic(err)
 	}
-	NewStorage("S3", string(id), root, label)
+	return string(id)
 }
 
 func internalCreateStorage(storageID []byte, kind string, identifier string, rootPath string) storage_base.Storage {
@@ -130,7 +145,7 @@ func RegisterMockStorage(stor storage_base.Storage, label string) {
 	cacheLock.Lock()
 	cache[utils.SliceToArr(storageID)] = stor
 	cacheLock.Unlock()
-	_, err := db.DB.Exec("INSERT INTO storage (storage_id, type, identifier, root_path, readable_label) VALUES (?, ?, ?, ?, ?)", storageID, "Mock", "mock-identifier", "/mock", label)
+	_, err := db.DB.Exec("INSERT INTO storage (storage_id, type, identifier, root_path, readable_label) VALUES (?, ?, ?, ?, ?)", storageID, "Mock", "mock-identifier-"+label, "/mock", label)
 	db.Must(err)
 }
 
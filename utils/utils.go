@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bufio"
 	"crypto/md5"
 	"crypto/sha256"
 	"database/sql"
@@ -18,6 +19,7 @@ import (
 	"unicode/utf8"
 
 	"golang.org/x/sys/unix"
+	"golang.org/x/term"
 
 	"github.com/leijurv/gb/config"
 	"github.com/leijurv/gb/db"
@@ -250,9 +252,24 @@ func FormatCommasStr(num string) string {
 	return num
 }
 
+// a line typed in without echoing it, if stdin is a terminal. otherwise (e.g. piped in) just the next line from reader
+func ReadPassphrase(reader *bufio.Reader) string {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		passphrase, err := term.ReadPassword(fd)
+		os.Stderr.WriteString("\n") // the enter wasn't echoed either
+		if err != nil {
+			panic(err)
+		}
+		return string(passphrase)
+	}
+	line, _ := reader.ReadString('\n')
+	return strings.TrimSuffix(line, "\n")
+}
+
 func IsDatabaseFile(path string) bool {
 	dbPath := config.Config().DatabaseLocation
-	return path == dbPath || path == dbPath+"-wal" || path == dbPath+"-shm"
+	return path == dbPath || path == dbPath+"-wal" || path == dbPath+"-shm" || path == dbPath+"-backupstate" || strings.HasPrefix(path, dbPath+"-restorestate-") || strings.HasPrefix(path, dbPath+"-contentindex")
 }
 
 type GBdirent struct {